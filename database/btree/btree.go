@@ -3,13 +3,23 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"project/utils"
 )
 
 const HEADER = 4
 const BTREE_PAGE_SIZE = 4096
+const BTREE_MAX_PAGE_SIZE = 16384 // keeps the 3-page scratch node within uint16 offsets
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VALUE_SIZE = 3000
+
+var (
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrCorrupt       = errors.New("corrupted tree")
+)
+
 const (
 	BNODE_NODE = 1 // internal nodes without values
 	BNODE_LEAF = 2 // leaf nodes with values
@@ -17,7 +27,7 @@ const (
 
 type BNode []byte // can be dumped to the disk
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
 }
 func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
@@ -31,20 +41,20 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 // pointers
 func (node BNode) getPtr(idx uint16) uint64 {
 	utils.Assert(idx < node.nkeys(), "Try to read a out of bound pointer")
-	pos := HEADER + 8*idx
+	pos := node.header() + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 func (node BNode) setPtr(idx uint16, val uint64) {
 	utils.Assert(idx < node.nkeys(), "Try to write a out of bound pointer")
-	pos := HEADER + 8*idx
+	pos := node.header() + 8*idx
 	binary.LittleEndian.PutUint64(node[pos:], val)
 }
 
 // offset list
 func offsetPos(node BNode, idx uint16) uint16 {
 	utils.Assert(1 <= idx && idx <= node.nkeys(), "Try to read a out of bound offset position")
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.header() + 8*node.nkeys() + 2*(idx-1)
 }
 
 func (node BNode) getOffset(idx uint16) uint16 {
@@ -64,9 +74,20 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 // key-values
 func (node BNode) kvPos(idx uint16) uint16 {
 	utils.Assert(idx <= node.nkeys(), "Try to read a out of bound key position")
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.header() + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
 }
+
+// the key, a copy for compressed leaves.
 func (node BNode) getKey(idx uint16) []byte {
+	if !node.prefixed() {
+		return node.rawKey(idx)
+	}
+	prefix, suffix := node.prefix(), node.rawKey(idx)
+	return append(append(make([]byte, 0, len(prefix)+len(suffix)), prefix...), suffix...)
+}
+
+// the key as stored, without the prefix of compressed leaves.
+func (node BNode) rawKey(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys(), "Try to read a out of bound key")
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
@@ -80,6 +101,12 @@ func (node BNode) getVal(idx uint16) []byte {
 	return node[pos+4+klen:][:vlen]
 }
 
+// a leaf with only the dummy key, what's left of a tree after its last
+// key is deleted. the root is reset to 0 instead.
+func (node BNode) dummyOnly() bool {
+	return node.btype() == BNODE_LEAF && node.nkeys() == 1
+}
+
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
@@ -87,77 +114,284 @@ func (node BNode) nbytes() uint16 {
 type BTree struct {
 	// pointer (a nonzero page number)
 	root uint64
+	// number of keys, not counting the dummy key
+	count uint64
+	// node sizes by type, 0 means BTREE_PAGE_SIZE.
+	// leaves can be made larger than internal nodes so that large values
+	// don't eat into the fan-out of the internal levels. the sizes only
+	// bound the nodes written from now on and any node that fits in its
+	// page reads back, so they aren't part of the on-disk format and can
+	// change between runs. Insert and BulkLoad refuse sizes out of range.
+	LeafPageSize     uint16
+	InternalPageSize uint16
 	// callbacks for managing on-disk pages
 	Get func(uint64) []byte // dereference a pointer
 	New func([]byte) uint64 // allocate a new page
 	Del func(uint64)        // deallocate a page
+	// optional, reports a page that no reader can see (e.g. allocated by
+	// the pending update), so that it can be modified in place.
+	Writable func(uint64) bool
+	// optional, the key order, bytes.Compare if nil. it must stay the same
+	// for the lifetime of the tree since the pages are sorted by it, and
+	// the empty key (the dummy key, also an empty start bound) sorts first.
+	Compare func(a, b []byte) int
+	// optional, write leaves with their shared key prefix stored once,
+	// see prefix.go. compressed leaves are read either way.
+	PrefixCompression bool
+	// optional, counts the operations on the tree
+	Metrics *Metrics
+	// optional, don't merge a node with a sibling when a delete leaves it
+	// under MergeThreshold, only when it becomes empty. deletes rewrite fewer
+	// pages and keys re-inserted nearby find room without a split, but
+	// sparse nodes take more pages and make the tree deeper than needed
+	// until it's rebuilt, e.g. by KV.Compact.
+	LazyMerge bool
+	// optional, a node left by a delete at or under this fraction of the
+	// page size is merged with a sibling, 0 means 0.25. it must be in
+	// (0, 0.5], deletes return an error otherwise. lower values merge
+	// less, so deletes are cheaper but nodes are sparser; higher values
+	// keep nodes denser for reads at the cost of more merging. past 0.5 a
+	// merged node could be close to full and split again by the next insert.
+	MergeThreshold float64
+}
+
+func (tree *BTree) compare(a, b []byte) int {
+	if tree.Compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return tree.Compare(a, b)
+}
+
+// the page size used for nodes of the given type
+func (tree *BTree) pageSize(btype uint16) uint16 {
+	size := tree.InternalPageSize
+	if btype == BNODE_LEAF {
+		size = tree.LeafPageSize
+	}
+	if size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return size
+}
+
+// the root pointer, for persisting it outside the tree
+func (tree *BTree) Root() uint64 {
+	return tree.root
+}
+
+func (tree *BTree) SetRoot(ptr uint64) {
+	tree.root = ptr
 }
 
-// Read the value corresponding to the key
-func (tree *BTree) Read(key []byte) ([]byte, bool) {
+// the number of keys, maintained by Insert and Delete
+func (tree *BTree) Count() uint64 {
+	return tree.count
+}
+
+// for restoring a persisted tree along with SetRoot
+func (tree *BTree) SetCount(n uint64) {
+	tree.count = n
+}
+
+// the node code asserts its invariants and the callbacks panic on bad
+// pointers, a corrupted or missing page is turned into ErrCorrupt here.
+func recoverCorrupt(err *error) {
+	if r := recover(); r != nil {
+		*err = corruptErr(r)
+	}
+}
+
+func corruptErr(r any) error {
+	if cause, ok := r.(error); ok {
+		return fmt.Errorf("%w: %w", cause, ErrCorrupt)
+	}
+	return fmt.Errorf("%v: %w", r, ErrCorrupt)
+}
+
+// Read the value corresponding to the key. found tells a missing key from
+// an empty value, which is returned as a non-nil empty slice.
+func (tree *BTree) Read(key []byte) (val []byte, found bool, err error) {
+	defer recoverCorrupt(&err)
+	if tree.Metrics != nil {
+		tree.Metrics.Reads.Add(1)
+	}
 	if tree.root == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	return treeRead(tree, tree.Get(tree.root), key)
+	val, found = treeRead(tree, tree.Get(tree.root), key)
+	return val, found, nil
 }
 
-// Insert a new key or update an existing key
-func (tree *BTree) Insert(key []byte, val []byte) {
+// Insert adds or updates a KV, the key and the value are checked against
+// BTREE_MAX_KEY_SIZE and BTREE_MAX_VALUE_SIZE before anything is changed.
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	_, _, err := tree.Replace(key, val)
+	return err
+}
+
+// Replace is Insert that also returns a copy of the previous value.
+func (tree *BTree) Replace(key []byte, val []byte) (old []byte, existed bool, err error) {
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return nil, false, fmt.Errorf("%d bytes over the %d limit: %w", len(key), BTREE_MAX_KEY_SIZE, ErrKeyTooLarge)
+	}
+	if len(val) > BTREE_MAX_VALUE_SIZE {
+		return nil, false, fmt.Errorf("%d bytes over the %d limit: %w", len(val), BTREE_MAX_VALUE_SIZE, ErrValueTooLarge)
+	}
+	if err := checkPageSizes(tree); err != nil {
+		return nil, false, err
+	}
+	defer recoverCorrupt(&err)
+	if tree.Metrics != nil {
+		tree.Metrics.Inserts.Add(1)
+	}
+	if tree.root != 0 {
+		if old, ok := treeUpdateInPlace(tree, key, val); ok {
+			return old, true, nil
+		}
+	}
 	if tree.root == 0 {
 		// create the first node
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize(BNODE_LEAF)))
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		nodeAppendKV(root, 0, 0, nil, nil)
 		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.New(root)
-		return
+		tree.root = tree.alloc(root)
+		tree.count = 1
+		return nil, false, nil
 	}
-	node := treeInsert(tree, tree.Get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
-	tree.Del(tree.root)
+	node, old, existed := treeInsert(tree, tree.Get(tree.root), key, val)
+	// the old value points into a page that is freed below
+	old = bytes.Clone(old)
+	nsplit, split := nodeSplit3(tree, node)
+	// the old root is freed only after the new one is in place
+	oldRoot := tree.root
 	if nsplit > 1 {
 		// the root was split, add a new level.
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize(BNODE_NODE)))
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range split[:nsplit] {
-			ptr, key := tree.New(knode), knode.getKey(0)
+			ptr, key := tree.alloc(knode), knode.getKey(0)
 			nodeAppendKV(root, uint16(i), ptr, key, nil)
 		}
-		tree.root = tree.New(root)
+		tree.root = tree.alloc(root)
 	} else {
-		tree.root = tree.New(split[0])
+		tree.root = tree.alloc(split[0])
 	}
+	tree.Del(oldRoot)
+	if !existed {
+		tree.count++
+	}
+	return old, existed, nil
+}
+
+// overwrite a value of the same length directly in its leaf if the leaf
+// is writable. the keys don't change, so the parents don't either.
+// returns a copy of the old value.
+func treeUpdateInPlace(tree *BTree, key []byte, val []byte) ([]byte, bool) {
+	if tree.Writable == nil {
+		return nil, false
+	}
+	ptr := tree.root
+	node := BNode(tree.Get(ptr))
+	for node.btype() == BNODE_NODE {
+		ptr = node.getPtr(nodeLookupLE(tree, node, key))
+		node = tree.Get(ptr)
+	}
+	idx := nodeLookupLE(tree, node, key)
+	if tree.compare(key, node.getKey(idx)) != 0 || len(node.getVal(idx)) != len(val) {
+		return nil, false
+	}
+	if !tree.Writable(ptr) {
+		return nil, false
+	}
+	old := bytes.Clone(node.getVal(idx))
+	copy(node.getVal(idx), val)
+	return old, true
+}
+
+// nodes up to this size are merged, see MergeThreshold.
+func (tree *BTree) mergeLimit(btype uint16) uint16 {
+	threshold := tree.MergeThreshold
+	if threshold == 0 {
+		threshold = 0.25
+	}
+	return uint16(threshold * float64(tree.pageSize(btype)))
+}
+
+// a bad MergeThreshold is a config error, deletes fail before reading
+// the tree.
+func checkMergeThreshold(tree *BTree) error {
+	threshold := tree.MergeThreshold
+	if threshold == 0 || 0 < threshold && threshold <= 0.5 {
+		return nil
+	}
+	return fmt.Errorf("merge threshold %v: not in (0, 0.5]", threshold)
 }
 
 // delete a key and returns whether the key was there
-func (tree *BTree) Delete(key []byte) bool {
-	node := treeDelete(tree, tree.Get(tree.root), key)
-	if len(node) == 0 {
-		return false
-	}
-	tree.Del(tree.root)
-	// if 1 key in internal node
-	if node.btype() == BNODE_NODE && node.nkeys() == 1 {
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	_, deleted, err := tree.Remove(key)
+	return deleted, err
+}
+
+// Remove is Delete that also returns a copy of the deleted value.
+func (tree *BTree) Remove(key []byte) (old []byte, deleted bool, err error) {
+	if err := checkMergeThreshold(tree); err != nil {
+		return nil, false, err
+	}
+	defer recoverCorrupt(&err)
+	if tree.Metrics != nil {
+		tree.Metrics.Deletes.Add(1)
+	}
+	if tree.root == 0 {
+		return nil, false, nil
+	}
+	node, old, found := treeDelete(tree, tree.Get(tree.root), key)
+	if !found {
+		return nil, false, nil
+	}
+	old = bytes.Clone(old)
+	oldRoot := tree.root
+	switch {
+	case node.dummyOnly():
+		tree.root = 0 // the tree is empty again
+	case node.btype() == BNODE_NODE && node.nkeys() == 1:
 		// remove level
-		tree.root = node.getPtr(0) // assign root to 0 pointer
-	} else {
-		tree.root = tree.New(node) // assign root to point to updated node
+		ptr := node.getPtr(0)
+		if BNode(tree.Get(ptr)).dummyOnly() {
+			tree.Del(ptr)
+			ptr = 0
+		}
+		tree.root = ptr
+	default:
+		tree.root = tree.alloc(node) // assign root to point to updated node
 	}
-	return true
+	tree.Del(oldRoot)
+	tree.count--
+	return old, true, nil
 }
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-// TODO: binary search
-func nodeLookupLE(node BNode, key []byte) uint16 {
+// the first key is never compared: it's either the dummy key or the key
+// the parent used to get here, so it's <= key and serves as the fallback.
+func nodeLookupLE(tree *BTree, node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
+	if nkeys == 0 {
+		return 0 // no valid position, the caller's read of it fails
+	}
 	left, right := uint16(1), nkeys-1
 	found := uint16(0)
 
 	for left <= right {
 		mid := (left + right) / 2
-		cmp := bytes.Compare(node.getKey(mid), key)
+		var cmp int
+		if node.prefixed() && tree.Compare == nil {
+			cmp = prefixedCompare(node, mid, key)
+		} else {
+			cmp = tree.compare(node.getKey(mid), key)
+		}
 
 		if cmp <= 0 {
 			found = mid
@@ -182,24 +416,38 @@ func leafInsert(
 
 func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
-	nodeAppendRange(new, old, 0, 0, idx-1)
+	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
-	nodeAppendRange(new, old, idx, idx, old.nkeys()-idx)
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
+}
+
+// leafUpdate for a plain leaf that already holds the key. Everything up
+// to the end of the key, the header, pointers and offsets included, is
+// copied as is in one go. The offsets past idx are rewritten after.
+func leafUpdateVal(new BNode, old BNode, idx uint16, val []byte) {
+	pos := old.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(old[pos:])
+	copy(new, old[:pos+4+klen])
+	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
+	copy(new[pos+4+klen:], val)
+	new.setOffset(idx+1, old.getOffset(idx)+4+klen+uint16(len(val)))
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
 // part of the treeInsert(): KV insertion to an internal node
 func nodeInsert(
 	tree *BTree, new BNode, node BNode, idx uint16, key []byte, val []byte,
-) {
+) ([]byte, bool) {
 	kptr := node.getPtr(idx)
 	// recursive insertion to the kid node
-	knode := treeInsert(tree, tree.Get(kptr), key, val)
+	knode, old, existed := treeInsert(tree, tree.Get(kptr), key, val)
 	// split the result
-	nsplit, split := nodeSplit3(knode)
+	nsplit, split := nodeSplit3(tree, knode)
 	// deallocate the kid node
 	tree.Del(kptr)
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	return old, existed
 }
 
 // copy multiple KVs into the position from the old node
@@ -212,6 +460,13 @@ func nodeAppendRange(
 	if n == 0 {
 		return
 	}
+	if old.prefixed() {
+		// the keys change, copy them one by one
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(new, dstNew+i, old.getPtr(srcOld+i), old.getKey(srcOld+i), old.getVal(srcOld+i))
+		}
+		return
+	}
 	// pointers
 	for i := uint16(0); i < n; i++ {
 		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
@@ -251,18 +506,34 @@ func nodeReplaceKidN(
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.New(node), node.getKey(0), nil)
+		nodeAppendKV(new, idx+uint16(i), tree.alloc(node), node.getKey(0), nil)
 		//                ^position      ^pointer        ^key            ^val
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
 // split a oversized node into 2 so that the 2nd node always fits on a page
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	utils.Assert(old.nbytes() > BTREE_PAGE_SIZE, "Try to split a node that is not oversize")
-	nKey := old.nkeys()
-	rightNKey := nKey / 2
-	leftNKey := nKey - rightNKey
+func nodeSplit2(left BNode, right BNode, old BNode, pageSize uint16) {
+	utils.Assert(old.nbytes() > pageSize, "Try to split a node that is not oversize")
+	// size of the left node if it takes the first n keys
+	leftBytes := func(n uint16) uint16 {
+		return HEADER + 8*n + 2*n + old.getOffset(n)
+	}
+	// size of the right node if it takes the rest
+	rightBytes := func(n uint16) uint16 {
+		return old.nbytes() - leftBytes(n) + HEADER
+	}
+	// start from the middle, shrink the left half if it's too big,
+	// then grow it until the right half fits.
+	leftNKey := old.nkeys() / 2
+	for leftNKey > 1 && leftBytes(leftNKey) > pageSize {
+		leftNKey--
+	}
+	for rightBytes(leftNKey) > pageSize {
+		leftNKey++
+	}
+	utils.Assert(1 <= leftNKey && leftNKey < old.nkeys(), "Can't find a split point")
+	rightNKey := old.nkeys() - leftNKey
 
 	// set headers
 	left.setHeader(old.btype(), leftNKey)
@@ -274,31 +545,53 @@ func nodeSplit2(left BNode, right BNode, old BNode) {
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+func nodeSplit3(tree *BTree, old BNode) (nsplit uint16, split [3]BNode) {
+	defer func() {
+		if nsplit > 1 && tree.Metrics != nil {
+			tree.Metrics.Splits.Add(1)
+		}
+	}()
+	if tree.PrefixCompression && old.btype() == BNODE_LEAF {
+		return prefixedSplit(tree, old)
+	}
+	pageSize := tree.pageSize(old.btype())
+	if old.nbytes() <= pageSize {
+		old = old[:pageSize]
 		return 1, [3]BNode{old} // not split
 	}
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	left := BNode(make([]byte, 2*pageSize)) // might be split later
+	right := BNode(make([]byte, pageSize))
+	nodeSplit2(left, right, old, pageSize)
+	if left.nbytes() <= pageSize {
+		left = left[:pageSize]
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	utils.Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, "Last splitted node shouldn't be oversize")
+	leftleft := BNode(make([]byte, pageSize))
+	middle := BNode(make([]byte, pageSize))
+	nodeSplit2(leftleft, middle, left, pageSize)
+	utils.Assert(leftleft.nbytes() <= pageSize, "Last splitted node shouldn't be oversize")
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
+// Has reports whether the key exists without returning its value.
+// A corrupted page is returned as ErrCorrupt like Read does.
+func (tree *BTree) Has(key []byte) (found bool, err error) {
+	defer recoverCorrupt(&err)
+	if tree.Metrics != nil {
+		tree.Metrics.Reads.Add(1)
+	}
+	if tree.root == 0 {
+		return false, nil
+	}
+	_, found = treeRead(tree, tree.Get(tree.root), key)
+	return found, nil
+}
 func treeRead(tree *BTree, node BNode, key []byte) ([]byte, bool) {
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		if tree.compare(key, node.getKey(idx)) == 0 {
 			// found the key, return it.
 			return node.getVal(idx), true
 		} else {
@@ -314,29 +607,37 @@ func treeRead(tree *BTree, node BNode, key []byte) ([]byte, bool) {
 // insert a KV into a node, the result might be split.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// also returns the old value if the key was updated rather than added.
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte) (BNode, []byte, bool) {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	newNode := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	newNode := BNode(make([]byte, tree.plainLimit(node.btype())+tree.pageSize(node.btype())))
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 	// act depending on the node type
+	var old []byte
+	existed := false
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) { // found the key, update it.
-			leafUpdate(newNode, node, idx, key, val)
+		if tree.compare(key, node.getKey(idx)) == 0 { // found the key, update it.
+			old, existed = node.getVal(idx), true
+			if tree.Compare == nil && !node.prefixed() {
+				leafUpdateVal(newNode, node, idx, val) // the same key bytes
+			} else {
+				leafUpdate(newNode, node, idx, key, val)
+			}
 		} else {
 			// insert it after the position.
 			leafInsert(newNode, node, idx+1, key, val)
 		}
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, newNode, node, idx, key, val)
+		old, existed = nodeInsert(tree, newNode, node, idx, key, val)
 	default:
 		panic("bad node!")
 	}
-	return newNode
+	return newNode, old, existed
 }
 
 // remove a key from a leaf node
@@ -349,8 +650,11 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 }
 
 // merge 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode) {
-	new.setHeader(BNODE_NODE, left.nkeys()+right.nkeys())
+func nodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
+	if tree.Metrics != nil {
+		tree.Metrics.Merges.Add(1)
+	}
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
 	// Copy
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
@@ -363,28 +667,29 @@ func nodeReplace2Kid(
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, ptr, key, nil)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-idx-1)
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
 // should the updated kid be merged with a sibling?
 func shouldMerge(
 	tree *BTree, node BNode, idx uint16, updated BNode,
 ) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	pageSize := tree.pageSize(updated.btype())
+	if updated.plainBytes() > tree.mergeLimit(updated.btype()) {
 		return 0, BNode{}
 	}
 	if idx > 0 {
 		sibling := BNode(tree.Get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := sibling.plainBytes() + updated.plainBytes() - HEADER
+		if merged <= pageSize {
 			return -1, sibling // left
 		}
 	}
 
 	if idx+1 < node.nkeys() {
 		sibling := BNode(tree.Get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := sibling.plainBytes() + updated.plainBytes() - HEADER
+		if merged <= pageSize {
 			return +1, sibling // right
 		}
 	}
@@ -392,20 +697,22 @@ func shouldMerge(
 }
 
 // delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+// also returns the deleted value and whether the key was found. the updated
+// node can have 0 keys, e.g. an internal node whose only kid was emptied.
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, []byte, bool) {
 	// where to delete the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) { // found the key, update it.
+		if tree.compare(key, node.getKey(idx)) == 0 { // found the key, update it.
 			// the result node.
-			newNode := BNode(make([]byte, BTREE_PAGE_SIZE))
+			newNode := BNode(make([]byte, tree.plainLimit(BNODE_LEAF)))
 			leafDelete(newNode, node, idx)
-			return newNode
+			return newNode, node.getVal(idx), true
 		} else {
-			return BNode{}
+			return BNode{}, nil, false
 		}
 	case BNODE_NODE:
 		return nodeDelete(tree, node, idx, key)
@@ -415,34 +722,52 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 }
 
 // delete a key from an internal node; part of the treeDelete()
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode { // recurse into the kid
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, []byte, bool) { // recurse into the kid
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.Get(kptr), key)
-	if len(updated) == 0 {
-		return BNode{} // not found
+	updated, old, found := treeDelete(tree, tree.Get(kptr), key)
+	if !found {
+		return BNode{}, nil, false
 	}
 	tree.Del(kptr)
-	newNode := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newNode := BNode(make([]byte, tree.pageSize(BNODE_NODE)))
 	// check for merging
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibling := 0, BNode{}
+	if !tree.LazyMerge || updated.nkeys() == 0 {
+		mergeDir, sibling = shouldMerge(tree, node, idx, updated)
+	}
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, sibling, updated)
+		merged := BNode(make([]byte, tree.pageSize(updated.btype())))
+		nodeMerge(tree, merged, sibling, updated)
 		tree.Del(node.getPtr(idx - 1))
-		nodeReplace2Kid(newNode, node, idx-1, tree.New(merged), merged.getKey(0))
+		nodeReplace2Kid(newNode, node, idx-1, tree.alloc(merged), merged.getKey(0))
 	case mergeDir > 0: // right
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, updated, sibling)
+		merged := BNode(make([]byte, tree.pageSize(updated.btype())))
+		nodeMerge(tree, merged, updated, sibling)
 		tree.Del(node.getPtr(idx + 1))
-		nodeReplace2Kid(newNode, node, idx, tree.New(merged), merged.getKey(0))
+		nodeReplace2Kid(newNode, node, idx, tree.alloc(merged), merged.getKey(0))
 	case mergeDir == 0 && updated.nkeys() == 0:
 		utils.Assert(node.nkeys() == 1 && idx == 0, "bad node when merging") // 1 empty child but no sibling
 		newNode.setHeader(BNODE_NODE, 0)                                     // the parent becomes empty too
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
 		nodeReplaceKidN(tree, newNode, node, idx, updated)
 	}
-	return newNode
+	return newNode, old, true
+}
+
+// a leaf must hold at least one max-sized KV, an internal node must
+// survive a kid being split into 3.
+func checkPageSizes(tree *BTree) error {
+	leafMin := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VALUE_SIZE
+	internalMin := HEADER + 3*(8+2+4+BTREE_MAX_KEY_SIZE)
+	leaf, internal := int(tree.pageSize(BNODE_LEAF)), int(tree.pageSize(BNODE_NODE))
+	if leaf <= leafMin || leaf > BTREE_MAX_PAGE_SIZE {
+		return fmt.Errorf("leaf page size %d: not in (%d, %d]", leaf, leafMin, BTREE_MAX_PAGE_SIZE)
+	}
+	if internal <= internalMin || internal > BTREE_MAX_PAGE_SIZE {
+		return fmt.Errorf("internal page size %d: not in (%d, %d]", internal, internalMin, BTREE_MAX_PAGE_SIZE)
+	}
+	return nil
 }
 
 func init() {
@@ -0,0 +1,127 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotEmpty = errors.New("tree is not empty")
+	ErrUnsorted = errors.New("keys are not strictly ascending")
+)
+
+// BulkLoad builds the tree bottom-up from KVs in strictly ascending key
+// order, packing each node as full as it goes, instead of splitting nodes
+// over and over like repeated Insert calls. The tree must be empty.
+// pairs has the shape of an iter.Seq2[[]byte, []byte]. On error the pages
+// allocated so far are freed and the tree stays empty.
+func (tree *BTree) BulkLoad(pairs func(yield func(key, val []byte) bool)) (err error) {
+	if tree.root != 0 {
+		return ErrNotEmpty
+	}
+	if err := checkPageSizes(tree); err != nil {
+		return err
+	}
+	b := &bulkBuilder{tree: tree}
+	defer func() {
+		if err != nil {
+			for _, ptr := range b.pages {
+				tree.Del(ptr)
+			}
+		}
+	}()
+	defer recoverCorrupt(&err)
+
+	b.add(0, bulkItem{}) // the dummy key
+	var prev []byte
+	count := uint64(0)
+	pairs(func(key, val []byte) bool {
+		switch {
+		case len(key) > BTREE_MAX_KEY_SIZE:
+			err = fmt.Errorf("%d bytes over the %d limit: %w", len(key), BTREE_MAX_KEY_SIZE, ErrKeyTooLarge)
+		case len(val) > BTREE_MAX_VALUE_SIZE:
+			err = fmt.Errorf("%d bytes over the %d limit: %w", len(val), BTREE_MAX_VALUE_SIZE, ErrValueTooLarge)
+		case tree.compare(prev, key) >= 0: // also rejects the empty key
+			err = fmt.Errorf("%q after %q: %w", key, prev, ErrUnsorted)
+		}
+		if err != nil {
+			return false
+		}
+		// the caller may reuse the slices
+		item := bulkItem{key: append([]byte(nil), key...), val: append([]byte(nil), val...)}
+		b.add(0, item)
+		prev = item.key
+		count++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	tree.root = b.finish()
+	tree.count = count
+	return nil
+}
+
+type bulkItem struct {
+	key []byte
+	val []byte
+	ptr uint64
+}
+
+// the rightmost node of each level is being filled, the others are done.
+type bulkBuilder struct {
+	tree   *BTree
+	levels [][]bulkItem // pending items by level, leaves first
+	sizes  []int        // nbytes() of the pending items
+	pages  []uint64     // allocated so far
+}
+
+func bulkType(level int) uint16 {
+	if level == 0 {
+		return BNODE_LEAF
+	}
+	return BNODE_NODE
+}
+
+// add an item to the rightmost node of a level, starting a new node if full.
+func (b *bulkBuilder) add(level int, item bulkItem) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, nil)
+		b.sizes = append(b.sizes, HEADER)
+	}
+	size := 8 + 2 + 4 + len(item.key) + len(item.val)
+	if len(b.levels[level]) > 0 && b.sizes[level]+size > int(b.tree.pageSize(bulkType(level))) {
+		b.flush(level)
+	}
+	b.levels[level] = append(b.levels[level], item)
+	b.sizes[level] += size
+}
+
+// write out the rightmost node of a level and link it to the level above.
+func (b *bulkBuilder) flush(level int) {
+	items := b.levels[level]
+	ptr := b.alloc(level, items)
+	b.levels[level], b.sizes[level] = nil, HEADER
+	b.add(level+1, bulkItem{key: items[0].key, ptr: ptr})
+}
+
+func (b *bulkBuilder) alloc(level int, items []bulkItem) uint64 {
+	btype := bulkType(level)
+	node := BNode(make([]byte, b.tree.pageSize(btype)))
+	node.setHeader(btype, uint16(len(items)))
+	for i, item := range items {
+		nodeAppendKV(node, uint16(i), item.ptr, item.key, item.val)
+	}
+	ptr := b.tree.alloc(node)
+	b.pages = append(b.pages, ptr)
+	return ptr
+}
+
+// flush the rightmost nodes bottom-up, the top level becomes the root.
+func (b *bulkBuilder) finish() uint64 {
+	for level := 0; level < len(b.levels)-1; level++ {
+		b.flush(level)
+	}
+	top := len(b.levels) - 1
+	return b.alloc(top, b.levels[top])
+}
@@ -1,53 +1,90 @@
 package btree
 
-import (
-	"project/utils"
-	"unsafe"
-)
+import "project/utils"
 
+// C is an in-memory tree for tests, cross-checked against the Ref map.
+// Page numbers come from a counter, so runs are reproducible, and freed
+// numbers are reused after the update that freed them, like the free list
+// of the file backend does.
 type C struct {
 	tree  BTree
 	Ref   map[string]string
 	pages map[uint64]BNode
+	next  uint64   // the next new page number, 0 is the nil pointer
+	freed []uint64 // freed by the current update
+	free  []uint64 // reusable page numbers
 }
 
 func NewC() *C {
 	pages := map[uint64]BNode{}
-	return &C{
-		tree: BTree{
-			get: func(ptr uint64) []byte {
-				node, ok := pages[ptr]
-				utils.Assert(ok, "Can't read allocated data")
-				return node
-			},
-			new: func(node []byte) uint64 {
-				utils.Assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE, "new node exceed max size")
-				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
-				utils.Assert(pages[ptr] == nil, "pointer already been assigned")
-				pages[ptr] = node
-				return ptr
-			},
-			del: func(ptr uint64) {
-				utils.Assert(pages[ptr] != nil, "try to de-allocate a pointer that is not occupied")
-				delete(pages, ptr)
-			},
-		},
+	c := &C{
 		Ref:   map[string]string{},
 		pages: pages,
+		next:  1,
 	}
+	c.tree = BTree{
+		Get: func(ptr uint64) []byte {
+			node, ok := pages[ptr]
+			utils.Assert(ok, "Can't read allocated data")
+			return node
+		},
+		New: func(node []byte) uint64 {
+			utils.Assert(BNode(node).nbytes() <= c.tree.pageSize(BNode(node).btype()), "new node exceed max size")
+			var ptr uint64
+			if n := len(c.free); n > 0 {
+				ptr, c.free = c.free[n-1], c.free[:n-1]
+			} else {
+				ptr, c.next = c.next, c.next+1
+			}
+			utils.Assert(pages[ptr] == nil, "pointer already been assigned")
+			pages[ptr] = node
+			return ptr
+		},
+		Del: func(ptr uint64) {
+			utils.Assert(pages[ptr] != nil, "try to de-allocate a pointer that is not occupied")
+			delete(pages, ptr)
+			c.freed = append(c.freed, ptr)
+		},
+	}
+	return c
+}
+
+// the pages freed so far can be reused, called after each update of C.
+func (c *C) commit() {
+	c.free = append(c.free, c.freed...)
+	c.freed = c.freed[:0]
+}
+
+// the underlying tree, for configuring it before use
+func (c *C) Tree() *BTree {
+	return &c.tree
+}
+
+// number of pages currently allocated
+func (c *C) PageCount() int {
+	return len(c.pages)
 }
 
 func (c *C) Read(key string) (string, bool) {
-	val, ok := c.tree.Read([]byte(key))
+	val, ok, err := c.tree.Read([]byte(key))
+	utils.Assert(err == nil, "read from an in-memory tree")
 	return string(val), ok
 }
 
-func (c *C) Add(key string, val string) {
-	c.tree.Insert([]byte(key), []byte(val))
+func (c *C) Add(key string, val string) error {
+	if err := c.tree.Insert([]byte(key), []byte(val)); err != nil {
+		return err
+	}
+	c.commit()
 	c.Ref[key] = val
+	return nil
 }
 
-func (c *C) Del(key string) {
-	c.tree.Delete([]byte(key))
+func (c *C) Del(key string) error {
+	if _, err := c.tree.Delete([]byte(key)); err != nil {
+		return err
+	}
+	c.commit()
 	delete(c.Ref, key)
+	return nil
 }
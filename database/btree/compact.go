@@ -0,0 +1,116 @@
+package btree
+
+// CompactRange rewrites the leaves holding keys in [start, end) so that
+// they are filled up, an empty end means no upper bound. The run of such
+// leaves under each parent is repacked into as few leaves as possible, so
+// the keys don't move to other parents and the separators stay valid; the
+// internal nodes on the way are copied and the old pages are freed.
+// A run that can't be packed into fewer leaves is left as it is.
+func (tree *BTree) CompactRange(start, end []byte) (err error) {
+	if err := checkPageSizes(tree); err != nil {
+		return err
+	}
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return nil
+	}
+	root := BNode(tree.Get(tree.root))
+	if root.btype() == BNODE_LEAF {
+		return nil // nothing to pack it with
+	}
+	node, changed := treeCompactRange(tree, root, start, end)
+	if !changed {
+		return nil
+	}
+	tree.Del(tree.root)
+	// remove the levels left with a single kid
+	ptr := uint64(0)
+	for node.btype() == BNODE_NODE && node.nkeys() == 1 {
+		if ptr != 0 {
+			tree.Del(ptr)
+		}
+		ptr = node.getPtr(0)
+		node = tree.Get(ptr)
+	}
+	if ptr == 0 {
+		ptr = tree.alloc(node)
+	}
+	tree.root = ptr
+	return nil
+}
+
+// returns the updated internal node and whether anything was repacked.
+func treeCompactRange(tree *BTree, node BNode, start, end []byte) (BNode, bool) {
+	if node.btype() != BNODE_NODE {
+		panic("bad node!")
+	}
+	// the kids whose key range [key(i), key(i+1)) overlaps the range
+	lo := nodeLookupLE(tree, node, start)
+	hi := lo + 1
+	for hi < node.nkeys() && tree.beforeEnd(node.getKey(hi), end) {
+		hi++
+	}
+	if BNode(tree.Get(node.getPtr(lo))).btype() == BNODE_LEAF {
+		return leafCompactRange(tree, node, lo, hi)
+	}
+	new := BNode(make([]byte, tree.pageSize(BNODE_NODE)))
+	copy(new, node[:node.nbytes()])
+	changed := false
+	for i := lo; i < hi; i++ {
+		kid, ok := treeCompactRange(tree, tree.Get(node.getPtr(i)), start, end)
+		if !ok {
+			continue
+		}
+		tree.Del(node.getPtr(i))
+		new.setPtr(i, tree.alloc(kid))
+		changed = true
+	}
+	return new, changed
+}
+
+// repack the leaves [lo, hi) of the node like BulkLoad fills them.
+func leafCompactRange(tree *BTree, node BNode, lo, hi uint16) (BNode, bool) {
+	pageSize := int(tree.pageSize(BNODE_LEAF))
+	var leaves [][]bulkItem
+	var items []bulkItem
+	size := HEADER
+	for i := lo; i < hi; i++ {
+		leaf := BNode(tree.Get(node.getPtr(i)))
+		for j := uint16(0); j < leaf.nkeys(); j++ {
+			item := bulkItem{key: leaf.getKey(j), val: leaf.getVal(j)}
+			kv := 8 + 2 + 4 + len(item.key) + len(item.val)
+			if len(items) > 0 && size+kv > pageSize {
+				leaves, items, size = append(leaves, items), nil, HEADER
+			}
+			items = append(items, item)
+			size += kv
+		}
+	}
+	if len(items) > 0 {
+		leaves = append(leaves, items)
+	}
+	if len(leaves) >= int(hi-lo) {
+		return node, false
+	}
+	nkeys := node.nkeys() - (hi - lo) + uint16(len(leaves))
+	new := BNode(make([]byte, tree.pageSize(BNODE_NODE)))
+	new.setHeader(BNODE_NODE, nkeys)
+	nodeAppendRange(new, node, 0, 0, lo)
+	for i, items := range leaves {
+		leaf := BNode(make([]byte, pageSize))
+		leaf.setHeader(BNODE_LEAF, uint16(len(items)))
+		for j, item := range items {
+			nodeAppendKV(leaf, uint16(j), 0, item.key, item.val)
+		}
+		key := items[0].key
+		if i == 0 {
+			key = node.getKey(lo) // the grandparent may have it too
+		}
+		nodeAppendKV(new, lo+uint16(i), tree.alloc(leaf), key, nil)
+	}
+	nodeAppendRange(new, node, lo+uint16(len(leaves)), hi, node.nkeys()-hi)
+	for i := lo; i < hi; i++ {
+		tree.Del(node.getPtr(i))
+	}
+	return new, true
+}
@@ -0,0 +1,197 @@
+package btree
+
+// DeleteRange removes all keys in [start, end), an empty end means no upper
+// bound, and returns how many were removed. Subtrees entirely inside the
+// range are freed without visiting their keys one by one, and each node on
+// the 2 boundary paths is rebuilt and merged with its siblings only once.
+func (tree *BTree) DeleteRange(start, end []byte) (count int, err error) {
+	if err := checkMergeThreshold(tree); err != nil {
+		return 0, err
+	}
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return 0, nil
+	}
+	node, count := treeDeleteRange(tree, tree.Get(tree.root), start, end)
+	if count == 0 {
+		return 0, nil
+	}
+	tree.Del(tree.root)
+	// remove the levels left with a single kid
+	ptr := uint64(0)
+	for node.btype() == BNODE_NODE && node.nkeys() == 1 {
+		if ptr != 0 {
+			tree.Del(ptr)
+		}
+		ptr = node.getPtr(0)
+		node = tree.Get(ptr)
+	}
+	switch {
+	case node.dummyOnly():
+		if ptr != 0 {
+			tree.Del(ptr)
+		}
+		ptr = 0 // the tree is empty again
+	case ptr == 0:
+		ptr = tree.alloc(node)
+	}
+	tree.root = ptr
+	tree.count -= uint64(count)
+	return count, nil
+}
+
+// the dummy key is never deleted.
+func inDeleteRange(tree *BTree, key, start, end []byte) bool {
+	return len(key) > 0 && tree.compare(key, start) >= 0 && tree.beforeEnd(key, end)
+}
+
+// a kid of an internal node being rebuilt, node is set when it was changed.
+type rangeKid struct {
+	ptr  uint64
+	key  []byte
+	node BNode
+}
+
+// returns the updated node and the number of deleted keys,
+// an internal node can become empty if all its kids are gone.
+func treeDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return leafDeleteRange(tree, node, start, end)
+	case BNODE_NODE:
+		return nodeDeleteRange(tree, node, start, end)
+	default:
+		panic("bad node!")
+	}
+}
+
+func leafDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int) {
+	var keep []uint16
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if !inDeleteRange(tree, node.getKey(i), start, end) {
+			keep = append(keep, i)
+		}
+	}
+	count := int(node.nkeys()) - len(keep)
+	if count == 0 {
+		return BNode{}, 0
+	}
+	new := BNode(make([]byte, tree.plainLimit(BNODE_LEAF)))
+	new.setHeader(BNODE_LEAF, uint16(len(keep)))
+	for i, idx := range keep {
+		nodeAppendKV(new, uint16(i), 0, node.getKey(idx), node.getVal(idx))
+	}
+	return new, count
+}
+
+func nodeDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int) {
+	var kids []rangeKid
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		// the kid holds the keys in [lo, hi), hi is nil for the last kid
+		lo, hi := node.getKey(i), []byte(nil)
+		if i+1 < node.nkeys() {
+			hi = node.getKey(i + 1)
+		}
+		kid := rangeKid{ptr: node.getPtr(i), key: lo}
+		switch {
+		case hi != nil && tree.compare(hi, start) <= 0, !tree.beforeEnd(lo, end):
+			kids = append(kids, kid) // outside the range
+		case len(lo) > 0 && tree.compare(lo, start) >= 0 &&
+			(len(end) == 0 || hi != nil && tree.compare(hi, end) <= 0):
+			count += treeFree(tree, kid.ptr) // inside the range
+		default:
+			updated, n := treeDeleteRange(tree, tree.Get(kid.ptr), start, end)
+			if n == 0 {
+				kids = append(kids, kid)
+				continue
+			}
+			count += n
+			tree.Del(kid.ptr)
+			if updated.nkeys() > 0 {
+				kid.node = updated
+				kids = append(kids, kid)
+			}
+		}
+	}
+	if count == 0 {
+		return BNode{}, 0
+	}
+	kids = mergeRangeKids(tree, kids)
+
+	new := BNode(make([]byte, tree.pageSize(BNODE_NODE)))
+	new.setHeader(BNODE_NODE, uint16(len(kids)))
+	for i, kid := range kids {
+		if kid.node != nil {
+			kid.ptr, kid.key = tree.alloc(kid.node), kid.node.getKey(0)
+		}
+		nodeAppendKV(new, uint16(i), kid.ptr, kid.key, nil)
+	}
+	return new, count
+}
+
+// merge the changed kids that became small with a sibling, same rule as shouldMerge.
+// the empty kids are already gone, so there's nothing to do with LazyMerge.
+func mergeRangeKids(tree *BTree, kids []rangeKid) []rangeKid {
+	if tree.LazyMerge {
+		return kids
+	}
+	load := func(kid *rangeKid) BNode {
+		if kid.node == nil {
+			kid.node = tree.Get(kid.ptr)
+			tree.Del(kid.ptr) // it will be replaced by the merged node
+		}
+		return kid.node
+	}
+	fits := func(a, b BNode) bool {
+		return a.plainBytes()+b.plainBytes()-HEADER <= tree.pageSize(a.btype())
+	}
+	for i := 0; i < len(kids); {
+		updated := kids[i].node
+		if updated == nil || updated.plainBytes() > tree.mergeLimit(updated.btype()) {
+			i++
+			continue
+		}
+		var left, right int
+		switch {
+		case i > 0 && fits(peekKid(tree, kids[i-1]), updated):
+			left, right = i-1, i
+		case i+1 < len(kids) && fits(updated, peekKid(tree, kids[i+1])):
+			left, right = i, i+1
+		default:
+			i++
+			continue
+		}
+		merged := BNode(make([]byte, tree.pageSize(updated.btype())))
+		nodeMerge(tree, merged, load(&kids[left]), load(&kids[right]))
+		kids[left].node = merged
+		kids = append(kids[:right], kids[right+1:]...)
+		i = left // the merged node may take another sibling
+	}
+	return kids
+}
+
+func peekKid(tree *BTree, kid rangeKid) BNode {
+	if kid.node != nil {
+		return kid.node
+	}
+	return tree.Get(kid.ptr)
+}
+
+// free a whole subtree, returns the number of keys in it.
+func treeFree(tree *BTree, ptr uint64) int {
+	node := BNode(tree.Get(ptr))
+	count := 0
+	switch node.btype() {
+	case BNODE_LEAF:
+		count = int(node.nkeys())
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			count += treeFree(tree, node.getPtr(i))
+		}
+	default:
+		panic("bad node!")
+	}
+	tree.Del(ptr)
+	return count
+}
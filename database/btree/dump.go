@@ -0,0 +1,78 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// keys and values longer than this are cut short in Dump
+const DUMP_MAX_BYTES = 32
+
+// Dump writes an indented view of the tree for debugging: each node with
+// its page number, type and keys, and the values of the leaves. Printable
+// bytes are quoted, others are in hex.
+//
+//	NODE page 5 nkeys 2
+//	  "" -> 3
+//	    LEAF page 3 nkeys 2
+//	      "" = ""
+//	      "a" = "1"
+//	  "b" -> 4
+//	    ...
+func (tree *BTree) Dump(w io.Writer) (err error) {
+	defer recoverCorrupt(&err)
+	bw := bufio.NewWriter(w)
+	if tree.root == 0 {
+		fmt.Fprintln(bw, "empty")
+	} else {
+		treeDump(tree, bw, tree.root, 0)
+	}
+	return bw.Flush()
+}
+
+func treeDump(tree *BTree, w io.Writer, ptr uint64, depth int) {
+	node := BNode(tree.Get(ptr))
+	indent := strings.Repeat("  ", depth)
+	switch node.btype() {
+	case BNODE_LEAF:
+		fmt.Fprintf(w, "%sLEAF page %d nkeys %d", indent, ptr, node.nkeys())
+		if node.prefixed() {
+			fmt.Fprintf(w, " prefix %s", dumpBytes(node.prefix()))
+		}
+		fmt.Fprintln(w)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			fmt.Fprintf(w, "%s  %s = %s\n", indent, dumpBytes(node.getKey(i)), dumpBytes(node.getVal(i)))
+		}
+	case BNODE_NODE:
+		fmt.Fprintf(w, "%sNODE page %d nkeys %d\n", indent, ptr, node.nkeys())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			fmt.Fprintf(w, "%s  %s -> %d\n", indent, dumpBytes(node.getKey(i)), node.getPtr(i))
+			treeDump(tree, w, node.getPtr(i), depth+2)
+		}
+	default:
+		panic("bad node!")
+	}
+}
+
+func dumpBytes(b []byte) string {
+	cut := b[:min(len(b), DUMP_MAX_BYTES)]
+	printable := true
+	for _, c := range cut {
+		if c < 0x20 || c > 0x7e {
+			printable = false
+			break
+		}
+	}
+	s := "0x" + hex.EncodeToString(cut)
+	if printable {
+		s = strconv.Quote(string(cut))
+	}
+	if len(cut) < len(b) {
+		s += fmt.Sprintf("...(%d bytes)", len(b))
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package btree
+
+import (
+	"fmt"
+	"slices"
+)
+
+// the bucket bounds of SizeHistogram when none are given
+var DEFAULT_SIZE_BUCKETS = []int{16, 64, 256, 1024}
+
+// the distribution of the key or value sizes in bytes.
+// Counts[i] is the number of sizes <= Bounds[i] and > Bounds[i-1], the
+// last count is for the sizes over all bounds.
+type SizeHistogram struct {
+	Bounds []int
+	Counts []uint64
+	N      uint64
+	Min    int
+	Max    int
+	P50    int
+	P99    int
+}
+
+type SizeStats struct {
+	Keys   SizeHistogram
+	Values SizeHistogram
+}
+
+// SizeHistogram walks the leaves once. bounds must be increasing, nil
+// takes DEFAULT_SIZE_BUCKETS. The percentiles are exact since the sizes
+// are bounded by BTREE_MAX_KEY_SIZE and BTREE_MAX_VALUE_SIZE.
+func (tree *BTree) SizeHistogram(bounds []int) (stats SizeStats, err error) {
+	if bounds == nil {
+		bounds = DEFAULT_SIZE_BUCKETS
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return SizeStats{}, fmt.Errorf("size buckets %v: not increasing", bounds)
+		}
+	}
+	defer recoverCorrupt(&err)
+	// the number of keys and values of each size
+	keys := make([]uint64, BTREE_MAX_KEY_SIZE+1)
+	vals := make([]uint64, BTREE_MAX_VALUE_SIZE+1)
+	tree.Walk(nil, nil, func(key, val []byte) bool {
+		keys[len(key)]++
+		vals[len(val)]++
+		return true
+	})
+	return SizeStats{Keys: sizeHistogram(keys, bounds), Values: sizeHistogram(vals, bounds)}, nil
+}
+
+func sizeHistogram(counts []uint64, bounds []int) SizeHistogram {
+	h := SizeHistogram{Bounds: slices.Clone(bounds), Counts: make([]uint64, len(bounds)+1)}
+	for _, n := range counts {
+		h.N += n
+	}
+	if h.N == 0 {
+		return h
+	}
+	h.Min = -1
+	seen := uint64(0)
+	for size, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if h.Min < 0 {
+			h.Min = size
+		}
+		h.Max = size
+		// the smallest size with at least p of the sizes at or below it
+		if seen < (h.N+1)/2 && seen+n >= (h.N+1)/2 {
+			h.P50 = size
+		}
+		if p99 := (h.N*99 + 99) / 100; seen < p99 && seen+n >= p99 {
+			h.P99 = size
+		}
+		seen += n
+		bucket, _ := slices.BinarySearch(bounds, size)
+		h.Counts[bucket] += n
+	}
+	return h
+}
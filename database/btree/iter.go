@@ -0,0 +1,293 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Iter is a cursor over a key range, see BTree.Scan and BTree.ScanReverse.
+// It keeps the path from the root to the current leaf so that moving to
+// a neighbouring leaf only re-reads the nodes that change.
+type Iter struct {
+	tree  *BTree
+	path  []BNode  // from the root to the leaf
+	pos   []uint16 // index into each node of the path
+	start []byte   // inclusive, the bound for Prev()
+	end   []byte   // exclusive, the bound for Next(), empty for no bound
+	valid bool     // the cursor is on a KV
+	fresh bool     // positioned but not yet returned by Next() or Prev()
+	err   error    // a page read failed, see Err
+}
+
+// closed cursors are reused along with their path slices, so that short
+// scans don't allocate.
+var iterPool = sync.Pool{New: func() any { return &Iter{} }}
+
+func newIter(tree *BTree) *Iter {
+	it := iterPool.Get().(*Iter)
+	it.tree = tree
+	return it
+}
+
+// Close puts the cursor back in the pool, it must not be used afterwards,
+// nor closed again since another scan may own it by then. Closing is
+// optional, an unclosed cursor is left to the GC. It's not done at the end
+// of the range since Seek() and Prev() can still move back.
+func (it *Iter) Close() {
+	clear(it.path) // drop the page references
+	*it = Iter{path: it.path[:0], pos: it.pos[:0]}
+	iterPool.Put(it)
+}
+
+// Scan returns a cursor over the keys in [start, end), an empty end means
+// no upper bound. The cursor starts before the first key:
+//
+//	it := tree.Scan(start, end)
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Val())
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// Key() and Val() point into the pages and are only valid until the tree
+// is modified.
+func (tree *BTree) Scan(start, end []byte) (it *Iter) {
+	it = newIter(tree)
+	it.end = end
+	if tree.root == 0 {
+		return it
+	}
+	defer it.recover(nil)
+	// descend to the leaf containing the first key >= start
+	iterDescend(it, func(node BNode) uint16 {
+		return nodeLookupLE(it.tree, node, start)
+	})
+	iterSkipTo(it, start)
+	it.fresh = true
+	return it
+}
+
+// the leaf position is <= key, move past smaller keys and the dummy key.
+func iterSkipTo(it *Iter, key []byte) {
+	it.valid = true
+	for it.valid && (len(it.Key()) == 0 || it.tree.compare(it.Key(), key) < 0) {
+		it.valid = iterNext(it)
+	}
+}
+
+// Seek moves the cursor to the first key >= key, forward or backward, and
+// reports whether it's before the end bound. Unlike Scan, the cursor is on
+// the key afterwards, Key() returns it and Next() moves past it. Only the
+// nodes of the path below the lowest one covering the key are re-read.
+func (it *Iter) Seek(key []byte) (ok bool) {
+	it.fresh = false
+	defer it.recover(&ok)
+	if len(it.path) == 0 || it.err != nil {
+		return false // an empty tree
+	}
+	// the lowest node whose key range [lo, hi) contains the key, the root
+	// covers everything. hi is nil for no bound.
+	level, hi := 0, []byte(nil)
+	for ; level+1 < len(it.path); level++ {
+		node, pos := it.path[level], it.pos[level]
+		if pos >= node.nkeys() {
+			break // moved past the end
+		}
+		if pos+1 < node.nkeys() {
+			hi = node.getKey(pos + 1)
+		}
+		lo := node.getKey(pos)
+		if it.tree.compare(key, lo) < 0 || (hi != nil && it.tree.compare(key, hi) >= 0) {
+			break
+		}
+	}
+	// descend from there
+	for ; ; level++ {
+		node := it.path[level]
+		it.pos[level] = nodeLookupLE(it.tree, node, key)
+		if level+1 == len(it.path) {
+			break
+		}
+		it.path[level+1] = it.tree.Get(node.getPtr(it.pos[level]))
+	}
+	iterSkipTo(it, key)
+	it.valid = it.valid && it.tree.beforeEnd(it.Key(), it.end)
+	return it.valid
+}
+
+// ScanReverse returns a cursor walking the keys in [start, end] from the
+// largest to the smallest with Prev(). Note the end is inclusive here,
+// an empty end means no upper bound.
+//
+//	for it := tree.ScanReverse(start, end); it.Prev(); {
+//		use(it.Key(), it.Val())
+//	}
+func (tree *BTree) ScanReverse(start, end []byte) (it *Iter) {
+	it = newIter(tree)
+	it.start = start
+	if tree.root == 0 {
+		return it
+	}
+	defer it.recover(nil)
+	// descend to the leaf containing the last key <= end
+	iterDescend(it, func(node BNode) uint16 {
+		if len(end) == 0 {
+			return node.nkeys() - 1
+		}
+		return nodeLookupLE(it.tree, node, end)
+	})
+	it.valid = true
+	it.fresh = true
+	return it
+}
+
+// First returns the smallest key, skipping the dummy key. Like Key() and
+// Val(), the slices are only valid until the tree is modified.
+// A failed page read panics like Get does.
+func (tree *BTree) First() ([]byte, []byte, bool) {
+	it := tree.Scan(nil, nil)
+	defer it.Close()
+	if it.Next() {
+		return it.Key(), it.Val(), true
+	}
+	if it.err != nil {
+		panic(it.err)
+	}
+	return nil, nil, false
+}
+
+// Last returns the largest key, see First.
+func (tree *BTree) Last() ([]byte, []byte, bool) {
+	it := tree.ScanReverse(nil, nil)
+	defer it.Close()
+	if it.Prev() {
+		return it.Key(), it.Val(), true
+	}
+	if it.err != nil {
+		panic(it.err)
+	}
+	return nil, nil, false
+}
+
+// Err returns the error that stopped the cursor, nil if it only reached
+// the end of the range. Once set, Next(), Prev() and Seek() return false.
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// deferred by the methods that read pages, a panic of tree.Get or of a bad
+// node stops the cursor.
+func (it *Iter) recover(ok *bool) {
+	if r := recover(); r != nil {
+		if cause, isErr := r.(error); isErr {
+			it.err = fmt.Errorf("%w: %w", cause, ErrCorrupt)
+		} else {
+			it.err = fmt.Errorf("%v: %w", r, ErrCorrupt)
+		}
+		it.valid, it.fresh = false, false
+		if ok != nil {
+			*ok = false
+		}
+	}
+}
+
+// fill the path from the root, pick chooses the kid at each level.
+func iterDescend(it *Iter, pick func(node BNode) uint16) {
+	for ptr := it.tree.root; ; {
+		node := BNode(it.tree.Get(ptr))
+		idx := pick(node)
+		it.path = append(it.path, node)
+		it.pos = append(it.pos, idx)
+		if node.btype() == BNODE_LEAF {
+			return
+		}
+		ptr = node.getPtr(idx)
+	}
+}
+
+// Next moves to the next key in the range and reports whether there is one.
+// The first call moves to the first key.
+func (it *Iter) Next() (ok bool) {
+	if it.err != nil {
+		return false
+	}
+	defer it.recover(&ok)
+	if it.fresh {
+		it.fresh = false
+	} else if it.valid {
+		it.valid = iterNext(it)
+	}
+	it.valid = it.valid && it.tree.beforeEnd(it.Key(), it.end)
+	return it.valid
+}
+
+// Prev moves to the previous key in the range and reports whether there is
+// one. The first call stays on the key ScanReverse positioned at.
+func (it *Iter) Prev() (ok bool) {
+	if it.err != nil {
+		return false
+	}
+	defer it.recover(&ok)
+	if it.fresh {
+		it.fresh = false
+	} else if it.valid {
+		it.valid = iterPrev(it)
+	}
+	// the dummy key is the smallest key of the tree, so stop there too
+	it.valid = it.valid && len(it.Key()) > 0 && it.tree.compare(it.Key(), it.start) >= 0
+	return it.valid
+}
+
+func (it *Iter) Key() []byte {
+	leaf := len(it.path) - 1
+	return it.path[leaf].getKey(it.pos[leaf])
+}
+
+func (it *Iter) Val() []byte {
+	leaf := len(it.path) - 1
+	return it.path[leaf].getVal(it.pos[leaf])
+}
+
+// move to the next KV, crossing into the next leaf if needed.
+// returns false past the last key.
+func iterNext(it *Iter) bool {
+	level := len(it.path) - 1
+	it.pos[level]++
+	// go up until a node has a next kid
+	for it.pos[level] >= it.path[level].nkeys() {
+		if level == 0 {
+			return false
+		}
+		level--
+		it.pos[level]++
+	}
+	// go down along the leftmost path
+	for level++; level < len(it.path); level++ {
+		it.path[level] = it.tree.Get(it.path[level-1].getPtr(it.pos[level-1]))
+		it.pos[level] = 0
+	}
+	return true
+}
+
+// move to the previous KV, crossing into the previous leaf if needed.
+// returns false before the first key.
+func iterPrev(it *Iter) bool {
+	level := len(it.path) - 1
+	// go up until a node has a previous kid
+	for it.pos[level] == 0 {
+		if level == 0 {
+			return false
+		}
+		level--
+	}
+	it.pos[level]--
+	// go down along the rightmost path
+	for level++; level < len(it.path); level++ {
+		node := BNode(it.tree.Get(it.path[level-1].getPtr(it.pos[level-1])))
+		it.path[level] = node
+		it.pos[level] = node.nkeys() - 1
+	}
+	return true
+}
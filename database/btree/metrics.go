@@ -0,0 +1,32 @@
+package btree
+
+import "sync/atomic"
+
+// Metrics counts the tree operations, see BTree.Metrics. The counters can
+// be read while the tree is in use.
+type Metrics struct {
+	Reads   atomic.Uint64
+	Inserts atomic.Uint64 // including updates of existing keys
+	Deletes atomic.Uint64
+	Splits  atomic.Uint64 // nodes split in 2 or 3
+	Merges  atomic.Uint64 // nodes merged with a sibling
+}
+
+// a copy of the counters at one point in time
+type MetricsSnapshot struct {
+	Reads   uint64
+	Inserts uint64
+	Deletes uint64
+	Splits  uint64
+	Merges  uint64
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Reads:   m.Reads.Load(),
+		Inserts: m.Inserts.Load(),
+		Deletes: m.Deletes.Load(),
+		Splits:  m.Splits.Load(),
+		Merges:  m.Merges.Load(),
+	}
+}
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Modify is a read-modify-write of a single key. fn gets the current value
+// and returns the new one: write false leaves the key as it is and a nil
+// value deletes it. The leaf is located once to read the value, and a
+// value of the same length is written back there if the leaf is writable.
+// Otherwise Replace or Remove copy the path, which descends again.
+// The old value is a copy. A panic in fn is passed through.
+func (tree *BTree) Modify(key []byte, fn func(old []byte, exists bool) (new []byte, write bool)) (old []byte, existed bool, err error) {
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return nil, false, fmt.Errorf("%d bytes over the %d limit: %w", len(key), BTREE_MAX_KEY_SIZE, ErrKeyTooLarge)
+	}
+	if err := checkMergeThreshold(tree); err != nil {
+		return nil, false, err // fn may delete the key
+	}
+	inFn := false
+	defer func() {
+		if r := recover(); r != nil {
+			if inFn {
+				panic(r) // not ours
+			}
+			err = corruptErr(r)
+		}
+	}()
+	ptr := uint64(0)
+	var leaf BNode
+	idx := uint16(0)
+	if tree.root != 0 {
+		ptr = tree.root
+		leaf = tree.Get(ptr)
+		for leaf.btype() == BNODE_NODE {
+			ptr = leaf.getPtr(nodeLookupLE(tree, leaf, key))
+			leaf = tree.Get(ptr)
+		}
+		idx = nodeLookupLE(tree, leaf, key)
+		if tree.compare(key, leaf.getKey(idx)) == 0 {
+			old, existed = bytes.Clone(leaf.getVal(idx)), true
+		}
+	}
+	if tree.Metrics != nil {
+		tree.Metrics.Reads.Add(1)
+	}
+	inFn = true
+	val, write := fn(old, existed)
+	inFn = false
+	switch {
+	case !write:
+		return old, existed, nil
+	case val == nil:
+		if !existed {
+			return nil, false, nil
+		}
+		_, _, err = tree.Remove(key)
+		return old, existed, err
+	case existed && len(val) == len(old) && tree.Writable != nil && tree.Writable(ptr):
+		if tree.Metrics != nil {
+			tree.Metrics.Inserts.Add(1)
+		}
+		copy(leaf.getVal(idx), val)
+		return old, existed, nil
+	default:
+		_, _, err = tree.Replace(key, val)
+		return old, existed, err
+	}
+}
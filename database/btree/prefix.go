@@ -0,0 +1,164 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"project/utils"
+)
+
+// Leaves written with BTree.PrefixCompression store the prefix shared by
+// all their keys once, and only the suffixes in the KVs. They are marked
+// by a flag in the node type so that both forms can be read.
+//
+//	| type | nkeys | plen | prefix | pointers | offsets | key suffixes & values |
+//	|  2B  |   2B  |  2B  |  plen  | nkeys*8  | nkeys*2 |          ...          |
+//
+// The nodes being modified are always in the plain form, a leaf is only
+// compressed when it's written by tree.alloc.
+const BNODE_PREFIX = 0x100
+
+func (node BNode) prefixed() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0
+}
+
+// the shared key prefix of a compressed leaf, nil otherwise.
+func (node BNode) prefix() []byte {
+	if !node.prefixed() {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node[HEADER:])
+	return node[HEADER+2:][:plen]
+}
+
+// where the pointers start.
+func (node BNode) header() uint16 {
+	if !node.prefixed() {
+		return HEADER
+	}
+	return HEADER + 2 + uint16(len(node.prefix()))
+}
+
+// the size of the node in the plain form.
+func (node BNode) plainBytes() uint16 {
+	if !node.prefixed() {
+		return node.nbytes()
+	}
+	plen := uint16(len(node.prefix()))
+	return node.nbytes() - 2 - plen + node.nkeys()*plen
+}
+
+// how large a plain node can get, compressed leaves can hold more than
+// a page of KVs.
+func (tree *BTree) plainLimit(btype uint16) uint16 {
+	if tree.PrefixCompression && btype == BNODE_LEAF {
+		return 2 * tree.pageSize(btype)
+	}
+	return tree.pageSize(btype)
+}
+
+// the prefix to compress a plain leaf with, nil if it doesn't save space.
+func leafPrefix(tree *BTree, node BNode) []byte {
+	if !tree.PrefixCompression || node.btype() != BNODE_LEAF {
+		return nil
+	}
+	return rangePrefix(node, 0, node.nkeys())
+}
+
+// the prefix shared by the keys in [lo, hi), nil if it doesn't save space.
+func rangePrefix(node BNode, lo, hi uint16) []byte {
+	if hi-lo < 2 {
+		return nil
+	}
+	prefix := node.getKey(lo)
+	for i := lo + 1; i < hi && len(prefix) > 0; i++ {
+		key := node.getKey(i)
+		n := 0
+		for n < len(prefix) && n < len(key) && prefix[n] == key[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if (hi-lo-1)*uint16(len(prefix)) <= 2 {
+		return nil
+	}
+	return prefix
+}
+
+// split an oversize plain leaf into pieces that can be compressed into a
+// page each. any part of a piece fits too, so taking the largest pieces
+// from the left needs at most 3 of them: the old leaf fit, only the
+// inserted KV was added.
+func prefixedSplit(tree *BTree, old BNode) (uint16, [3]BNode) {
+	pageSize, limit := tree.pageSize(BNODE_LEAF), tree.plainLimit(BNODE_LEAF)
+	fits := func(lo, hi uint16) bool {
+		n := hi - lo
+		plain := HEADER + 10*n + old.getOffset(hi) - old.getOffset(lo)
+		packed := plain
+		if plen := uint16(len(rangePrefix(old, lo, hi))); plen > 0 {
+			packed = plain + 2 + plen - n*plen
+		}
+		return plain <= limit && packed <= pageSize
+	}
+	// the largest piece starting at lo
+	cut := func(lo uint16) uint16 {
+		hi := lo + 1
+		for hi < old.nkeys() && fits(lo, hi+1) {
+			hi++
+		}
+		return hi
+	}
+	piece := func(lo, hi uint16) BNode {
+		node := BNode(make([]byte, limit))
+		node.setHeader(BNODE_LEAF, hi-lo)
+		nodeAppendRange(node, old, 0, lo, hi-lo)
+		return node
+	}
+	nkeys := old.nkeys()
+	if fits(0, nkeys) {
+		return 1, [3]BNode{old[:limit]} // not split
+	}
+	left := cut(0)
+	switch {
+	case fits(left, nkeys):
+		// as close to the middle as both halves allow
+		mid := left
+		for mid > nkeys/2 && fits(mid-1, nkeys) {
+			mid--
+		}
+		return 2, [3]BNode{piece(0, mid), piece(mid, nkeys)}
+	default:
+		middle := cut(left)
+		utils.Assert(fits(middle, nkeys), "Last splitted node shouldn't be oversize")
+		return 3, [3]BNode{piece(0, left), piece(left, middle), piece(middle, nkeys)}
+	}
+}
+
+// write a plain node to a new page, compressing it if possible.
+func (tree *BTree) alloc(node BNode) uint64 {
+	pageSize := tree.pageSize(node.btype())
+	prefix := leafPrefix(tree, node)
+	if len(prefix) == 0 {
+		utils.Assert(node.nbytes() <= pageSize, "plain node exceeds the page size")
+		return tree.New(node[:min(len(node), int(pageSize))])
+	}
+	packed := BNode(make([]byte, pageSize))
+	packed.setHeader(BNODE_LEAF|BNODE_PREFIX, node.nkeys())
+	binary.LittleEndian.PutUint16(packed[HEADER:], uint16(len(prefix)))
+	copy(packed[HEADER+2:], prefix)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		nodeAppendKV(packed, i, 0, node.getKey(i)[len(prefix):], node.getVal(i))
+	}
+	return tree.New(packed)
+}
+
+// compare a key of a compressed leaf without building it.
+func prefixedCompare(node BNode, idx uint16, key []byte) int {
+	prefix := node.prefix()
+	if cmp := bytes.Compare(prefix, key[:min(len(key), len(prefix))]); cmp != 0 || len(key) < len(prefix) {
+		if cmp == 0 {
+			return 1 // the key is a proper prefix of the prefix
+		}
+		return cmp
+	}
+	return bytes.Compare(node.rawKey(idx), key[len(prefix):])
+}
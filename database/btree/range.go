@@ -0,0 +1,234 @@
+package btree
+
+// RangeBytes estimates how many bytes the keys in [start, end) take on disk.
+// An empty end means no upper bound.
+// Leaves that fall entirely inside the range count with their whole nbytes(),
+// the partially covered boundary leaves count only their KVs in the range.
+// So the result includes the node overhead (header, pointers, offsets) and
+// is an approximation of the footprint rather than the raw KV size.
+func (tree *BTree) RangeBytes(start, end []byte) uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+	return treeRangeBytes(tree, tree.Get(tree.root), nil, start, end)
+}
+
+// is the key below the (exclusive) end bound?
+func (tree *BTree) beforeEnd(key []byte, end []byte) bool {
+	return len(end) == 0 || tree.compare(key, end) < 0
+}
+
+// the size of a single KV inside a node, including its pointer and offset
+func kvBytes(node BNode, idx uint16) uint64 {
+	return uint64(8 + 2 + 4 + len(node.getKey(idx)) + len(node.getVal(idx)))
+}
+
+// hi is the exclusive upper bound of the node's key range, nil if unbounded.
+func treeRangeBytes(tree *BTree, node BNode, hi []byte, start, end []byte) uint64 {
+	total := uint64(0)
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if tree.compare(key, start) >= 0 && tree.beforeEnd(key, end) {
+				total += kvBytes(node, i)
+			}
+		}
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			lo, kidHi := node.getKey(i), hi
+			if i+1 < node.nkeys() {
+				kidHi = node.getKey(i + 1)
+			}
+			if kidHi != nil && tree.compare(kidHi, start) <= 0 {
+				continue // the kid is before the range
+			}
+			if !tree.beforeEnd(lo, end) {
+				break // the kid is after the range
+			}
+			kid := BNode(tree.Get(node.getPtr(i)))
+			covered := tree.compare(lo, start) >= 0 &&
+				(len(end) == 0 || (kidHi != nil && tree.compare(kidHi, end) <= 0))
+			if covered {
+				total += treeBytes(tree, kid)
+			} else {
+				total += treeRangeBytes(tree, kid, kidHi, start, end)
+			}
+		}
+	default:
+		panic("bad node!")
+	}
+	return total
+}
+
+// the sum of nbytes() of all leaves under the node
+func treeBytes(tree *BTree, node BNode) uint64 {
+	if node.btype() == BNODE_LEAF {
+		return uint64(node.nbytes())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		total += treeBytes(tree, tree.Get(node.getPtr(i)))
+	}
+	return total
+}
+
+// SeekNth returns the n-th key (counting from 0) in order and its value.
+// Nodes don't cache subtree counts, so this walks the leaves from the left,
+// skipping a whole leaf at a time by its nkeys(): O(n) in the worst case.
+func (tree *BTree) SeekNth(n uint64) ([]byte, []byte, bool) {
+	if tree.root == 0 {
+		return nil, nil, false
+	}
+	return treeSeekNth(tree, tree.Get(tree.root), &n)
+}
+
+// n is decremented by the number of keys skipped so far
+func treeSeekNth(tree *BTree, node BNode, n *uint64) ([]byte, []byte, bool) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		first := uint16(0)
+		if node.nkeys() > 0 && len(node.getKey(0)) == 0 {
+			first = 1 // the dummy key
+		}
+		count := uint64(node.nkeys() - first)
+		if *n < count {
+			idx := first + uint16(*n)
+			return node.getKey(idx), node.getVal(idx), true
+		}
+		*n -= count
+		return nil, nil, false
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key, val, ok := treeSeekNth(tree, tree.Get(node.getPtr(i)), n)
+			if ok {
+				return key, val, true
+			}
+		}
+		return nil, nil, false
+	default:
+		panic("bad node!")
+	}
+}
+
+// Walk calls fn on each KV in [start, end) in order until fn returns false.
+// An empty end means no upper bound. The dummy key is never visited.
+// The slices passed to fn point into the pages and must not be retained.
+func (tree *BTree) Walk(start, end []byte, fn func(key, val []byte) bool) {
+	if tree.root == 0 {
+		return
+	}
+	treeWalk(tree, tree.Get(tree.root), nil, start, end, fn)
+}
+
+// hi is the exclusive upper bound of the node's key range, nil if unbounded.
+// returns false once the walk should stop.
+func treeWalk(
+	tree *BTree, node BNode, hi []byte, start, end []byte,
+	fn func(key, val []byte) bool,
+) bool {
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 || tree.compare(key, start) < 0 {
+				continue
+			}
+			if !tree.beforeEnd(key, end) || !fn(key, node.getVal(i)) {
+				return false
+			}
+		}
+		return true
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kidHi := hi
+			if i+1 < node.nkeys() {
+				kidHi = node.getKey(i + 1)
+			}
+			if kidHi != nil && tree.compare(kidHi, start) <= 0 {
+				continue // the kid is before the range
+			}
+			if !treeWalk(tree, tree.Get(node.getPtr(i)), kidHi, start, end, fn) {
+				return false
+			}
+		}
+		return true
+	default:
+		panic("bad node!")
+	}
+}
+
+// EstimateRange approximates the number of keys in [start, end) and the
+// bytes they take as counted by RangeBytes, reading only the nodes on the
+// paths to both bounds. An empty end means no upper bound.
+// Nodes don't store subtree counts, so each subtree between the paths is
+// taken to be shaped like the path nodes of the same level. The boundary
+// leaves are counted exactly, the rest is an estimate: close for a tree
+// of evenly filled nodes, off by the fill variation otherwise.
+func (tree *BTree) EstimateRange(start, end []byte) (keys, bytes uint64) {
+	if tree.root == 0 || (len(end) > 0 && tree.compare(end, start) <= 0) {
+		return 0, 0
+	}
+	// the paths to the first key >= start and to the last key < end
+	var lo, hi []BNode
+	var loIdx, hiIdx []uint16
+	loPtr, hiPtr := tree.root, tree.root
+	for {
+		loNode := BNode(tree.Get(loPtr))
+		hiNode := loNode
+		if hiPtr != loPtr {
+			hiNode = tree.Get(hiPtr)
+		}
+		lo, hi = append(lo, loNode), append(hi, hiNode)
+		loIdx = append(loIdx, nodeLookupLE(tree, loNode, start))
+		if len(end) == 0 {
+			hiIdx = append(hiIdx, hiNode.nkeys()-1)
+		} else {
+			hiIdx = append(hiIdx, nodeLookupLE(tree, hiNode, end))
+		}
+		if loNode.btype() == BNODE_LEAF {
+			break
+		}
+		loPtr, hiPtr = loNode.getPtr(loIdx[len(loIdx)-1]), hiNode.getPtr(hiIdx[len(hiIdx)-1])
+	}
+	// the estimated keys and bytes of a subtree rooted at each level
+	leaf := len(lo) - 1
+	subKeys := make([]float64, len(lo))
+	subBytes := make([]float64, len(lo))
+	subKeys[leaf] = float64(lo[leaf].nkeys()+hi[leaf].nkeys()) / 2
+	subBytes[leaf] = float64(lo[leaf].nbytes()+hi[leaf].nbytes()) / 2
+	for l := leaf - 1; l >= 0; l-- {
+		fanout := float64(lo[l].nkeys()+hi[l].nkeys()) / 2
+		subKeys[l], subBytes[l] = fanout*subKeys[l+1], fanout*subBytes[l+1]
+	}
+	// the kids between the paths, from where they split
+	estKeys, estBytes := 0.0, 0.0
+	split := false
+	for l := 0; l < leaf; l++ {
+		n := 0
+		switch {
+		case split:
+			n = int(lo[l].nkeys()-loIdx[l]-1) + int(hiIdx[l])
+		case loIdx[l] != hiIdx[l]:
+			split = true
+			n = int(hiIdx[l] - loIdx[l] - 1)
+		}
+		estKeys += float64(n) * subKeys[l+1]
+		estBytes += float64(n) * subBytes[l+1]
+	}
+	// the boundary leaves
+	count := func(node BNode) {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) > 0 && tree.compare(key, start) >= 0 && tree.beforeEnd(key, end) {
+				keys++
+				bytes += kvBytes(node, i)
+			}
+		}
+	}
+	count(lo[leaf])
+	if split {
+		count(hi[leaf])
+	}
+	return keys + uint64(estKeys+0.5), bytes + uint64(estBytes+0.5)
+}
@@ -0,0 +1,63 @@
+package btree
+
+// the shape of a tree, see BTree.Stats
+type TreeStats struct {
+	Height         int // number of levels, 0 for an empty tree
+	InternalNodes  int
+	LeafNodes      int
+	TotalKeys      int     // not counting the dummy key
+	AvgFillPercent float64 // average nbytes() over the page size
+}
+
+// Stats walks the whole tree once from the root.
+func (tree *BTree) Stats() (stats TreeStats, err error) {
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return stats, nil
+	}
+	fill := 0.0
+	treeStats(tree, tree.Get(tree.root), 1, &stats, &fill)
+	stats.TotalKeys-- // the dummy key
+	stats.AvgFillPercent = 100 * fill / float64(stats.InternalNodes+stats.LeafNodes)
+	return stats, nil
+}
+
+func treeStats(tree *BTree, node BNode, depth int, stats *TreeStats, fill *float64) {
+	stats.Height = max(stats.Height, depth)
+	*fill += float64(node.nbytes()) / float64(tree.pageSize(node.btype()))
+	switch node.btype() {
+	case BNODE_LEAF:
+		stats.LeafNodes++
+		stats.TotalKeys += int(node.nkeys())
+	case BNODE_NODE:
+		stats.InternalNodes++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeStats(tree, tree.Get(node.getPtr(i)), depth+1, stats, fill)
+		}
+	default:
+		panic("bad node!")
+	}
+}
+
+// Pages calls fn with the page number of every node, parents first.
+func (tree *BTree) Pages(fn func(ptr uint64)) (err error) {
+	defer recoverCorrupt(&err)
+	if tree.root != 0 {
+		treePages(tree, tree.root, fn)
+	}
+	return nil
+}
+
+func treePages(tree *BTree, ptr uint64, fn func(ptr uint64)) {
+	fn(ptr)
+	node := BNode(tree.Get(ptr))
+	switch node.btype() {
+	case BNODE_LEAF:
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treePages(tree, node.getPtr(i), fn)
+		}
+	default:
+		panic("bad node!")
+	}
+}
@@ -0,0 +1,131 @@
+package btree
+
+import "fmt"
+
+// Verify walks the whole tree and checks its invariants: keys strictly
+// ascending in each node and within the range given by the parent, each
+// separator key equal to the first key of its kid, all leaves at the same
+// depth, and every node within the page size. The error names the first
+// offending page and wraps ErrCorrupt.
+func (tree *BTree) Verify() (err error) {
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return nil
+	}
+	v := &treeVerifier{tree: tree, leafDepth: -1}
+	node := BNode(tree.Get(tree.root))
+	if node.nkeys() == 0 || len(node.getKey(0)) != 0 {
+		return fmt.Errorf("root page %d: no dummy key: %w", tree.root, ErrCorrupt)
+	}
+	return v.verify(tree.root, node, 0, nil)
+}
+
+// VerifyPath is Verify limited to the nodes on the path from the root to
+// the leaf of the key, with the depth of the first leaf as the depth of
+// all of them. It reads two paths instead of the whole tree, so it can run
+// after each update to check the nodes the update rewrote.
+func (tree *BTree) VerifyPath(key []byte) (err error) {
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return nil
+	}
+	v := &treeVerifier{tree: tree}
+	node := BNode(tree.Get(tree.root))
+	if node.nkeys() == 0 || len(node.getKey(0)) != 0 {
+		return fmt.Errorf("root page %d: no dummy key: %w", tree.root, ErrCorrupt)
+	}
+	for first := node; first.btype() == BNODE_NODE; v.leafDepth++ {
+		first = tree.Get(first.getPtr(0))
+	}
+	ptr, hi := tree.root, []byte(nil)
+	for depth := 0; ; depth++ {
+		if err := v.check(ptr, node, depth, hi); err != nil {
+			return err
+		}
+		if node.btype() == BNODE_LEAF {
+			return nil
+		}
+		i := nodeLookupLE(tree, node, key)
+		if i+1 < node.nkeys() {
+			hi = node.getKey(i + 1)
+		}
+		kid := BNode(tree.Get(node.getPtr(i)))
+		if err := v.checkKid(ptr, node, i, kid); err != nil {
+			return err
+		}
+		ptr, node = node.getPtr(i), kid
+	}
+}
+
+type treeVerifier struct {
+	tree      *BTree
+	leafDepth int // -1 until the first leaf
+}
+
+func verifyFail(ptr uint64, format string, args ...any) error {
+	return fmt.Errorf("page %d: %s: %w", ptr, fmt.Sprintf(format, args...), ErrCorrupt)
+}
+
+// hi is the exclusive upper bound from the parent, nil if unbounded.
+func (v *treeVerifier) verify(ptr uint64, node BNode, depth int, hi []byte) error {
+	if err := v.check(ptr, node, depth, hi); err != nil {
+		return err
+	}
+	if node.btype() == BNODE_LEAF {
+		return nil
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kptr, kidHi := node.getPtr(i), hi
+		if i+1 < node.nkeys() {
+			kidHi = node.getKey(i + 1)
+		}
+		kid := BNode(v.tree.Get(kptr))
+		if err := v.checkKid(ptr, node, i, kid); err != nil {
+			return err
+		}
+		if err := v.verify(kptr, kid, depth+1, kidHi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the invariants of a node on its own.
+func (v *treeVerifier) check(ptr uint64, node BNode, depth int, hi []byte) error {
+	tree := v.tree
+	btype := node.btype()
+	if btype != BNODE_LEAF && btype != BNODE_NODE {
+		return verifyFail(ptr, "bad node type %d", btype)
+	}
+	if node.nkeys() == 0 {
+		return verifyFail(ptr, "no keys")
+	}
+	if size := tree.pageSize(btype); node.nbytes() > size {
+		return verifyFail(ptr, "%d bytes over the page size %d", node.nbytes(), size)
+	}
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if tree.compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return verifyFail(ptr, "key %d %q not after %q", i, node.getKey(i), node.getKey(i-1))
+		}
+	}
+	if last := node.getKey(node.nkeys() - 1); hi != nil && tree.compare(last, hi) >= 0 {
+		return verifyFail(ptr, "key %q not before the next separator %q", last, hi)
+	}
+	if btype == BNODE_LEAF {
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		}
+		if depth != v.leafDepth {
+			return verifyFail(ptr, "leaf at depth %d, others at %d", depth, v.leafDepth)
+		}
+	}
+	return nil
+}
+
+// the separator i of an internal node against its kid.
+func (v *treeVerifier) checkKid(ptr uint64, node BNode, i uint16, kid BNode) error {
+	if kid.nkeys() > 0 && v.tree.compare(node.getKey(i), kid.getKey(0)) != 0 {
+		return verifyFail(ptr, "separator %d %q but page %d starts with %q", i, node.getKey(i), node.getPtr(i), kid.getKey(0))
+	}
+	return nil
+}
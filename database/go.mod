@@ -1,3 +1,3 @@
 module project
 
-go 1.21.5
+go 1.23
@@ -0,0 +1,69 @@
+package kv
+
+import (
+	"errors"
+	"project/btree"
+)
+
+// Batch accumulates updates in the in-memory tree and commits them with
+// a single root update, i.e. 2 fsyncs for any number of updates.
+// Reads through the KV see the uncommitted updates, and other writes to
+// the KV must not be interleaved with an open batch.
+type Batch struct {
+	db  *KV
+	err error // a corrupted page was hit or ErrReadOnly, the batch can only be discarded
+}
+
+func (db *KV) Batch() *Batch {
+	if db.ReadOnly {
+		return &Batch{db: db, err: ErrReadOnly}
+	}
+	return &Batch{db: db}
+}
+
+func (b *Batch) Set(key []byte, val []byte) error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	db := b.db
+	_, _, err := treeReplace(db, &db.tree, db.encodeKey(key), db.encodeVal(val, 0))
+	return b.check(err)
+}
+
+func (b *Batch) Del(key []byte) (bool, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	if b.err != nil {
+		return false, b.err
+	}
+	_, deleted, err := treeRemove(b.db, &b.db.tree, b.db.encodeKey(key))
+	return deleted, b.check(err)
+}
+
+// a rejected KV leaves the tree as it was, but a corrupted page
+// may have left some updates behind.
+func (b *Batch) check(err error) error {
+	if errors.Is(err, btree.ErrCorrupt) {
+		b.err = err
+	}
+	return err
+}
+
+// Commit writes all updates of the batch. On error the on-disk root is
+// left untouched and the updates are discarded.
+func (b *Batch) Commit() error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	if b.err != nil {
+		return abortUpdate(b.db, b.err)
+	}
+	if err := updateFile(b.db); err != nil {
+		return abortUpdate(b.db, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"project/btree"
+)
+
+// Pages of files in FORMAT_CHECKSUM end with a CRC32 of the rest of the
+// page. The tree and the free list leave the last bytes of a page unused.
+//
+//	| node or free list node | crc32 |
+//	|  page size - 4 bytes   |  4B   |
+const PAGE_CHECKSUM_SIZE = 4
+const PAGE_DATA_SIZE = btree.BTREE_PAGE_SIZE - PAGE_CHECKSUM_SIZE // with the default page size
+
+var ErrChecksumMismatch = errors.New("page checksum mismatch")
+
+// the on-disk form of a page, with the checksum added.
+func pageSeal(node []byte, size uint64) []byte {
+	page := make([]byte, size)
+	pageSealTo(page, node)
+	return page
+}
+
+// pageSeal into a zeroed page.
+func pageSealTo(page []byte, node []byte) {
+	data := len(page) - PAGE_CHECKSUM_SIZE
+	copy(page, node[:min(len(node), data)])
+	binary.LittleEndian.PutUint32(page[data:], crc32.ChecksumIEEE(page[:data]))
+}
+
+func pageCheck(ptr uint64, page []byte) error {
+	data := len(page) - PAGE_CHECKSUM_SIZE
+	sum := binary.LittleEndian.Uint32(page[data:])
+	if crc32.ChecksumIEEE(page[:data]) != sum {
+		return fmt.Errorf("page %d: %w", ptr, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// a panic from the page callbacks or the node code during a scan.
+func corruptErr(op string, r any) error {
+	if err, ok := r.(error); ok {
+		return fmt.Errorf("%s: %w: %w", op, err, btree.ErrCorrupt)
+	}
+	return fmt.Errorf("%s: %v: %w", op, r, btree.ErrCorrupt)
+}
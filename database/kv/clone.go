@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+var ErrBatchOpen = errors.New("a batch is open")
+
+// Clone copies the committed pages and the meta page to a new file at
+// newPath, which must not exist. The copy is a database of its own: the
+// pages are copied as they are, free ones included, so it's as large as
+// the original. Use Compact on either to shrink it.
+// Like Compact, it's written to a temporary file and renamed. It fails
+// with ErrBatchOpen while a batch is open.
+func (db *KV) Clone(newPath string) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(db.page.updates) > 0 && !db.ReadOnly {
+		return fmt.Errorf("clone: %w", ErrBatchOpen)
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("clone: %s: %w", newPath, os.ErrExist)
+	}
+	tmp := fmt.Sprintf("%s.tmp.%d", newPath, rand.Int())
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("clone", r)
+		}
+		if err != nil {
+			_ = fp.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	if err = cloneWrite(db, fp); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	if err = fp.Close(); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	if err = os.Rename(tmp, newPath); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	if err = syncDir(newPath, db.FsyncHook); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	return nil
+}
+
+// the meta page of the committed state, then every page after it.
+// the pages of a ReadOnly KV may come from the log, see walOverlay.
+func cloneWrite(db *KV, fp *os.File) error {
+	w := bufio.NewWriter(fp)
+	meta := encodeMeta(db, db.page.flushed)
+	if _, err := w.Write(append(meta, make([]byte, int(db.page.size)-len(meta))...)); err != nil {
+		return err
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		page, ok := db.page.updates[ptr]
+		switch {
+		case !ok:
+			page = storageRead(db, ptr) // sealed already
+		case db.version >= FORMAT_CHECKSUM:
+			page = pageSeal(page, db.page.size)
+		default:
+			page = append(page[:len(page):len(page)], make([]byte, int(db.page.size)-len(page))...)
+		}
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
+
+// Clone returns a copy that shares the pages with the original. The pages
+// are never modified once written, so only the page map is copied.
+func (db *MemKV) Clone() *MemKV {
+	clone := NewMemKV()
+	for ptr, page := range db.pages {
+		clone.pages[ptr] = page
+	}
+	clone.next = db.next
+	clone.tree.SetRoot(db.tree.Root())
+	clone.tree.SetCount(db.tree.Count())
+	return clone
+}
@@ -0,0 +1,160 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+var ErrSnapshotsOpen = errors.New("snapshots are open")
+
+// the file size in bytes before and after Compact
+type CompactStats struct {
+	Before int64
+	After  int64
+}
+
+// Compact rewrites the KVs into a new file, with packed nodes and no free
+// pages, and renames it over the old one like utils.SaveData2.
+// The copy is made under the read lock, so reads go on while updates wait;
+// the files are swapped under the write lock. If an update slipped in
+// between, the copy is made again under the write lock.
+// Snapshots point into the old file and must be closed first.
+// It needs a FileStorage, which is replaced by one on the new file.
+func (db *KV) Compact() (CompactStats, error) {
+	if db.ReadOnly {
+		return CompactStats{}, ErrReadOnly
+	}
+	if _, ok := db.Storage.(*FileStorage); !ok {
+		return CompactStats{}, fmt.Errorf("compact: %w", errors.ErrUnsupported)
+	}
+	db.mu.RLock()
+	ncommit := db.ncommit
+	tmp, err := compactCopy(db)
+	db.mu.RUnlock()
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.ncommit != ncommit {
+		_ = os.Remove(tmp)
+		if tmp, err = compactCopy(db); err != nil {
+			return CompactStats{}, err
+		}
+	}
+	var stats CompactStats
+	if stats.Before, err = fileSize(db.Path); err == nil {
+		stats.After, err = fileSize(tmp)
+	}
+	if err == nil && len(db.snapshots) > 0 {
+		err = fmt.Errorf("compact: %d %w", len(db.snapshots), ErrSnapshotsOpen)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return CompactStats{}, err
+	}
+	return stats, compactSwap(db, tmp)
+}
+
+// CompactRange packs the leaves holding the keys in [start, end) in one
+// update, see btree.BTree.CompactRange; an empty end means no upper bound.
+// Unlike Compact, the file isn't rewritten: the old leaves go on the free
+// list and the file only shrinks through Truncate. The values, overflow
+// pages included, are copied as they are.
+func (db *KV) CompactRange(start, end []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	start, end = db.encodeRange(start, end)
+	if err := db.tree.CompactRange(start, end); err != nil {
+		return abortUpdate(db, fmt.Errorf("compact range: %w", err))
+	}
+	if len(db.page.updates) == 0 {
+		return nil // already packed
+	}
+	return updateFile(db)
+}
+
+func fileSize(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("compact: %w", err)
+	}
+	return stat.Size(), nil
+}
+
+// bulk load the tree into a temporary file next to the database file.
+func compactCopy(db *KV) (string, error) {
+	if len(db.snapshots) > 0 {
+		return "", fmt.Errorf("compact: %d %w", len(db.snapshots), ErrSnapshotsOpen)
+	}
+	tmp := fmt.Sprintf("%s.tmp.%d", db.Path, rand.Int())
+	out := &KV{Path: tmp, PageSize: int(db.page.size)}
+	if err := out.Open(); err != nil {
+		return "", fmt.Errorf("compact: %w", err)
+	}
+	out.version = db.version // the stored values are copied as is
+	err := out.tree.BulkLoad(func(yield func(key, val []byte) bool) {
+		db.tree.Walk(nil, nil, func(key, val []byte) bool {
+			if isOverflow(db, val) {
+				// the chain is copied to pages of the new file
+				val = out.encodeVal(db.decodeVal(val))
+			}
+			return yield(key, val)
+		})
+	})
+	if err == nil {
+		err = updateFile(out)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("compact: %w", err)
+	}
+	return tmp, nil
+}
+
+// replace the database file with the copy and load it.
+func compactSwap(db *KV, tmp string) error {
+	if db.wal != nil {
+		// the record was made for the old file
+		if err := db.wal.Truncate(0); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("compact: truncate wal: %w", err)
+		}
+		if err := db.wal.Sync(); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("compact: fsync wal: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, db.Path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("compact: %w", err)
+	}
+	// this fsyncs the directory, which makes the rename durable
+	storage, err := openFileStorage(db.Path, false, db.FsyncHook)
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := db.Storage.Close(); err != nil {
+		_ = storage.Close()
+		return fmt.Errorf("compact: %w", err)
+	}
+	db.Storage, db.owned = storage, true
+	// the pending state belonged to the old file
+	db.unsynced = nil
+	db.deferred.pages, db.deferred.committed = nil, 0
+	if err := discardUpdates(db); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	db.page.reserved = db.page.flushed
+	return nil
+}
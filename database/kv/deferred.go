@@ -0,0 +1,54 @@
+package kv
+
+import "fmt"
+
+// With KV.DeferredFree the pages an update frees are queued in memory
+// instead of pushed on the free list, so an update doesn't write the tail
+// node of the list. Reclaim pushes the queue in one update, Close does it
+// for what's left. The queue isn't persisted: the pages of a crashed
+// process stay unreachable until Compact or RepairFreeList.
+
+// callback for BTree and freeVal, free a page.
+func (db *KV) pageFree(ptr uint64) {
+	if db.DeferredFree {
+		db.deferred.pages = append(db.deferred.pages, ptr)
+		return
+	}
+	db.free.PushTail(ptr)
+}
+
+// Reclaim pushes the pages queued by DeferredFree on the free list and
+// returns their number. They get the seqs after every open snapshot, so
+// they aren't reused while a snapshot can still read them.
+func (db *KV) Reclaim() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if len(db.page.updates) > 0 {
+		return 0, fmt.Errorf("reclaim: %w", ErrBatchOpen)
+	}
+	return reclaim(db)
+}
+
+func reclaim(db *KV) (n int, err error) {
+	if len(db.deferred.pages) == 0 {
+		return 0, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, abortUpdate(db, corruptErr("reclaim", r))
+		}
+	}()
+	for _, ptr := range db.deferred.pages {
+		db.free.PushTail(ptr)
+	}
+	if err := updateFile(db); err != nil {
+		return 0, abortUpdate(db, err) // the queue stays
+	}
+	n = len(db.deferred.pages)
+	db.deferred.pages, db.deferred.committed = db.deferred.pages[:0], 0
+	return n, nil
+}
@@ -0,0 +1,185 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"project/btree"
+)
+
+// Export stream layout, all integers little-endian:
+//
+//	| magic | version u32 | entry | ... | 0xffffffff | count u64 |
+//
+// entry: | klen u32 | vlen u32 | flags u8 | key | val |, sorted by key.
+// The keys are user keys and the values logical values, so a stream can be
+// imported regardless of the KeyTransform and the file format.
+const EXPORT_MAGIC = "BMOXEXP1"
+const EXPORT_VERSION = 1
+const EXPORT_END = 0xffffffff
+
+var ErrExportFormat = errors.New("not an export stream of a supported version")
+
+// Export writes all KVs to w in key order.
+func (db *KV) Export(w io.Writer) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("export", r)
+		}
+	}()
+	bw := bufio.NewWriter(w)
+	head := append([]byte(EXPORT_MAGIC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(head[len(EXPORT_MAGIC):], EXPORT_VERSION)
+	if _, err = bw.Write(head); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	count := uint64(0)
+	lo, hi := db.encodeRange(nil, nil)
+	db.tree.Walk(lo, hi, func(key, val []byte) bool {
+		val, flags := db.decodeVal(val)
+		key = db.decodeKey(key)
+		var entry [9]byte
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(len(key)))
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(len(val)))
+		entry[8] = flags
+		for _, part := range [][]byte{entry[:], key, val} {
+			if _, err = bw.Write(part); err != nil {
+				return false
+			}
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	var tail [12]byte
+	binary.LittleEndian.PutUint32(tail[0:4], EXPORT_END)
+	binary.LittleEndian.PutUint64(tail[4:12], count)
+	if _, err = bw.Write(tail[:]); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if err = bw.Flush(); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	return nil
+}
+
+// Import loads a stream written by Export into an empty KV with the bulk
+// loader, and commits it as one update. On error nothing is imported.
+func (db *KV) Import(r io.Reader) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.tree.Root() != 0 {
+		return fmt.Errorf("import: %w", btree.ErrNotEmpty)
+	}
+	br := bufio.NewReader(r)
+	head := make([]byte, len(EXPORT_MAGIC)+4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return fmt.Errorf("import: header: %w", err)
+	}
+	if string(head[:len(EXPORT_MAGIC)]) != EXPORT_MAGIC ||
+		binary.LittleEndian.Uint32(head[len(EXPORT_MAGIC):]) != EXPORT_VERSION {
+		return fmt.Errorf("import: %w", ErrExportFormat)
+	}
+
+	var rerr error
+	err := db.tree.BulkLoad(func(yield func(key, val []byte) bool) {
+		rerr = importEntries(db, br, yield)
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return abortUpdate(db, fmt.Errorf("import: %w", err))
+	}
+	return updateFile(db)
+}
+
+// read the entries and the trailer, the stored KVs are passed to yield.
+func importEntries(db *KV, br *bufio.Reader, yield func(key, val []byte) bool) error {
+	count := uint64(0)
+	for {
+		var entry [9]byte
+		if _, err := io.ReadFull(br, entry[:4]); err != nil {
+			return fmt.Errorf("entry %d: %w", count, err)
+		}
+		klen := binary.LittleEndian.Uint32(entry[0:4])
+		if klen == EXPORT_END {
+			var tail [8]byte
+			if _, err := io.ReadFull(br, tail[:]); err != nil {
+				return fmt.Errorf("trailer: %w", err)
+			}
+			if n := binary.LittleEndian.Uint64(tail[:]); n != count {
+				return fmt.Errorf("%d entries, the trailer says %d: %w", count, n, ErrExportFormat)
+			}
+			return nil
+		}
+		if _, err := io.ReadFull(br, entry[4:]); err != nil {
+			return fmt.Errorf("entry %d: %w", count, err)
+		}
+		vlen, flags := binary.LittleEndian.Uint32(entry[4:8]), entry[8]
+		// the lengths are checked before anything is allocated
+		if klen > btree.BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("entry %d: %d-byte key: %w: %w", count, klen, ErrExportFormat, btree.ErrKeyTooLarge)
+		}
+		if uint64(vlen) > maxValueSize(db) {
+			return fmt.Errorf("entry %d: %d-byte value: %w: %w", count, vlen, ErrExportFormat, btree.ErrValueTooLarge)
+		}
+		if flags != 0 && db.version < FORMAT_VALUE_FLAGS {
+			return fmt.Errorf("entry %d: value flags: %w", count, ErrFormatVersion)
+		}
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return fmt.Errorf("entry %d: %w", count, err)
+		}
+		val, err := readValue(br, vlen)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", count, err)
+		}
+		if !yield(db.encodeKey(key), db.encodeVal(val, flags)) {
+			return nil // rejected by the bulk loader
+		}
+		count++
+	}
+}
+
+// the longest value the file format can hold. an overflow chain has no
+// limit of its own, the length of an entry is a u32.
+func maxValueSize(db *KV) uint64 {
+	switch {
+	case db.version >= FORMAT_OVERFLOW:
+		return math.MaxUint32
+	case db.version >= FORMAT_VALUE_FLAGS:
+		return btree.BTREE_MAX_VALUE_SIZE - 1
+	default:
+		return btree.BTREE_MAX_VALUE_SIZE
+	}
+}
+
+// a value larger than a leaf is read in pieces, so that a damaged length
+// only allocates as much as the stream really has.
+func readValue(br *bufio.Reader, vlen uint32) ([]byte, error) {
+	if vlen <= btree.BTREE_MAX_VALUE_SIZE {
+		val := make([]byte, vlen)
+		_, err := io.ReadFull(br, val)
+		return val, err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, br, int64(vlen))
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
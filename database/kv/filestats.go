@@ -0,0 +1,52 @@
+package kv
+
+import "fmt"
+
+// how the pages of the file are used, see KV.FileStats.
+// TotalPages = 1 (the meta page) + LivePages + FreePages + FreeListPages
+// + DeferredPages.
+type FileStats struct {
+	TotalPages    int64 // including the pages appended by an open batch
+	LivePages     int64 // tree nodes and overflow pages
+	FreePages     int64 // items in the free list
+	FreeListPages int64 // the nodes of the free list itself
+	DeferredPages int64 // freed pages waiting for Reclaim, see KV.DeferredFree
+	FileSize      int64 // in bytes, without the pages of an open batch but with the reserved ones
+}
+
+// FileStats walks the tree and the free list, including the updates of an
+// open batch. A large FreePages is a hint to run Compact.
+func (db *KV) FileStats() (stats FileStats, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("file stats", r)
+		}
+	}()
+	tree, err := db.tree.Stats()
+	if err != nil {
+		return FileStats{}, err
+	}
+	stats.LivePages = int64(tree.InternalNodes + tree.LeafNodes)
+	db.tree.Walk(nil, nil, func(key, val []byte) bool {
+		if isOverflow(db, val) {
+			stats.LivePages += overflowPages(db, val)
+		}
+		return true
+	})
+	stats.FreePages = int64(db.free.tailSeq - db.free.headSeq)
+	for ptr := db.free.headPage; ptr != 0; ptr = LNode(db.freeRead(ptr)).getNext() {
+		stats.FreeListPages++
+		if ptr == db.free.tailPage {
+			break
+		}
+	}
+	stats.DeferredPages = int64(len(db.deferred.pages))
+	stats.TotalPages = int64(db.page.flushed + db.page.nappend)
+	if stats.FileSize, err = db.Storage.Size(); err != nil {
+		return FileStats{}, fmt.Errorf("file stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,113 @@
+package kv
+
+import (
+	"encoding/binary"
+	"project/utils"
+)
+
+// The free list is an unrolled linked list of pages holding free page numbers.
+// Items are pushed at the tail and popped from the head, each item has a
+// sequence number and the meta page stores the head and tail positions.
+//
+//	| next | pointers |
+//	|  8B  |   n*8B   |
+//
+// The tail node is written in place, which is safe because the slots after
+// the committed tail are invisible to the committed meta page. A torn write
+// leaves those slots intact but not the page checksum, so the checksum of
+// the committed tail node isn't checked, see KV.freeRead.
+const FREE_LIST_HEADER = 8
+
+type LNode []byte
+
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[0:8])
+}
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[0:8], next)
+}
+func (node LNode) getPtr(idx int) uint64 {
+	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER+8*idx:])
+}
+func (node LNode) setPtr(idx int, ptr uint64) {
+	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER+8*idx:], ptr)
+}
+
+type FreeList struct {
+	// callbacks for managing on-disk pages
+	get func(uint64) []byte // read a page
+	new func([]byte) uint64 // append a new page
+	set func(uint64) []byte // update an existing page
+	// persisted in the meta page
+	headPage uint64 // pointer to the list head node, 0 if there is no list yet
+	headSeq  uint64 // sequence number of the first item
+	tailPage uint64
+	tailSeq  uint64
+	// in-memory states
+	size   int    // page size
+	maxSeq uint64 // the durable `tailSeq`, items past it were freed by updates not on disk yet
+}
+
+// the position of an item in its node, the nodes leave room for the checksum.
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64((fl.size-PAGE_CHECKSUM_SIZE-FREE_LIST_HEADER)/8))
+}
+
+// called when an update is durable, the items before seq can be reused now.
+func (fl *FreeList) SetMaxSeq(seq uint64) {
+	fl.maxSeq = seq
+}
+
+// get 1 item from the list head. return 0 on failure.
+func (fl *FreeList) PopHead() uint64 {
+	ptr, head := flPop(fl)
+	if head != 0 { // the empty head node is recycled
+		fl.PushTail(head)
+	}
+	return ptr
+}
+
+// remove 1 item from the head node, and remove the head node if empty.
+func flPop(fl *FreeList) (ptr uint64, head uint64) {
+	if fl.headSeq == fl.maxSeq {
+		return 0, 0 // can't reuse pages freed by the pending update
+	}
+	node := LNode(fl.get(fl.headPage))
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
+	fl.headSeq++
+	// move to the next one if the head node is empty
+	if fl.seq2idx(fl.headSeq) == 0 {
+		head, fl.headPage = fl.headPage, node.getNext()
+		utils.Assert(fl.headPage != 0, "free list head moved past the tail")
+	}
+	return ptr, head
+}
+
+// add 1 item to the tail
+func (fl *FreeList) PushTail(ptr uint64) {
+	if fl.tailPage == 0 {
+		// the first node, for new files and files predating the free list
+		fl.tailPage = fl.new(make([]byte, fl.size))
+		fl.headPage = fl.tailPage
+	}
+	// add it to the tail node
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
+	fl.tailSeq++
+	// add a new tail node if it's full (the list is never empty)
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		// try to reuse from the list head
+		next, head := flPop(fl) // may remove the head node
+		if next == 0 {
+			// or allocate a new node by appending
+			next = fl.new(make([]byte, fl.size))
+		}
+		// link to the new tail node
+		LNode(fl.set(fl.tailPage)).setNext(next)
+		fl.tailPage = next
+		// also add the head node if it's removed
+		if head != 0 {
+			LNode(fl.set(fl.tailPage)).setPtr(0, head)
+			fl.tailSeq++
+		}
+	}
+}
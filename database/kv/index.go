@@ -0,0 +1,95 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"project/record"
+)
+
+// Index keeps rows and a secondary index on them in the same tree, the
+// keys are namespaced by their first byte:
+//
+//	| INDEX_ROW   | primary key |                         -> row
+//	| INDEX_ENTRY | index key, record-encoded | primary key | -> empty
+//
+// The index key is encoded as a record column, which terminates it, so the
+// entries of one index key are exactly the keys with its prefix.
+// The caller decides which index keys a row has.
+const (
+	INDEX_ROW   = 0x00
+	INDEX_ENTRY = 0x01
+)
+
+type Index struct {
+	db *KV
+}
+
+func (db *KV) Index() *Index {
+	return &Index{db: db}
+}
+
+func indexRowKey(primaryKey []byte) []byte {
+	return append([]byte{INDEX_ROW}, primaryKey...)
+}
+
+func indexEntryPrefix(indexKey []byte) []byte {
+	return append([]byte{INDEX_ENTRY}, record.EncodeRecord([]record.Value{record.Bytes(indexKey)})...)
+}
+
+func (idx *Index) Put(primaryKey, row []byte) error {
+	_, _, err := idx.db.Set(indexRowKey(primaryKey), row)
+	return err
+}
+
+func (idx *Index) Get(primaryKey []byte) ([]byte, bool, error) {
+	return idx.db.Get(indexRowKey(primaryKey))
+}
+
+// IndexInsert adds primaryKey to the rows with indexKey.
+func (idx *Index) IndexInsert(indexKey, primaryKey []byte) error {
+	_, _, err := idx.db.Set(append(indexEntryPrefix(indexKey), primaryKey...), nil)
+	return err
+}
+
+// IndexRemove removes primaryKey from the rows with indexKey.
+func (idx *Index) IndexRemove(indexKey, primaryKey []byte) (bool, error) {
+	_, existed, err := idx.db.Del(append(indexEntryPrefix(indexKey), primaryKey...))
+	return existed, err
+}
+
+// IndexScan returns the primary keys of the rows with indexKey, in order.
+func (idx *Index) IndexScan(indexKey []byte) ([][]byte, error) {
+	prefix := indexEntryPrefix(indexKey)
+	entries, err := idx.db.PrefixScan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(entries))
+	for i, entry := range entries {
+		keys[i] = bytes.TrimPrefix(entry.Key, prefix)
+	}
+	return keys, nil
+}
+
+// Delete removes a row along with its entries under the given index keys
+// in one transaction. It returns false if the row doesn't exist.
+func (idx *Index) Delete(primaryKey []byte, indexKeys ...[]byte) (bool, error) {
+	txn := idx.db.Begin()
+	deleted, err := txn.Del(indexRowKey(primaryKey))
+	for _, indexKey := range indexKeys {
+		if err != nil {
+			break
+		}
+		_, err = txn.Del(append(indexEntryPrefix(indexKey), primaryKey...))
+	}
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		if rerr := txn.Rollback(); rerr != nil && rerr != ErrTxnDone {
+			return false, fmt.Errorf("%w (rollback: %v)", err, rerr)
+		}
+		return false, err
+	}
+	return deleted, nil
+}
@@ -1,57 +1,1118 @@
 package kv
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path"
 	"project/btree"
+	"slices"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// The errors returned by the KV wrap these, use errors.Is to tell them
+// apart. The ones of the tree are the same values as in package btree.
+var (
+	ErrKeyExists     = errors.New("key already exists")
+	ErrNotFound      = errors.New("key not found")
+	ErrKeyTooLarge   = btree.ErrKeyTooLarge   // over btree.BTREE_MAX_KEY_SIZE
+	ErrValueTooLarge = btree.ErrValueTooLarge // over the tree limit or the cap of GetCapped
+	ErrCorrupt       = btree.ErrCorrupt       // a damaged page, ErrChecksumMismatch included
+	ErrPageSize      = errors.New("bad page size")
+	ErrReadOnly      = errors.New("opened read-only")
+)
+
+// KV is safe for concurrent use. Reads share a read lock and writes take
+// the write lock for the whole update including the fsyncs, so readers
+// wait for an update to commit; reads through a Snapshot take no lock.
+// Callbacks run under the lock and must not call back into the KV.
 type KV struct {
-	Path string // file name
+	Path string // file name, of the default FileStorage and of the log
+	// where the pages are kept, a FileStorage at Path if nil. Close closes it.
+	// The log and Compact need a FileStorage.
+	Storage Storage
+	// debug only: read every written key back and check the nodes on the
+	// path to it, see btree.BTree.VerifyPath. a mismatch is returned as
+	// ErrCorrupt, the update is committed by then.
+	VerifyAfterWrite bool
+	// optional mapping between user keys and stored keys
+	KeyTransform KeyTransform
+	// log each update to Path+".wal" first, see wal.go
+	WAL bool
+	// bytes per page, a multiple of 4096 up to 16384. it's fixed when the
+	// file is created, 0 takes the size of an existing file or 4096.
+	PageSize int
+	// when updates become durable, see SyncMode. ignored with WAL.
+	SyncMode   SyncMode
+	SyncPeriod time.Duration // for SyncInterval, 1s if 0
+	// see btree.BTree.LazyMerge, Compact packs the nodes again
+	LazyMerge bool
+	// queue the pages freed by updates in memory until Reclaim or Close,
+	// see deferred.go. a crash loses the queued pages until Compact.
+	DeferredFree bool
+	// pages to reserve with fallocate whenever the updates outgrow the
+	// file, so that it's extended in large pieces. 0 leaves it to the writes.
+	// the reserved pages count in FileStats.FileSize until Compact or
+	// Truncate cuts the file to its data. the Storage may ignore it.
+	GrowBy int
+	// the most pages written by one pwrite, consecutive pages of an update
+	// are written together. 0 takes WRITE_BATCH_PAGES, 1 writes them one by one.
+	WriteBatchPages int
+	// open an existing file with O_RDONLY, updates fail with ErrReadOnly.
+	// the log of a WAL database is applied in memory only.
+	ReadOnly bool
+	// rebuild a damaged free list on Open from the pages unreachable from
+	// the root, see RepairedPages. the new list is durable before Open
+	// returns. a damaged tree isn't repaired. ignored with ReadOnly.
+	RepairFreeList bool
+	// testing only: replaces syscall.Fsync on the file and its directory,
+	// for the default FileStorage
+	FsyncHook func(fd int) error
+	// testing only: called after each step of updateFile, an error stops
+	// the update there. a test can exit the process in it to simulate a crash.
+	UpdateHook func(step UpdateStep) error
 	// internals
-	fd   int
-	tree btree.BTree
-	// more ...
+	mu      sync.RWMutex
+	tree    btree.BTree
+	version uint64 // on-disk format
+	page    struct {
+		size     uint64            // bytes per page
+		flushed  uint64            // database size in number of pages
+		nappend  uint64            // number of pages to be appended
+		reserved uint64            // pages the file has room for, see GrowBy
+		updates  map[uint64][]byte // pending updates, including appended pages
+	}
+	free      FreeList
+	snapshots map[*Snapshot]struct{} // open snapshots
+	nfsync    uint64                 // number of fsyncs on the file
+	nwrite    uint64                 // number of page writes, see WriteCount
+	ncommit   uint64                 // number of updates written, see Compact
+	metrics   btree.Metrics          // counters, see Metrics
+	unsynced  []byte                 // the meta page of the last update, until it's written
+	syncStop  chan struct{}          // stops the SyncInterval goroutine
+	syncDone  chan struct{}
+	wal       *os.File // nil without WAL
+	repaired  int      // see RepairedPages
+	owned     bool     // the Storage was opened by Open
+	deferred  struct {
+		pages     []uint64 // freed pages not on the free list, see DeferredFree
+		committed int      // how many of them the last written update freed
+	}
 }
 
 func (db *KV) Open() error {
-	db.tree.Get = db.pageRead   // read a page
-	db.tree.New = db.pageAppend // apppend a page
-	db.tree.Del = func(uint64) {}
+	if err := openStorage(db); err != nil {
+		return err
+	}
+	db.page.updates = map[uint64][]byte{}
+	// btree callbacks
+	db.tree.Get = db.pageRead  // read a page
+	db.tree.New = db.pageAlloc // reuse or append a page
+	db.tree.Del = db.pageFree  // free a page, or queue it
+	db.tree.Writable = db.pageWritable
+	db.tree.LazyMerge = db.LazyMerge
+	db.tree.Metrics = &db.metrics
+	// free list callbacks
+	db.free.get = db.freeRead
+	db.free.new = db.pageAppend
+	db.free.set = db.pageWrite
+	if err := openWAL(db); err != nil {
+		_ = closeStorage(db)
+		return err
+	}
+	if err := readRoot(db); err != nil {
+		_ = closeStorage(db)
+		if db.wal != nil {
+			_ = db.wal.Close()
+		}
+		return err
+	}
+	// room for the page checksum, older files fill the whole page
+	nodeSize := db.page.size
+	if db.version >= FORMAT_CHECKSUM {
+		nodeSize -= PAGE_CHECKSUM_SIZE
+	}
+	db.tree.LeafPageSize = uint16(nodeSize)
+	db.tree.InternalPageSize = uint16(nodeSize)
+	db.free.size = int(db.page.size)
+	if db.tree.Count() == 0 && db.tree.Root() != 0 {
+		// files predating the key count, or an emptied tree
+		if err := countKeys(db); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	if db.RepairFreeList && !db.ReadOnly && !freeListValid(db) {
+		if err := repairFreeList(db); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	if db.SyncMode == SyncInterval && db.wal == nil && !db.ReadOnly {
+		startSync(db)
+	}
+	return nil
+}
+
+// a FileStorage at Path unless one is given.
+func openStorage(db *KV) error {
+	if db.Storage != nil {
+		if fs, ok := db.Storage.(*FileStorage); ok && db.Path == "" {
+			db.Path = fs.path // for the log
+		}
+		return nil
+	}
+	fs, err := openFileStorage(db.Path, db.ReadOnly, db.FsyncHook)
+	if err != nil {
+		return err
+	}
+	db.Storage, db.owned = fs, true
+	return nil
+}
+
+// a given Storage is closed but kept, so the KV can be opened on it again.
+func closeStorage(db *KV) error {
+	err := db.Storage.Close()
+	if db.owned {
+		db.Storage, db.owned = nil, false
+	}
+	return err
+}
+
+func countKeys(db *KV) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("count keys", r)
+		}
+	}()
+	n := uint64(0)
+	db.tree.Walk(nil, nil, func(key, val []byte) bool {
+		n++
+		return true
+	})
+	db.tree.SetCount(n)
+	return nil
+}
+
+// Close makes the updates durable and closes the Storage.
+// Slices returned by the tree are invalid afterwards.
+func (db *KV) Close() error {
+	stopSync(db)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.ReadOnly && len(db.page.updates) == 0 {
+		if _, err := reclaim(db); err != nil {
+			return err
+		}
+	}
+	if db.unsynced != nil {
+		if err := syncMeta(db, db.unsynced); err != nil {
+			return err
+		}
+	}
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			return fmt.Errorf("close wal: %w", err)
+		}
+		db.wal = nil
+	}
+	return closeStorage(db)
+}
+
+// Get returns a copy of the value. A damaged page is returned as
+// ErrCorrupt, ok is false only for a missing key.
+func (db *KV) Get(key []byte) (val []byte, ok bool, err error) {
+	val, _, ok, err = db.GetWithFlags(key)
+	return val, ok, err
 }
 
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Read(key)
+// GetWithFlags also returns the flags the value was stored with,
+// always 0 for files in FORMAT_PLAIN.
+func (db *KV) GetWithFlags(key []byte) ([]byte, byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return dbGet(db, key)
 }
-func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return updateFile(db)
+
+// Lookup is Get with ErrNotFound for a missing key.
+func (db *KV) Lookup(key []byte) ([]byte, error) {
+	val, ok, err := db.Get(key)
+	if err == nil && !ok {
+		err = fmt.Errorf("get %q: %w", key, ErrNotFound)
+	}
+	return val, err
 }
-func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, updateFile(db)
+
+func dbGet(db *KV, key []byte) (val []byte, flags byte, ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			val, flags, ok, err = nil, 0, false, corruptErr(fmt.Sprintf("get %q", key), r)
+		}
+	}()
+	stored, ok, err := db.tree.Read(db.encodeKey(key))
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("get %q: %w", key, err)
+	}
+	if !ok {
+		return nil, 0, false, nil
+	}
+	val, flags = db.decodeVal(stored)
+	// copy it out of the mmap, the page can be reused by later updates.
+	// an empty value stays non-nil, only ok tells a missing key apart
+	return bytes.Clone(val), flags, true, nil
 }
 
-func updateFile(db *KV) error {
+// GetCapped is Get that refuses to return a value longer than maxBytes.
+// The length is taken from the leaf, so an oversized value is rejected
+// with ErrValueTooLarge before its overflow chain is read or anything is
+// copied out. ok is true in that case since the key exists.
+func (db *KV) GetCapped(key []byte, maxBytes int) (val []byte, ok bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			val, ok, err = nil, false, corruptErr(fmt.Sprintf("get %q", key), r)
+		}
+	}()
+	stored, ok, err := db.tree.Read(db.encodeKey(key))
+	if err != nil {
+		return nil, false, fmt.Errorf("get %q: %w", key, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	if size := db.valSize(stored); size > uint64(max(maxBytes, 0)) {
+		return nil, true, fmt.Errorf("%d bytes over the %d cap: %w", size, maxBytes, ErrValueTooLarge)
+	}
+	val, _ = db.decodeVal(stored)
+	return bytes.Clone(val), true, nil
+}
+
+// Has reports whether the key exists, without copying the value out.
+func (db *KV) Has(key []byte) (ok bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr(fmt.Sprintf("has %q", key), r)
+		}
+	}()
+	ok, err = db.tree.Has(db.encodeKey(key))
+	if err != nil {
+		return false, fmt.Errorf("has %q: %w", key, err)
+	}
+	return ok, nil
+}
+
+// First returns the smallest key and its value, ok is false if the
+// database is empty. Keys are ordered as stored, see KeyTransform.
+func (db *KV) First() (key []byte, val []byte, ok bool, err error) {
+	return dbEdge(db, "first", false)
+}
+
+// Last returns the largest key and its value, see First.
+func (db *KV) Last() (key []byte, val []byte, ok bool, err error) {
+	return dbEdge(db, "last", true)
+}
+
+// the first or the last KV within the bounds of encodeRange.
+func dbEdge(db *KV, op string, last bool) (key []byte, val []byte, ok bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			key, val, ok, err = nil, nil, false, corruptErr(op, r)
+		}
+	}()
+	lo, hi := db.encodeRange(nil, nil)
+	var it *btree.Iter
+	if last {
+		// the end is inclusive in reverse, skip the key equal to it
+		it = db.tree.ScanReverse(lo, hi)
+		ok = it.Prev()
+		if ok && len(hi) > 0 && bytes.Compare(it.Key(), hi) >= 0 {
+			ok = it.Prev()
+		}
+	} else {
+		it = db.tree.Scan(lo, hi)
+		ok = it.Next()
+	}
+	defer it.Close()
+	if err := it.Err(); err != nil {
+		return nil, nil, false, fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return nil, nil, false, nil
+	}
+	val, _ = db.decodeVal(it.Val())
+	key = append([]byte(nil), db.decodeKey(it.Key())...)
+	return key, bytes.Clone(val), true, nil
+}
+
+// GetMany looks up several keys under one read lock. The keys are visited
+// in sorted order with a single cursor, so keys close to each other share
+// most of the descent. The results are in the order of the input keys.
+func (db *KV) GetMany(keys [][]byte) (vals [][]byte, found []bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			vals, found, err = nil, nil, corruptErr("get many", r)
+		}
+	}()
+	stored := make([][]byte, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		stored[i], order[i] = db.encodeKey(key), i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(stored[order[a]], stored[order[b]]) < 0
+	})
+	vals, found = make([][]byte, len(keys)), make([]bool, len(keys))
+	it := db.tree.Scan(db.encodeRange(nil, nil))
+	defer it.Close()
+	for _, i := range order {
+		if !it.Seek(stored[i]) || !bytes.Equal(it.Key(), stored[i]) {
+			continue
+		}
+		val, _ := db.decodeVal(it.Val())
+		vals[i], found[i] = bytes.Clone(val), true
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, fmt.Errorf("get many: %w", err)
+	}
+	return vals, found, nil
+}
+
+// Set stores the value with no flags, clearing any previous ones.
+// It returns a copy of the value it replaced, if any.
+func (db *KV) Set(key []byte, val []byte) (old []byte, existed bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, existed, err = dbSet(db, key, val, 0)
+	if err != nil || !existed {
+		return nil, false, err
+	}
+	old, _ = db.decodeVal(old)
+	return old, true, nil
+}
+
+// SetWithFlags stores the value along with a byte of caller-defined flags.
+// Files in FORMAT_PLAIN have no room for flags and only accept 0.
+func (db *KV) SetWithFlags(key []byte, val []byte, flags byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, _, err := dbSet(db, key, val, flags)
+	return err
+}
+
+// returns the old stored value
+func dbSet(db *KV, key []byte, val []byte, flags byte) ([]byte, bool, error) {
+	if db.ReadOnly {
+		return nil, false, ErrReadOnly
+	}
+	if flags != 0 && db.version < FORMAT_VALUE_FLAGS {
+		return nil, false, fmt.Errorf("value flags: %w", ErrFormatVersion)
+	}
+	key, stored := db.encodeKey(key), db.encodeVal(val, flags)
+	old, existed, err := treeReplace(db, &db.tree, key, stored)
+	if err != nil {
+		return nil, false, abortUpdate(db, err)
+	}
+	if err := updateFile(db); err != nil {
+		return nil, false, err
+	}
+	if db.VerifyAfterWrite {
+		if err := verifyWrite(db, key, stored, true); err != nil {
+			return nil, false, err
+		}
+	}
+	return old, existed, nil
+}
+
+// Del returns a copy of the deleted value, if any.
+func (db *KV) Del(key []byte) (old []byte, existed bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return nil, false, ErrReadOnly
+	}
+	key = db.encodeKey(key)
+	old, existed, err = treeRemove(db, &db.tree, key)
+	if err != nil {
+		return nil, false, abortUpdate(db, err)
+	}
+	if err := updateFile(db); err != nil {
+		return nil, false, err
+	}
+	if db.VerifyAfterWrite {
+		if err := verifyWrite(db, key, nil, false); err != nil {
+			return nil, false, err
+		}
+	}
+	old, _ = db.decodeVal(old)
+	return old, existed, nil
+}
+
+// DeletePrefix removes the keys beginning with prefix and returns how many
+// there were, an empty prefix removes them all. It's a single update.
+func (db *KV) DeletePrefix(prefix []byte) (count int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	stored := db.encodeKey(prefix)
+	// past an all 0xff prefix, every key still has it
+	count, err = treeRemoveRange(db, &db.tree, stored, prefixEnd(stored))
+	if err != nil {
+		return 0, abortUpdate(db, fmt.Errorf("delete prefix %q: %w", prefix, err))
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if err := updateFile(db); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// PopFront removes the n smallest keys, or all of them if there are fewer,
+// and returns them in order. It's a single update, so either all of them
+// are removed or none.
+func (db *KV) PopFront(n int) (out []KeyValue, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	var first, last []byte
+	err = func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = corruptErr("pop front", r)
+			}
+		}()
+		it := db.tree.Scan(db.encodeRange(nil, nil))
+		defer it.Close()
+		for len(out) < n && it.Next() {
+			if first == nil {
+				first = bytes.Clone(it.Key())
+			}
+			last = it.Key()
+			val, _ := db.decodeVal(it.Val())
+			out = append(out, KeyValue{
+				Key: append([]byte(nil), db.decodeKey(it.Key())...),
+				Val: bytes.Clone(val),
+			})
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("pop front: %w", err)
+		}
+		return nil
+	}()
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	// the range ends right after the last key
+	end := append(bytes.Clone(last), 0)
+	if _, err := treeRemoveRange(db, &db.tree, first, end); err != nil {
+		return nil, abortUpdate(db, fmt.Errorf("pop front: %w", err))
+	}
+	if err := updateFile(db); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CompareAndSwap sets the key to val only if its current value equals
+// expected, a nil expected means the key must be absent. A failed
+// comparison returns false with no error.
+func (db *KV) CompareAndSwap(key []byte, expected []byte, val []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, ok, err := dbGet(db, key)
+	if err != nil {
+		return false, err
+	}
+	if ok != (expected != nil) || !bytes.Equal(cur, expected) {
+		return false, nil
+	}
+	if _, _, err := dbSet(db, key, val, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Modify is a read-modify-write of a key under the write lock. fn gets a
+// copy of the current value and returns the new one: write false leaves the
+// key as it is, a nil value deletes it, and an empty non-nil value is
+// stored. The value is set with no flags, like Set. A panic in fn discards
+// the update and is passed through.
+func (db *KV) Modify(key []byte, fn func(old []byte, exists bool) (new []byte, write bool)) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	inFn := false
+	defer func() {
+		if r := recover(); r != nil {
+			if inFn {
+				_ = abortUpdate(db, nil)
+				panic(r) // not ours
+			}
+			// the overflow pages of the old or the new value
+			err = abortUpdate(db, corruptErr("modify", r))
+		}
+	}()
+	key = db.encodeKey(key)
+	var stored []byte
+	changed := false
+	old, existed, err := db.tree.Modify(key, func(old []byte, exists bool) ([]byte, bool) {
+		if exists {
+			old, _ = db.decodeVal(old)
+			old = bytes.Clone(old)
+		}
+		inFn = true
+		val, write := fn(old, exists)
+		inFn = false
+		if !write || val == nil && !exists {
+			return nil, false
+		}
+		if val != nil {
+			stored = db.encodeVal(val, 0)
+		}
+		changed = true
+		return stored, true
+	})
+	if err != nil {
+		db.freeVal(stored)
+		return abortUpdate(db, err)
+	}
+	if !changed {
+		return nil
+	}
+	if existed {
+		db.freeVal(old)
+	}
+	if err := updateFile(db); err != nil {
+		return err
+	}
+	if db.VerifyAfterWrite {
+		return verifyWrite(db, key, stored, stored != nil)
+	}
+	return nil
+}
+
+// Rename moves the value of oldKey to newKey with a single root update,
+// so a crash leaves either the old key or the new key, never both or none.
+// It returns false if oldKey doesn't exist, and ErrKeyExists if newKey does.
+// If writing the update fails it returns false and the error; the file then
+// holds one of the two keys, which a reopen tells.
+func (db *KV) Rename(oldKey, newKey []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return false, ErrReadOnly
+	}
+	oldKey, newKey = db.encodeKey(oldKey), db.encodeKey(newKey)
+	val, ok, err := db.tree.Read(oldKey)
+	if err != nil || !ok {
+		return false, err
+	}
+	if string(oldKey) == string(newKey) {
+		return true, nil
+	}
+	_, exists, err := db.tree.Read(newKey)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, fmt.Errorf("rename to %q: %w", db.decodeKey(newKey), ErrKeyExists)
+	}
+	// don't hold on to the old page, the overflow pages move along
+	val = bytes.Clone(val)
+	if err = db.tree.Insert(newKey, val); err == nil {
+		_, err = db.tree.Delete(oldKey)
+	}
+	if err != nil {
+		return false, abortUpdate(db, err)
+	}
+	if err := updateFile(db); err != nil {
+		return false, err
+	}
+	if db.VerifyAfterWrite {
+		if err := verifyWrite(db, newKey, val, true); err != nil {
+			return true, err
+		}
+		if err := verifyWrite(db, oldKey, nil, false); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Count returns the number of keys, including the updates of an open batch.
+// It's kept for the whole file, so it counts the keys of every namespace
+// of a KeyTransform.
+func (db *KV) Count() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.tree.Count()
+}
+
+// Metrics returns the counters of the tree operations since Open,
+// it doesn't wait for the lock.
+func (db *KV) Metrics() btree.MetricsSnapshot {
+	return db.metrics.Snapshot()
+}
+
+// Stats describes the shape of the tree, including the updates of an open batch.
+func (db *KV) Stats() (btree.TreeStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.tree.Stats()
+}
+
+// callback for BTree & FreeList, dereference a pointer.
+// committed pages are returned directly from the Storage and are read-only.
+func (db *KV) pageRead(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page // pending update
+	}
+	return storageRead(db, ptr)
+}
+
+// a committed page.
+func storageRead(db *KV, ptr uint64) []byte {
+	return readPage(db.Storage, db.version, db.page.size, ptr)
+}
+
+// a committed page of the given format. snapshots read without the lock,
+// so they pass the format they were taken with, see Snapshot.
+func readPage(s Storage, version uint64, pageSize uint64, ptr uint64) []byte {
+	page := storagePage(s, pageSize, ptr)
+	if version >= FORMAT_CHECKSUM {
+		if err := pageCheck(ptr, page); err != nil {
+			panic(err)
+		}
+	}
+	return page
+}
+
+// readPage without the checksum.
+func storagePage(s Storage, pageSize uint64, ptr uint64) []byte {
+	page, err := s.ReadAt(int64(ptr*pageSize), int(pageSize))
+	if err != nil {
+		panic(fmt.Errorf("read page %d: %w", ptr, err))
+	}
+	return page
+}
+
+// callback for BTree, allocate a new page.
+// pages on the free list are reused before the file is extended.
+func (db *KV) pageAlloc(node []byte) uint64 {
+	if ptr := db.free.PopHead(); ptr != 0 {
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	return db.pageAppend(node)
+}
+
+// callback for BTree, the tree pages of the pending update are not
+// visible to the committed root nor to any snapshot.
+func (db *KV) pageWritable(ptr uint64) bool {
+	_, ok := db.page.updates[ptr]
+	return ok
+}
+
+// callback for FreeList, allocate a new page at the end of the file.
+func (db *KV) pageAppend(node []byte) uint64 {
+	ptr := db.page.flushed + db.page.nappend
+	db.page.nappend++
+	db.page.updates[ptr] = node
+	return ptr
+}
+
+// callback for FreeList, get a page for updating it in place.
+func (db *KV) pageWrite(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page // pending update
+	}
+	page := make([]byte, db.page.size)
+	copy(page, db.freeRead(ptr)) // the committed page is read-only
+	db.page.updates[ptr] = page
+	return page
+}
+
+// callback for FreeList, read a node. The committed tail node is the only
+// committed page written in place, and a crash can tear that write. Its
+// committed items are the same before and after it, but the checksum
+// may not match, so it isn't checked for that node.
+func (db *KV) freeRead(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page // pending update
+	}
+	if ptr == db.free.tailPage {
+		return storagePage(db.Storage, db.page.size, ptr)
+	}
+	return storageRead(db, ptr)
+}
+
+// the meta page (page 0) holds:
+//
+//	| root | page used | version | free list head page, seq | tail page, seq | keys | page size |
+//	|  8B  |    8B     |   8B    |          8B, 8B          |     8B, 8B     |  8B  |    8B     |
+const META_SIZE = 72
+
+func readRoot(db *KV) error {
+	fileSize, err := db.Storage.Size()
+	if err != nil {
+		return fmt.Errorf("storage size: %w", err)
+	}
+	if fileSize == 0 {
+		if db.ReadOnly {
+			return fmt.Errorf("empty file: %w", ErrReadOnly)
+		}
+		// empty file, reserve the meta page and initialize it
+		db.page.flushed = 1
+		db.version = FORMAT_VERSION
+		db.page.size = btree.BTREE_PAGE_SIZE
+		if db.PageSize != 0 {
+			db.page.size = uint64(db.PageSize)
+		}
+		if err := checkPageSize(db.page.size); err != nil {
+			return err
+		}
+		if err := updateRoot(db); err != nil {
+			return err
+		}
+		return fsync(db)
+	}
+	meta, err := db.Storage.ReadAt(0, min(META_SIZE, int(fileSize)))
+	if err != nil {
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	// fields past a short file read as 0
+	meta = append(bytes.Clone(meta), make([]byte, META_SIZE-len(meta))...)
+	size := fileSize
+	if db.ReadOnly {
+		var err error
+		if meta, size, err = walOverlay(db, meta, size); err != nil {
+			return err
+		}
+	}
+	loadMeta(db, meta)
+	if err := checkMeta(db, size); err != nil {
+		return err
+	}
+	db.page.reserved = uint64(fileSize) / db.page.size
+	if db.PageSize != 0 && uint64(db.PageSize) != db.page.size {
+		return fmt.Errorf("%d-byte pages in the file, not %d: %w", db.page.size, db.PageSize, ErrPageSize)
+	}
+	setFreeListLimit(db, db.free.tailSeq)
+	return nil
+}
+
+func loadMeta(db *KV, meta []byte) {
+	// fields added later read as 0 in older files
+	db.tree.SetRoot(binary.LittleEndian.Uint64(meta[0:8]))
+	db.page.flushed = binary.LittleEndian.Uint64(meta[8:16])
+	db.version = binary.LittleEndian.Uint64(meta[16:24])
+	db.free.headPage = binary.LittleEndian.Uint64(meta[24:32])
+	db.free.headSeq = binary.LittleEndian.Uint64(meta[32:40])
+	db.free.tailPage = binary.LittleEndian.Uint64(meta[40:48])
+	db.free.tailSeq = binary.LittleEndian.Uint64(meta[48:56])
+	db.tree.SetCount(binary.LittleEndian.Uint64(meta[56:64]))
+	db.page.size = binary.LittleEndian.Uint64(meta[64:72])
+	if db.page.size == 0 {
+		db.page.size = btree.BTREE_PAGE_SIZE
+	}
+}
+
+func checkPageSize(size uint64) error {
+	if size == 0 || size%btree.BTREE_PAGE_SIZE != 0 || size > btree.BTREE_MAX_PAGE_SIZE {
+		return fmt.Errorf("%d bytes: %w", size, ErrPageSize)
+	}
+	return nil
+}
+
+// the meta page must describe pages that are in the file.
+func checkMeta(db *KV, size int64) error {
+	if db.version > FORMAT_VERSION {
+		return fmt.Errorf("meta page: version %d: %w", db.version, ErrFormatVersion)
+	}
+	if err := checkPageSize(db.page.size); err != nil {
+		return fmt.Errorf("meta page: %w: %w", err, btree.ErrCorrupt)
+	}
+	flushed := db.page.flushed
+	if flushed == 0 || (flushed > 1 && uint64(size) < flushed*db.page.size) {
+		return fmt.Errorf("meta page: %d pages in a %d-byte file: %w", flushed, size, btree.ErrCorrupt)
+	}
+	ptrs := []uint64{db.tree.Root(), db.free.headPage, db.free.tailPage}
+	if db.RepairFreeList && !db.ReadOnly {
+		ptrs = ptrs[:1] // see freeListValid
+	}
+	for _, ptr := range ptrs {
+		if ptr >= flushed {
+			return fmt.Errorf("meta page: pointer %d past %d pages: %w", ptr, flushed, btree.ErrCorrupt)
+		}
+	}
+	return nil
+}
+
+// see KV.WriteBatchPages
+const WRITE_BATCH_PAGES = 256
+
+func writePages(db *KV) error {
+	if db.GrowBy > 0 && db.page.flushed+db.page.nappend > db.page.reserved {
+		if err := growFile(db, db.page.flushed+db.page.nappend+uint64(db.GrowBy)); err != nil {
+			return err
+		}
+	}
+	// one write for each run of consecutive pages, the appended ones
+	// are always a single run
+	limit := db.WriteBatchPages
+	if limit <= 0 {
+		limit = WRITE_BATCH_PAGES
+	}
+	ptrs := slices.Sorted(maps.Keys(db.page.updates))
+	for len(ptrs) > 0 {
+		n := 1
+		for n < min(len(ptrs), limit) && ptrs[n] == ptrs[0]+uint64(n) {
+			n++
+		}
+		if err := writeRun(db, ptrs[:n]); err != nil {
+			return err
+		}
+		ptrs = ptrs[n:]
+	}
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	clear(db.page.updates)
+	return nil
+}
+
+func writeRun(db *KV, ptrs []uint64) error {
+	size := int(db.page.size)
+	buf := db.page.updates[ptrs[0]]
+	if len(ptrs) > 1 || db.version >= FORMAT_CHECKSUM {
+		buf = make([]byte, len(ptrs)*size)
+		for i, ptr := range ptrs {
+			page := buf[i*size : (i+1)*size]
+			if db.version >= FORMAT_CHECKSUM {
+				pageSealTo(page, db.page.updates[ptr])
+			} else {
+				copy(page, db.page.updates[ptr])
+			}
+		}
+	}
+	db.nwrite++
+	if err := db.Storage.WriteAt(int64(ptrs[0]*db.page.size), buf); err != nil {
+		return fmt.Errorf("write pages %d-%d: %w", ptrs[0], ptrs[len(ptrs)-1], err)
+	}
+	return nil
+}
+
+// reserve the space for npages in the file, the size grows with it.
+func growFile(db *KV, npages uint64) error {
+	if npages <= db.page.reserved {
+		return nil
+	}
+	if err := db.Storage.Grow(int64(npages * db.page.size)); err != nil {
+		return fmt.Errorf("fallocate %d pages: %w", npages, err)
+	}
+	db.page.reserved = npages
+	return nil
+}
+
+// Preallocate reserves n pages past the end of the data, updates fill them
+// before the file is extended again.
+func (db *KV) Preallocate(n int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	return growFile(db, db.page.flushed+db.page.nappend+uint64(n))
+}
+
+func updateRoot(db *KV) error {
+	meta := encodeMeta(db, db.page.flushed)
+	// a small write within one sector is atomic in practice
+	if err := db.Storage.WriteAt(0, meta); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	return nil
+}
+
+func encodeMeta(db *KV, flushed uint64) []byte {
+	meta := make([]byte, META_SIZE)
+	binary.LittleEndian.PutUint64(meta[0:8], db.tree.Root())
+	binary.LittleEndian.PutUint64(meta[8:16], flushed)
+	binary.LittleEndian.PutUint64(meta[16:24], db.version)
+	binary.LittleEndian.PutUint64(meta[24:32], db.free.headPage)
+	binary.LittleEndian.PutUint64(meta[32:40], db.free.headSeq)
+	binary.LittleEndian.PutUint64(meta[40:48], db.free.tailPage)
+	binary.LittleEndian.PutUint64(meta[48:56], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(meta[56:64], db.tree.Count())
+	binary.LittleEndian.PutUint64(meta[64:72], db.page.size)
+	return meta
+}
+
+// drop the pending updates and go back to the last committed state.
+func discardUpdates(db *KV) error {
+	db.page.nappend = 0
+	clear(db.page.updates)
+	db.tree.SetRoot(0)
+	db.deferred.pages = db.deferred.pages[:db.deferred.committed]
+	db.free = FreeList{get: db.free.get, new: db.free.new, set: db.free.set, size: db.free.size, maxSeq: db.free.maxSeq}
+	if db.unsynced != nil {
+		// the last update is only in memory, the limit stays where it was
+		loadMeta(db, db.unsynced)
+		return nil
+	}
+	return readRoot(db)
+}
+
+// discard a failed update, err is returned as is.
+func abortUpdate(db *KV, err error) error {
+	if derr := discardUpdates(db); derr != nil {
+		return fmt.Errorf("%w (discard: %v)", err, derr)
+	}
+	return err
+}
+
+// the steps of updateFile, see KV.UpdateHook
+type UpdateStep int
+
+const (
+	StepPagesWritten UpdateStep = iota + 1 // the new nodes, not yet durable
+	StepPagesSynced                        // the first fsync, the old root is still current
+	StepRootWritten                        // the meta page, not yet durable
+)
+
+func updateHook(db *KV, step UpdateStep) error {
+	if db.UpdateHook == nil {
+		return nil
+	}
+	return db.UpdateHook(step)
+}
+
+func updateFile(db *KV) (err error) {
+	db.ncommit++
+	defer func() {
+		if err == nil {
+			db.deferred.committed = len(db.deferred.pages)
+		}
+	}()
+	if db.wal != nil {
+		return updateFileWAL(db)
+	}
 	// 1. Write new nodes.
 	if err := writePages(db); err != nil {
 		return err
 	}
+	if err := updateHook(db, StepPagesWritten); err != nil {
+		return err
+	}
+	meta := encodeMeta(db, db.page.flushed)
+	if db.SyncMode != SyncAlways {
+		db.unsynced = meta // see Flush
+		return nil
+	}
+	return syncMeta(db, meta)
+}
+
+// make the pages written so far durable and switch to the meta page.
+func syncMeta(db *KV, meta []byte) error {
 	// 2. `fsync` to enforce the order between 1 and 3.
-	if err := syscall.Fsync(db.fd); err != nil {
+	if err := fsync(db); err != nil {
+		return err
+	}
+	if err := updateHook(db, StepPagesSynced); err != nil {
 		return err
 	}
 	// 3. Update the root pointer atomically.
-	if err := updateRoot(db); err != nil {
+	// a small write within one sector is atomic in practice
+	if err := db.Storage.WriteAt(0, meta); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := updateHook(db, StepRootWritten); err != nil {
 		return err
 	}
 	// 4. `fsync` to make everything persistent.
-	return syscall.Fsync(db.fd)
+	if err := fsync(db); err != nil {
+		return err
+	}
+	// the pages freed by this update can be reused from now on
+	setFreeListLimit(db, binary.LittleEndian.Uint64(meta[48:56]))
+	db.unsynced = nil
+	return nil
+}
+
+func fsync(db *KV) error {
+	db.nfsync++
+	if err := db.Storage.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// hook replaces syscall.Fsync if not nil, see KV.FsyncHook.
+func fsyncFd(hook func(fd int) error, fd int) error {
+	if hook != nil {
+		return hook(fd)
+	}
+	return syscall.Fsync(fd)
+}
+
+// FsyncCount returns the number of fsyncs issued on the file since Open.
+func (db *KV) FsyncCount() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.nfsync
+}
+
+// WriteCount returns the number of writes of tree and free list pages
+// issued on the file since Open, the meta page and the log aside.
+func (db *KV) WriteCount() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.nwrite
 }
 
-func createFileSync(file string) (int, error) {
+// open or create the file, then fsync the directory so that a new file
+// survives a crash.
+func createFileSync(file string, hook func(fd int) error) (int, error) {
 	// obtain the directory fd
 	flags := os.O_RDONLY | syscall.O_DIRECTORY
 	dirfd, err := syscall.Open(path.Dir(file), flags, 0o644)
@@ -66,8 +1127,22 @@ func createFileSync(file string) (int, error) {
 		return -1, fmt.Errorf("open file: %w", err)
 	}
 	// fsync the directory
-	if err = syscall.Fsync(dirfd); err != nil {
-		_ = syscall.Close(fd) // may leave an empty file return -1, fmt.Errorf("fsync directory: %w", err)
+	if err = fsyncFd(hook, dirfd); err != nil {
+		_ = syscall.Close(fd) // may leave an empty file
+		return -1, fmt.Errorf("fsync directory: %w", err)
 	}
 	return fd, nil
 }
+
+// fsync the directory of the file, which makes a rename to it durable.
+func syncDir(file string, hook func(fd int) error) error {
+	dirfd, err := syscall.Open(path.Dir(file), os.O_RDONLY|syscall.O_DIRECTORY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err := fsyncFd(hook, dirfd); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"project/btree"
+)
+
+// Store is the key-value interface shared by the file-backed KV and MemKV.
+type Store interface {
+	Get(key []byte) (val []byte, ok bool, err error)
+	Set(key []byte, val []byte) (old []byte, existed bool, err error)
+	Del(key []byte) (old []byte, existed bool, err error)
+}
+
+var (
+	_ Store = (*KV)(nil)
+	_ Store = (*MemKV)(nil)
+)
+
+// MemKV keeps the B-tree pages in memory, for tests and scratch data
+// that don't need a file. Nothing is persisted.
+type MemKV struct {
+	tree  btree.BTree
+	pages map[uint64][]byte
+	next  uint64 // the last page number handed out
+}
+
+func NewMemKV() *MemKV {
+	db := &MemKV{pages: map[uint64][]byte{}}
+	db.tree.Get = func(ptr uint64) []byte {
+		page, ok := db.pages[ptr]
+		if !ok {
+			panic(fmt.Errorf("read page %d: not allocated", ptr))
+		}
+		return page
+	}
+	db.tree.New = func(node []byte) uint64 {
+		db.next++
+		db.pages[db.next] = node
+		return db.next
+	}
+	db.tree.Del = func(ptr uint64) {
+		delete(db.pages, ptr)
+	}
+	return db
+}
+
+func (db *MemKV) Get(key []byte) ([]byte, bool, error) {
+	val, ok, err := db.tree.Read(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return bytes.Clone(val), true, nil
+}
+
+func (db *MemKV) Set(key []byte, val []byte) ([]byte, bool, error) {
+	return db.tree.Replace(key, val)
+}
+
+func (db *MemKV) Del(key []byte) ([]byte, bool, error) {
+	return db.tree.Remove(key)
+}
+
+func (db *MemKV) Count() uint64 {
+	return db.tree.Count()
+}
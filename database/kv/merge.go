@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// Merge upserts every KV of src into dst, scanning src in key order.
+// Keys go through src's and dst's KeyTransform, so onConflict sees user keys.
+// For keys present in both, the stored value is onConflict(key, dstVal, srcVal);
+// a nil onConflict lets src win. The whole merge is committed to dst with
+// a single root update, or not at all if any KV can't be inserted or a
+// page of either is damaged. dst and src must be different KVs.
+// The locks are taken in the order of the addresses of the KVs, so
+// concurrent merges in both directions don't deadlock.
+func Merge(dst *KV, src *KV, onConflict func(key, dstVal, srcVal []byte) []byte) (err error) {
+	if dst == src {
+		return errors.New("merge: dst and src are the same KV")
+	}
+	if dst.ReadOnly {
+		return ErrReadOnly
+	}
+	if uintptr(unsafe.Pointer(dst)) < uintptr(unsafe.Pointer(src)) {
+		dst.mu.Lock()
+		src.mu.RLock()
+	} else {
+		src.mu.RLock()
+		dst.mu.Lock()
+	}
+	defer dst.mu.Unlock()
+	defer src.mu.RUnlock()
+
+	inFn := false
+	defer func() {
+		if r := recover(); r != nil {
+			if inFn {
+				_ = abortUpdate(dst, nil)
+				panic(r) // not ours
+			}
+			err = abortUpdate(dst, corruptErr("merge", r))
+		}
+	}()
+	lo, hi := src.encodeRange(nil, nil)
+	src.tree.Walk(lo, hi, func(stored, storedVal []byte) bool {
+		key := src.decodeKey(stored)
+		val, flags := src.decodeVal(storedVal)
+		var old []byte
+		var ok bool
+		if old, _, ok, err = dbGet(dst, key); err != nil {
+			return false
+		}
+		if ok && onConflict != nil {
+			inFn = true
+			val = onConflict(key, old, val)
+			inFn = false
+		}
+		_, _, err = treeReplace(dst, &dst.tree, dst.encodeKey(key), dst.encodeVal(val, flags))
+		return err == nil
+	})
+	if err != nil {
+		return abortUpdate(dst, fmt.Errorf("merge: %w", err))
+	}
+	return updateFile(dst)
+}
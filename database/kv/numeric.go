@@ -0,0 +1,23 @@
+package kv
+
+import "encoding/binary"
+
+// Keys are compared bytewise, so integers are stored as 8 big-endian bytes
+// to sort in numeric order, with the sign bit of an int64 flipped so that
+// the negative numbers sort first.
+
+func EncodeUint64(u uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, u)
+}
+
+func DecodeUint64(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
+func EncodeInt64(i int64) []byte {
+	return EncodeUint64(uint64(i) ^ (1 << 63))
+}
+
+func DecodeInt64(key []byte) int64 {
+	return int64(DecodeUint64(key) ^ (1 << 63))
+}
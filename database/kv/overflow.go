@@ -0,0 +1,184 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"project/btree"
+)
+
+// In FORMAT_OVERFLOW a kind byte follows the flags of a stored value.
+// A value too large for a leaf is kept in a chain of overflow pages, and
+// the leaf only holds the first page and the length:
+//
+//	| flags | VAL_INLINE   | val          |
+//	| flags | VAL_OVERFLOW | head | length |
+//	|  1B   |      1B      |  8B  |   8B   |
+//
+// An overflow page holds the next page of the chain, 0 on the last one:
+//
+//	| next | data | crc32 |
+//	|  8B  |  ... |  4B   |
+const (
+	VAL_INLINE   = 0
+	VAL_OVERFLOW = 1
+)
+
+const VAL_HEADER = 2
+const OVERFLOW_HEADER = 8
+
+// values up to this size stay in the leaf
+const OVERFLOW_THRESHOLD = btree.BTREE_MAX_VALUE_SIZE - VAL_HEADER
+
+func encodeOverflow(db *KV, val []byte, flags byte) []byte {
+	if len(val) <= OVERFLOW_THRESHOLD {
+		stored := make([]byte, VAL_HEADER+len(val))
+		stored[0], stored[1] = flags, VAL_INLINE
+		copy(stored[VAL_HEADER:], val)
+		return stored
+	}
+	stored := make([]byte, VAL_HEADER+16)
+	stored[0], stored[1] = flags, VAL_OVERFLOW
+	binary.LittleEndian.PutUint64(stored[2:], writeOverflow(db, val))
+	binary.LittleEndian.PutUint64(stored[10:], uint64(len(val)))
+	return stored
+}
+
+// the value bytes of an overflow page.
+func overflowData(pageSize uint64) int {
+	return int(pageSize) - PAGE_CHECKSUM_SIZE - OVERFLOW_HEADER
+}
+
+// returns the first page of the chain.
+func writeOverflow(db *KV, val []byte) uint64 {
+	data := overflowData(db.page.size)
+	next := uint64(0)
+	// from the end so that each page knows the next one
+	for end := len(val); end > 0; {
+		start := (end - 1) / data * data
+		page := make([]byte, int(db.page.size)-PAGE_CHECKSUM_SIZE)
+		binary.LittleEndian.PutUint64(page, next)
+		copy(page[OVERFLOW_HEADER:], val[start:end])
+		next = db.pageAlloc(page)
+		end = start
+	}
+	return next
+}
+
+// the first page and the length of an overflow value.
+func overflowHead(stored []byte) (head uint64, size uint64) {
+	return binary.LittleEndian.Uint64(stored[2:]), binary.LittleEndian.Uint64(stored[10:])
+}
+
+func overflowNext(page []byte) uint64 {
+	return binary.LittleEndian.Uint64(page)
+}
+
+// the length of the chain of an overflow value.
+func overflowPages(db *KV, stored []byte) int64 {
+	_, size := overflowHead(stored)
+	data := uint64(overflowData(db.page.size))
+	return int64((size + data - 1) / data)
+}
+
+// an inline value is returned in place, an overflow value is reassembled
+// from the pages given by get, data bytes per page.
+func decodeOverflow(stored []byte, data int, get func(uint64) []byte) []byte {
+	if stored[1] == VAL_INLINE {
+		return stored[VAL_HEADER:]
+	}
+	head, size := overflowHead(stored)
+	val := make([]byte, 0, size)
+	for ptr := head; ptr != 0 && uint64(len(val)) < size; {
+		page := get(ptr)
+		n := min(uint64(data), size-uint64(len(val)))
+		val = append(val, page[OVERFLOW_HEADER:][:n]...)
+		ptr = overflowNext(page)
+	}
+	if uint64(len(val)) != size {
+		panic(fmt.Errorf("overflow chain at page %d: %d of %d bytes: %w", head, len(val), size, btree.ErrCorrupt))
+	}
+	return val
+}
+
+func isOverflow(db *KV, stored []byte) bool {
+	return db.version >= FORMAT_OVERFLOW && len(stored) >= VAL_HEADER && stored[1] == VAL_OVERFLOW
+}
+
+// free the overflow pages of a stored value that's no longer in the tree.
+func (db *KV) freeVal(stored []byte) {
+	if !isOverflow(db, stored) {
+		return
+	}
+	for ptr := binary.LittleEndian.Uint64(stored[2:]); ptr != 0; {
+		next := overflowNext(db.pageRead(ptr))
+		db.pageFree(ptr)
+		ptr = next
+	}
+}
+
+// insert a stored value and free the overflow pages of the value it
+// replaced, or of its own if it was rejected. returns the old stored value.
+func treeReplace(db *KV, tree *btree.BTree, key, stored []byte) (old []byte, existed bool, err error) {
+	defer recoverChain(&err)
+	old, existed, err = tree.Replace(key, stored)
+	if err != nil {
+		db.freeVal(stored)
+		return nil, false, err
+	}
+	if existed {
+		db.freeVal(old)
+	}
+	return old, existed, nil
+}
+
+// remove a key along with the overflow pages of its value.
+func treeRemove(db *KV, tree *btree.BTree, key []byte) (old []byte, deleted bool, err error) {
+	defer recoverChain(&err)
+	old, deleted, err = tree.Remove(key)
+	if err == nil && deleted {
+		db.freeVal(old)
+	}
+	return old, deleted, err
+}
+
+// a damaged overflow chain found by freeVal.
+func recoverChain(err *error) {
+	if r := recover(); r != nil {
+		*err = corruptErr("free overflow pages", r)
+	}
+}
+
+// remove the keys in [start, end) along with the overflow pages of their
+// values. DeleteRange drops whole subtrees unseen, so the chains are
+// collected first.
+func treeRemoveRange(db *KV, tree *btree.BTree, start, end []byte) (count int, err error) {
+	if db.version >= FORMAT_OVERFLOW {
+		var chains [][]byte
+		err = func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = corruptErr("delete range", r)
+				}
+			}()
+			tree.Walk(start, end, func(key, val []byte) bool {
+				if isOverflow(db, val) {
+					chains = append(chains, bytes.Clone(val))
+				}
+				return true
+			})
+			return nil
+		}()
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if err == nil {
+				for _, stored := range chains {
+					db.freeVal(stored)
+				}
+			}
+		}()
+	}
+	return tree.DeleteRange(start, end)
+}
@@ -0,0 +1,58 @@
+package kv
+
+import (
+	"fmt"
+	"project/btree"
+)
+
+// what the updates of KV.Plan would have written.
+type PlanStats struct {
+	PagesAppended uint64 // the file would grow by this many pages
+	PagesReused   uint64 // taken from the free list
+	PagesFreed    uint64 // added to the free list, reusable after the commit
+	Splits        uint64
+	Merges        uint64
+	Rejected      int   // updates that failed, e.g. with ErrKeyTooLarge
+	Err           error // the first of them
+}
+
+// Plan is a dry run: fn updates a txn as usual, then the updates are
+// counted and discarded instead of committed. The new pages only live in
+// memory, so nothing is written or synced and the file doesn't grow.
+// Commit and Rollback of the txn fail with ErrTxnDone. Like a txn, it must not be
+// interleaved with other writes to the KV.
+func (db *KV) Plan(fn func(txn *Txn)) (stats PlanStats, err error) {
+	if db.ReadOnly {
+		return PlanStats{}, ErrReadOnly
+	}
+	db.mu.Lock()
+	if len(db.page.updates) > 0 {
+		db.mu.Unlock()
+		return PlanStats{}, fmt.Errorf("plan: %w", ErrBatchOpen)
+	}
+	headSeq, tailSeq := db.free.headSeq, db.free.tailSeq
+	db.mu.Unlock()
+
+	var metrics btree.Metrics
+	txn := db.Begin()
+	txn.tree.Metrics = &metrics
+	txn.plan = &stats
+	defer func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		txn.err = ErrTxnDone
+		stats.PagesAppended = db.page.nappend
+		stats.PagesReused = db.free.headSeq - headSeq
+		stats.PagesFreed = db.free.tailSeq - tailSeq
+		stats.Splits = metrics.Splits.Load()
+		stats.Merges = metrics.Merges.Load()
+		if derr := discardUpdates(db); derr != nil && err == nil {
+			err = fmt.Errorf("plan: %w", derr)
+		}
+	}()
+	fn(txn)
+	if txn.err != nil && txn.err != ErrTxnDone {
+		return stats, fmt.Errorf("plan: %w", txn.err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"project/btree"
+)
+
+// GetReader returns a reader of the value that pulls an overflow value one
+// page at a time instead of building it in memory. It reads from a
+// snapshot of the last commit, so the pages stay valid until Close,
+// and it must not be called in the middle of a batch.
+// An inline value is copied into a bytes.Reader.
+func (db *KV) GetReader(key []byte) (io.ReadCloser, bool, error) {
+	snap := db.Snapshot()
+	stored, ok, err := snap.tree.Read(db.encodeKey(key))
+	if err != nil || !ok {
+		snap.Close()
+		return nil, false, err
+	}
+	if !snap.isOverflow(stored) {
+		val := bytes.Clone(snap.decodeVal(stored))
+		snap.Close()
+		return io.NopCloser(bytes.NewReader(val)), true, nil
+	}
+	r := &valueReader{snap: snap}
+	r.next, r.left = overflowHead(stored)
+	return r, true, nil
+}
+
+// reads an overflow chain through a snapshot.
+type valueReader struct {
+	snap *Snapshot
+	next uint64 // the next page of the chain
+	left uint64 // bytes not yet in buf
+	buf  []byte // the unread part of the current page
+}
+
+func (r *valueReader) Read(p []byte) (n int, err error) {
+	if r.snap == nil {
+		return 0, fmt.Errorf("read value: %w", io.ErrClosedPipe)
+	}
+	if len(r.buf) == 0 {
+		if r.left == 0 {
+			return 0, io.EOF
+		}
+		if err := r.load(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *valueReader) load() (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = corruptErr("read value", rec)
+		}
+	}()
+	if r.next == 0 {
+		return fmt.Errorf("read value: overflow chain %d bytes short: %w", r.left, btree.ErrCorrupt)
+	}
+	page := r.snap.pageRead(r.next)
+	n := min(uint64(overflowData(r.snap.pageSize)), r.left)
+	r.buf = page[OVERFLOW_HEADER:][:n]
+	r.left -= n
+	r.next = overflowNext(page)
+	return nil
+}
+
+// Close releases the snapshot, it's safe to call more than once.
+func (r *valueReader) Close() error {
+	if r.snap != nil {
+		r.snap.Close()
+		r.snap, r.buf = nil, nil
+	}
+	return nil
+}
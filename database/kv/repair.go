@@ -0,0 +1,97 @@
+package kv
+
+import "fmt"
+
+// the free list as loaded from the meta page describes a chain of pages
+// in the file ending at the tail, and free pages within the file.
+func freeListValid(db *KV) (ok bool) {
+	fl := &db.free
+	if fl.headPage == 0 || fl.tailPage == 0 {
+		return fl.headPage == fl.tailPage && fl.headSeq == 0 && fl.tailSeq == 0
+	}
+	flushed := db.page.flushed
+	if fl.headPage >= flushed || fl.tailPage >= flushed || fl.headSeq > fl.tailSeq {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false // a bad checksum
+		}
+	}()
+	ptr := fl.headPage
+	node := LNode(db.freeRead(ptr))
+	for seq := fl.headSeq; seq < fl.tailSeq; seq++ {
+		if fl.seq2idx(seq) == 0 && seq != fl.headSeq {
+			if ptr = node.getNext(); ptr == 0 || ptr >= flushed {
+				return false
+			}
+			node = LNode(db.freeRead(ptr))
+		}
+		if item := node.getPtr(fl.seq2idx(seq)); item == 0 || item >= flushed {
+			return false
+		}
+	}
+	if fl.seq2idx(fl.tailSeq) == 0 && fl.tailSeq != fl.headSeq {
+		ptr = node.getNext() // the tail node is empty
+	}
+	return ptr == fl.tailPage
+}
+
+// mark and sweep: every page that isn't reachable from the root, as a
+// tree node or in an overflow chain, goes on a new free list. The old
+// list is dropped, its nodes are free pages too. Returns the number of
+// free pages.
+func rebuildFreeList(db *KV) (int, error) {
+	used := make([]bool, db.page.flushed)
+	used[0] = true // the meta page
+	if err := db.tree.Pages(func(ptr uint64) { used[ptr] = true }); err != nil {
+		return 0, err
+	}
+	db.tree.Walk(nil, nil, func(key, val []byte) bool {
+		if isOverflow(db, val) {
+			for ptr, _ := overflowHead(val); ptr != 0; ptr = overflowNext(db.pageRead(ptr)) {
+				used[ptr] = true
+			}
+		}
+		return true
+	})
+	db.free = FreeList{get: db.free.get, new: db.free.new, set: db.free.set, size: db.free.size}
+	n := 0
+	for ptr, ok := range used {
+		if !ok {
+			db.free.PushTail(uint64(ptr))
+			n++
+		}
+	}
+	return n, nil
+}
+
+func repairFreeList(db *KV) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("repair free list", r)
+		}
+		if err != nil {
+			err = abortUpdate(db, err)
+		}
+	}()
+	if db.repaired, err = rebuildFreeList(db); err != nil {
+		return fmt.Errorf("repair free list: %w", err)
+	}
+	if err = updateFile(db); err != nil {
+		return err
+	}
+	if db.unsynced != nil {
+		return syncMeta(db, db.unsynced) // not left to SyncMode
+	}
+	return nil
+}
+
+// RepairedPages is the number of free pages found by the RepairFreeList
+// scan of Open, 0 if the free list was fine.
+func (db *KV) RepairedPages() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.repaired
+}
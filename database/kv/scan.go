@@ -0,0 +1,173 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+)
+
+// Aggregate folds fn over the KVs in [start, end) in key order, starting
+// from init. An empty end means no upper bound. The key and val passed to
+// fn are only valid during the call; the returned accumulator is kept.
+// fn runs under the read lock, so writers wait for the whole fold. A panic
+// in fn is passed through, a corrupted page returns ErrCorrupt.
+func (db *KV) Aggregate(
+	start, end []byte, fn func(acc, key, val []byte) []byte, init []byte,
+) (acc []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	inFn := false
+	defer func() {
+		if r := recover(); r != nil {
+			if inFn {
+				panic(r) // not ours
+			}
+			acc, err = nil, corruptErr("aggregate", r)
+		}
+	}()
+	acc = init
+	start, end = db.encodeRange(start, end)
+	db.tree.Walk(start, end, func(key, val []byte) bool {
+		val, _ = db.decodeVal(val)
+		inFn = true
+		acc = fn(acc, db.decodeKey(key), val)
+		inFn = false
+		return true
+	})
+	return acc, nil
+}
+
+// All returns all KVs in key order, for use in a range-over-func loop.
+func (db *KV) All() iter.Seq2[[]byte, []byte] {
+	return db.Range(nil, nil)
+}
+
+// Range returns the KVs in [start, end) in key order, for use in a
+// range-over-func loop. An empty end means no upper bound. The yielded
+// key and val are copies. The read lock is held until the loop ends, so
+// the loop body must not call back into the KV. Breaking out of the loop
+// stops the scan. The loop can't return an error, so a corrupted page
+// panics with ErrCorrupt; ScanContext reports it through Err instead.
+func (db *KV) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		lo, hi := db.encodeRange(start, end)
+		it := db.tree.Scan(lo, hi)
+		defer it.Close()
+		for it.Next() {
+			val, _ := db.decodeVal(it.Val())
+			key := append([]byte(nil), db.decodeKey(it.Key())...)
+			if !yield(key, bytes.Clone(val)) {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			panic(fmt.Errorf("range: %w", err))
+		}
+	}
+}
+
+// Keys is Range without the values: they are never read, so overflow
+// pages aren't either. The yielded keys are copies.
+func (db *KV) Keys(start, end []byte) iter.Seq[[]byte] {
+	return func(yield func(key []byte) bool) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		lo, hi := db.encodeRange(start, end)
+		it := db.tree.Scan(lo, hi)
+		defer it.Close()
+		for it.Next() {
+			if !yield(append([]byte(nil), db.decodeKey(it.Key())...)) {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			panic(fmt.Errorf("keys: %w", err))
+		}
+	}
+}
+
+// a copied key-value pair
+type KeyValue struct {
+	Key []byte
+	Val []byte
+}
+
+// ScanBounded returns the KVs in [start, end) until the values add up to
+// maxBytes, plus the key to resume from on the next call (nil when the
+// range is exhausted). At least one KV is returned per call so that a
+// single value larger than maxBytes doesn't stall the pagination.
+func (db *KV) ScanBounded(start, end []byte, maxBytes int) (out []KeyValue, resume []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			out, resume, err = nil, nil, corruptErr("scan bounded", r)
+		}
+	}()
+	total := 0
+	start, end = db.encodeRange(start, end)
+	db.tree.Walk(start, end, func(key, val []byte) bool {
+		val, _ = db.decodeVal(val)
+		if len(out) > 0 && total+len(val) > maxBytes {
+			resume = append([]byte(nil), db.decodeKey(key)...)
+			return false
+		}
+		out = append(out, KeyValue{
+			Key: append([]byte(nil), db.decodeKey(key)...),
+			Val: bytes.Clone(val),
+		})
+		total += len(val)
+		return true
+	})
+	return out, resume, nil
+}
+
+// PrefixScan returns the KVs whose keys begin with prefix, in key order.
+func (db *KV) PrefixScan(prefix []byte) (out []KeyValue, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("prefix scan", r)
+		}
+	}()
+	stored := db.encodeKey(prefix)
+	it := db.tree.Scan(stored, prefixEnd(stored))
+	defer it.Close()
+	for it.Next() {
+		if !bytes.HasPrefix(it.Key(), stored) {
+			break // no successor of the prefix, scanning to the end
+		}
+		val, _ := db.decodeVal(it.Val())
+		out = append(out, KeyValue{
+			Key: append([]byte(nil), db.decodeKey(it.Key())...),
+			Val: bytes.Clone(val),
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("prefix scan: %w", err)
+	}
+	return out, nil
+}
+
+// the smallest key greater than all keys with the prefix, or nil
+// (no upper bound) if the prefix is empty or all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	n := len(prefix)
+	for n > 0 && prefix[n-1] == 0xff {
+		n--
+	}
+	if n == 0 {
+		return nil
+	}
+	end := append([]byte(nil), prefix[:n]...)
+	end[n-1]++
+	return end
+}
@@ -0,0 +1,101 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"project/btree"
+)
+
+// how many keys ScanContext reads between checks of the context
+const SCAN_CONTEXT_INTERVAL = 64
+
+// ScanIter is a cursor over a range of the KV that stops early when its
+// context is done, see ScanContext.
+type ScanIter struct {
+	snap *Snapshot // nil once closed
+	ctx  context.Context
+	it   *btree.Iter
+	key  []byte
+	val  []byte
+	n    int // keys read
+	err  error
+}
+
+// ScanContext returns a cursor over the KVs in [start, end), an empty end
+// means no upper bound:
+//
+//	it := db.ScanContext(ctx, start, end)
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Val())
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// The cursor reads a Snapshot taken here, so it holds no lock: updates
+// don't wait for the scan and it doesn't see them. The snapshot is closed
+// when Next returns false or by Close; a cursor that's never closed keeps
+// its pages off the free list and Compact from running, like any snapshot.
+// Key and Val are valid until the next call.
+func (db *KV) ScanContext(ctx context.Context, start, end []byte) *ScanIter {
+	snap := db.Snapshot()
+	start, end = db.encodeRange(start, end)
+	return &ScanIter{snap: snap, ctx: ctx, it: snap.tree.Scan(start, end)}
+}
+
+// Next moves to the next KV. It returns false at the end of the range,
+// on a corrupted page, or once the context is done.
+func (si *ScanIter) Next() (ok bool) {
+	if si.snap == nil {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			si.err, ok = corruptErr("scan", r), false
+		}
+		if !ok {
+			si.Close()
+		}
+	}()
+	if si.n%SCAN_CONTEXT_INTERVAL == 0 {
+		if err := si.ctx.Err(); err != nil {
+			si.err = fmt.Errorf("scan: %w", err)
+			return false
+		}
+	}
+	if !si.it.Next() {
+		if err := si.it.Err(); err != nil {
+			si.err = fmt.Errorf("scan: %w", err)
+		}
+		return false
+	}
+	si.n++
+	si.key = si.snap.db.decodeKey(si.it.Key())
+	si.val = si.snap.decodeVal(si.it.Val())
+	return true
+}
+
+func (si *ScanIter) Key() []byte {
+	return si.key
+}
+
+func (si *ScanIter) Val() []byte {
+	return si.val
+}
+
+// Err returns nil if the scan reached the end of the range or was closed.
+func (si *ScanIter) Err() error {
+	return si.err
+}
+
+// Close releases the snapshot, it can be called more than once.
+func (si *ScanIter) Close() {
+	if si.snap != nil {
+		si.key, si.val = nil, nil
+		si.it.Close()
+		si.it = nil // back in the pool, see btree.Iter.Close
+		si.snap.Close()
+		si.snap = nil
+	}
+}
@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"project/btree"
+)
+
+// Snapshot is a read-only view of the database at the time it was taken.
+// The tree is copy-on-write, so the view is just the root pointer; the
+// pages reachable from it are kept off the free list until Close.
+// A snapshot taken in the middle of a batch sees its updates so far,
+// the pending pages are copied since the batch modifies them in place.
+// Close snapshots before the KV.
+//
+// Reads don't take the lock, so they never wait for a writer nor hold one
+// up. The free list sequence numbers act as epochs: a page pushed by
+// tree.Del dies at the tail sequence of that moment, and it's only reused
+// once no open snapshot was taken before then, see setFreeListLimit.
+// The pages of the view are committed ones, read from the Storage while
+// the writer may be writing other pages, see Storage. A failed update
+// reloads the format of the KV, so the snapshot keeps its own copy.
+type Snapshot struct {
+	db       *KV
+	tree     btree.BTree
+	seq      uint64            // the free list tail when taken, later items may be reachable
+	updates  map[uint64][]byte // only the log pages of a ReadOnly KV, see walOverlay
+	version  uint64            // db.version when taken
+	pageSize uint64            // db.page.size when taken
+}
+
+func (db *KV) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	snap := &Snapshot{db: db, seq: db.free.tailSeq, version: db.version, pageSize: db.page.size}
+	snap.updates = maps.Clone(db.page.updates)
+	if !db.ReadOnly {
+		for ptr, page := range snap.updates {
+			snap.updates[ptr] = bytes.Clone(page)
+		}
+	}
+	snap.tree.SetRoot(db.tree.Root())
+	snap.tree.Get = snap.pageRead
+	snap.tree.Metrics = db.tree.Metrics
+	if db.snapshots == nil {
+		db.snapshots = map[*Snapshot]struct{}{}
+	}
+	db.snapshots[snap] = struct{}{}
+	return snap
+}
+
+func (snap *Snapshot) pageRead(ptr uint64) []byte {
+	if page, ok := snap.updates[ptr]; ok {
+		return page
+	}
+	return readPage(snap.db.Storage, snap.version, snap.pageSize, ptr)
+}
+
+// db.decodeVal with the format of the snapshot.
+func (snap *Snapshot) decodeVal(stored []byte) []byte {
+	switch {
+	case snap.version < FORMAT_VALUE_FLAGS || len(stored) == 0:
+		return stored
+	case snap.version >= FORMAT_OVERFLOW:
+		return decodeOverflow(stored, overflowData(snap.pageSize), snap.pageRead)
+	}
+	return stored[1:]
+}
+
+func (snap *Snapshot) isOverflow(stored []byte) bool {
+	return snap.version >= FORMAT_OVERFLOW && len(stored) >= VAL_HEADER && stored[1] == VAL_OVERFLOW
+}
+
+// Close releases the snapshot. Its pages are reused after the next update.
+func (snap *Snapshot) Close() {
+	snap.db.mu.Lock()
+	defer snap.db.mu.Unlock()
+
+	delete(snap.db.snapshots, snap)
+}
+
+func (snap *Snapshot) Get(key []byte) (val []byte, ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			val, ok, err = nil, false, corruptErr(fmt.Sprintf("get %q", key), r)
+		}
+	}()
+	stored, ok, err := snap.tree.Read(snap.db.encodeKey(key))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return bytes.Clone(snap.decodeVal(stored)), true, nil
+}
+
+// Scan calls fn on the KVs in [start, end) in key order until it returns
+// false. An empty end means no upper bound. The key and val passed to fn
+// are only valid during the call.
+func (snap *Snapshot) Scan(start, end []byte, fn func(key, val []byte) bool) (err error) {
+	inFn := false
+	defer func() {
+		if r := recover(); r != nil {
+			if inFn {
+				panic(r) // not ours
+			}
+			err = corruptErr("scan", r)
+		}
+	}()
+	db := snap.db
+	start, end = db.encodeRange(start, end)
+	snap.tree.Walk(start, end, func(key, val []byte) bool {
+		val = snap.decodeVal(val)
+		inFn = true
+		cont := fn(db.decodeKey(key), val)
+		inFn = false
+		return cont
+	})
+	return nil
+}
+
+// the free list only hands out pages freed before seq, the tail of the
+// last durable commit, and before the oldest open snapshot was taken.
+func setFreeListLimit(db *KV, seq uint64) {
+	db.free.SetMaxSeq(seq)
+	for snap := range db.snapshots {
+		db.free.maxSeq = min(db.free.maxSeq, snap.seq)
+	}
+}
@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+// SSTable layout, all integers little-endian:
+//
+//	| data block | index block | footer |
+//
+// data block:  | klen u32 | vlen u32 | key | val | ... sorted by key
+// index block: | klen u32 | key | data offset u64 | ... every SSTABLE_INDEX_INTERVAL-th entry
+// footer:      | index offset u64 | index entries u64 | data entries u64 | magic |
+const SSTABLE_MAGIC = "BMOXSST1"
+const SSTABLE_INDEX_INTERVAL = 16
+const SSTABLE_FOOTER_SIZE = 8 + 8 + 8 + len(SSTABLE_MAGIC)
+
+type sstIndexEntry struct {
+	key    []byte
+	offset uint64
+}
+
+// ExportSSTable writes all KVs to an immutable sorted-string-table file.
+// Unlike a page-level copy of the database, the format is independent of
+// the B-tree layout and can be consumed by other tools.
+// Like Clone, it's written to a temporary file and renamed over path, so
+// a failed export leaves an existing file at path as it was.
+func (db *KV) ExportSSTable(path string) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	tmp := fmt.Sprintf("%s.tmp.%d", path, rand.Int())
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("create sstable: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptErr("export sstable", r)
+		}
+		if err != nil {
+			_ = fp.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	if err = sstableWrite(db, fp); err != nil {
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	if err = syncDir(path, db.FsyncHook); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	return nil
+}
+
+func sstableWrite(db *KV, fp *os.File) error {
+	w := bufio.NewWriter(fp)
+
+	// data block
+	var index []sstIndexEntry
+	offset, count := uint64(0), uint64(0)
+	var werr error
+	lo, hi := db.encodeRange(nil, nil)
+	db.tree.Walk(lo, hi, func(key, val []byte) bool {
+		key = db.decodeKey(key)
+		val, _ = db.decodeVal(val)
+		if count%SSTABLE_INDEX_INTERVAL == 0 {
+			index = append(index, sstIndexEntry{append([]byte(nil), key...), offset})
+		}
+		var head [8]byte
+		binary.LittleEndian.PutUint32(head[0:4], uint32(len(key)))
+		binary.LittleEndian.PutUint32(head[4:8], uint32(len(val)))
+		if _, werr = w.Write(head[:]); werr != nil {
+			return false
+		}
+		if _, werr = w.Write(key); werr != nil {
+			return false
+		}
+		if _, werr = w.Write(val); werr != nil {
+			return false
+		}
+		offset += uint64(8 + len(key) + len(val))
+		count++
+		return true
+	})
+	if werr != nil {
+		return fmt.Errorf("write sstable data: %w", werr)
+	}
+
+	// index block
+	indexOffset := offset
+	for _, ent := range index {
+		buf := make([]byte, 4+len(ent.key)+8)
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(len(ent.key)))
+		copy(buf[4:], ent.key)
+		binary.LittleEndian.PutUint64(buf[4+len(ent.key):], ent.offset)
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("write sstable index: %w", err)
+		}
+	}
+
+	// footer
+	footer := make([]byte, SSTABLE_FOOTER_SIZE)
+	binary.LittleEndian.PutUint64(footer[0:8], indexOffset)
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(index)))
+	binary.LittleEndian.PutUint64(footer[16:24], count)
+	copy(footer[24:], SSTABLE_MAGIC)
+	if _, err := w.Write(footer); err != nil {
+		return fmt.Errorf("write sstable footer: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	return nil
+}
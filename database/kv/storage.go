@@ -0,0 +1,260 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Storage holds the bytes of a KV, see KV.Storage. The KV decides the
+// layout: the meta page at offset 0, then page ptr at ptr*page size.
+// FileStorage, the default, is the database file; MemStorage keeps the
+// bytes in memory. Another implementation can put them in an object store.
+//
+// It works on byte offsets rather than pages (ReadPage, AppendPage,
+// FreePage): the page size is in the meta page, which is read before the
+// size is known; consecutive pages are written with one WriteAt, see
+// KV.WriteBatchPages; and the free list lives in the pages themselves,
+// so there is nothing for a FreePage to do.
+//
+// The KV calls ReadAt under its read or write lock, except for snapshots,
+// which read without any lock; so ReadAt must be safe concurrently with
+// itself and with WriteAt. The other methods are called under the write lock.
+// Only two kinds of pages are written again in place, the meta page and
+// the tail node of the free list, and both are only read under the lock.
+// A page a snapshot can reach is never written while it's open.
+type Storage interface {
+	// ReadAt returns n bytes at off, an error past Size. The KV doesn't
+	// modify the slice, and it doesn't read a page through an old slice
+	// once the page is written again.
+	ReadAt(off int64, n int) ([]byte, error)
+	// WriteAt writes data at off, extending the storage if needed.
+	WriteAt(off int64, data []byte) error
+	Size() (int64, error)
+	// Grow reserves room for size bytes, see KV.GrowBy. It may do nothing.
+	Grow(size int64) error
+	Truncate(size int64) error
+	// Sync makes the writes so far durable.
+	Sync() error
+	Close() error
+}
+
+var (
+	_ Storage = (*MemStorage)(nil)
+	_ Storage = (*FileStorage)(nil)
+)
+
+var ErrPageNotFound = errors.New("page not found")
+
+// MemStorage keeps the bytes in memory, nothing is persisted. It outlives
+// Close, so a KV can be opened on it again.
+type MemStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) ReadAt(off int64, n int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if off < 0 || off+int64(n) > int64(len(s.data)) {
+		return nil, fmt.Errorf("read %d bytes at %d: %w", n, off, ErrPageNotFound)
+	}
+	// a copy, so that a later WriteAt can't change the bytes under a reader
+	return bytes.Clone(s.data[off : off+int64(n)]), nil
+}
+
+func (s *MemStorage) WriteAt(off int64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end := off + int64(len(data)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+	copy(s.data[off:], data)
+	return nil
+}
+
+func (s *MemStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *MemStorage) Grow(size int64) error {
+	return nil
+}
+
+func (s *MemStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size < int64(len(s.data)) {
+		s.data = s.data[:size]
+	}
+	return nil
+}
+
+func (s *MemStorage) Sync() error {
+	return nil
+}
+
+func (s *MemStorage) Close() error {
+	return nil
+}
+
+// FileStorage is the database file. Writes use pwrite, reads return slices
+// of a read-only mmap. The mapping grows by adding chunks rather than
+// remapping, so the slices stay valid until Close.
+type FileStorage struct {
+	path      string
+	fd        int
+	fsyncHook func(fd int) error // see KV.FsyncHook
+	size      atomic.Int64       // the file size
+	mu        sync.Mutex         // adding chunks
+	mapped    atomic.Int64       // mmap size, can be larger than the file size
+	chunks    atomic.Pointer[[][]byte]
+}
+
+// OpenFileStorage opens or creates the file at path.
+func OpenFileStorage(path string) (*FileStorage, error) {
+	return openFileStorage(path, false, nil)
+}
+
+// open the file and fsync its directory, a read-only file must exist.
+func openFileStorage(path string, readOnly bool, hook func(fd int) error) (*FileStorage, error) {
+	var fd int
+	var err error
+	if readOnly {
+		if fd, err = syscall.Open(path, syscall.O_RDONLY, 0); err != nil {
+			return nil, fmt.Errorf("open file: %w", err)
+		}
+	} else if fd, err = createFileSync(path, hook); err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("fstat: %w", err)
+	}
+	s := &FileStorage{path: path, fd: fd, fsyncHook: hook}
+	s.size.Store(st.Size)
+	s.chunks.Store(&[][]byte{})
+	return s, nil
+}
+
+func (s *FileStorage) ReadAt(off int64, n int) ([]byte, error) {
+	end := off + int64(n)
+	if off < 0 || end > s.size.Load() {
+		return nil, fmt.Errorf("read %d bytes at %d: %w", n, off, ErrPageNotFound)
+	}
+	if end > s.mapped.Load() {
+		if err := s.extendMmap(end); err != nil {
+			return nil, err
+		}
+	}
+	start := int64(0)
+	for _, chunk := range *s.chunks.Load() {
+		if off < start+int64(len(chunk)) {
+			if end > start+int64(len(chunk)) {
+				break // across 2 chunks
+			}
+			return chunk[off-start : end-start : end-start], nil
+		}
+		start += int64(len(chunk))
+	}
+	buf := make([]byte, n)
+	if _, err := syscall.Pread(s.fd, buf, off); err != nil {
+		return nil, fmt.Errorf("read %d bytes at %d: %w", n, off, err)
+	}
+	return buf, nil
+}
+
+// make sure the mmap covers `size` bytes of the file.
+func (s *FileStorage) extendMmap(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := s.mapped.Load()
+	if size <= total {
+		return nil // enough range
+	}
+	alloc := max(total, 64<<20) // double the current address space
+	for total+alloc < size {
+		alloc *= 2 // still not enough?
+	}
+	chunk, err := syscall.Mmap(
+		s.fd, total, int(alloc),
+		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	// readers may be going through the old list
+	chunks := append(*s.chunks.Load(), chunk)
+	s.chunks.Store(&chunks)
+	s.mapped.Store(total + alloc)
+	return nil
+}
+
+func (s *FileStorage) WriteAt(off int64, data []byte) error {
+	n, err := syscall.Pwrite(s.fd, data, off)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return err
+	}
+	if end := off + int64(len(data)); end > s.size.Load() {
+		s.size.Store(end)
+	}
+	return nil
+}
+
+func (s *FileStorage) Size() (int64, error) {
+	return s.size.Load(), nil
+}
+
+func (s *FileStorage) Grow(size int64) error {
+	if err := syscall.Fallocate(s.fd, 0, 0, size); err != nil {
+		return err
+	}
+	if size > s.size.Load() {
+		s.size.Store(size)
+	}
+	return nil
+}
+
+// the chunks past the new end stay mapped but aren't read.
+func (s *FileStorage) Truncate(size int64) error {
+	if err := syscall.Ftruncate(s.fd, size); err != nil {
+		return err
+	}
+	s.size.Store(size)
+	return nil
+}
+
+func (s *FileStorage) Sync() error {
+	return fsyncFd(s.fsyncHook, s.fd)
+}
+
+// Close unmaps and closes the file. Slices returned by ReadAt are invalid
+// afterwards.
+func (s *FileStorage) Close() error {
+	for _, chunk := range *s.chunks.Load() {
+		if err := syscall.Munmap(chunk); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
+	s.chunks.Store(&[][]byte{})
+	s.mapped.Store(0)
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,63 @@
+package kv
+
+import "time"
+
+// SyncMode trades durability for write speed. An update is written to the
+// file in every mode and is visible to readers right away, the modes only
+// differ in when it's made durable with fsync and the meta page.
+//
+// Until then the meta page on disk keeps pointing at the last durable tree,
+// and the pages reachable from it are not reused, so a crash loses the
+// recent updates but never leaves a broken file.
+type SyncMode int
+
+const (
+	// every update is durable when it returns, 2 fsyncs per update.
+	SyncAlways SyncMode = iota
+	// updates are durable only after Flush or Close.
+	SyncNever
+	// updates are flushed in the background every KV.SyncPeriod, so at
+	// most the updates of the last period are lost in a crash.
+	SyncInterval
+)
+
+// Flush makes the updates so far durable. It's a no-op with SyncAlways.
+func (db *KV) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.unsynced == nil {
+		return nil
+	}
+	return syncMeta(db, db.unsynced)
+}
+
+func startSync(db *KV) {
+	period := db.SyncPeriod
+	if period == 0 {
+		period = time.Second
+	}
+	db.syncStop, db.syncDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(db.syncDone)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// a failed flush is retried on the next tick and by Close
+				_ = db.Flush()
+			case <-db.syncStop:
+				return
+			}
+		}
+	}()
+}
+
+func stopSync(db *KV) {
+	if db.syncStop != nil {
+		close(db.syncStop)
+		<-db.syncDone
+		db.syncStop, db.syncDone = nil, nil
+	}
+}
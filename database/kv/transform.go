@@ -0,0 +1,38 @@
+package kv
+
+// KeyTransform maps the keys users pass in to the keys stored in the tree
+// and back, e.g. to put every key under a namespace prefix or to hash keys.
+// Nil functions are the identity.
+// Scans encode their bounds and run in stored-key order, so ranges are only
+// meaningful for order-preserving transforms like prefixing. The keys of
+// a KV are the stored keys starting with Encode(nil): an empty end bound
+// stops past them, so KVs with different prefixes can share a file.
+type KeyTransform struct {
+	Encode func(user []byte) []byte
+	Decode func(stored []byte) []byte
+}
+
+func (db *KV) encodeKey(key []byte) []byte {
+	if db.KeyTransform.Encode == nil {
+		return key
+	}
+	return db.KeyTransform.Encode(key)
+}
+
+func (db *KV) decodeKey(key []byte) []byte {
+	if db.KeyTransform.Decode == nil {
+		return key
+	}
+	return db.KeyTransform.Decode(key)
+}
+
+// an empty end is the end of the namespace, see KeyTransform.
+func (db *KV) encodeRange(start, end []byte) ([]byte, []byte) {
+	start = db.encodeKey(start)
+	if len(end) > 0 {
+		end = db.encodeKey(end)
+	} else if db.KeyTransform.Encode != nil {
+		end = prefixEnd(db.encodeKey(nil))
+	}
+	return start, end
+}
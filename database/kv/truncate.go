@@ -0,0 +1,118 @@
+package kv
+
+import "fmt"
+
+// Truncate shrinks the file by the run of free pages at its end and
+// returns the number of pages cut. The free list is rewritten without
+// them in one update, then the file is truncated once that update is
+// durable. Unlike Compact, the tree isn't copied and the free pages in
+// the middle of the file stay on the list, Compact reclaims those.
+// Snapshots may read the freed pages and must be closed first, and a
+// batch must not be open; it fails with ErrSnapshotsOpen or ErrBatchOpen.
+func (db *KV) Truncate() (n int, err error) {
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(db.page.updates) > 0 {
+		return 0, fmt.Errorf("truncate: %w", ErrBatchOpen)
+	}
+	if len(db.snapshots) > 0 {
+		return 0, fmt.Errorf("truncate: %d %w", len(db.snapshots), ErrSnapshotsOpen)
+	}
+	if db.unsynced != nil {
+		// the pages freed by the last update become reusable
+		if err := syncMeta(db, db.unsynced); err != nil {
+			return 0, err
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = abortUpdate(db, corruptErr("truncate", r))
+		}
+	}()
+	items, nodes := freeListPages(db)
+	free := map[uint64]bool{}
+	for _, ptr := range append(items, nodes...) {
+		free[ptr] = true
+	}
+	end := db.page.flushed
+	for end > 1 && free[end-1] {
+		end--
+	}
+	if end == db.page.flushed {
+		return 0, nil
+	}
+	before := db.page.flushed
+	db.page.flushed = end
+	truncateFreeList(db, items, nodes)
+	if err := updateFile(db); err != nil {
+		return 0, abortUpdate(db, err)
+	}
+	if db.unsynced != nil {
+		if err := syncMeta(db, db.unsynced); err != nil {
+			return 0, err
+		}
+	}
+	if err := db.Storage.Truncate(int64(db.page.flushed * db.page.size)); err != nil {
+		return 0, fmt.Errorf("truncate: %w", err)
+	}
+	db.page.reserved = db.page.flushed
+	return int(before - db.page.flushed), nil
+}
+
+// the items of the free list and the pages of its nodes.
+func freeListPages(db *KV) (items []uint64, nodes []uint64) {
+	fl := &db.free
+	if fl.headPage == 0 {
+		return nil, nil
+	}
+	nodes = append(nodes, fl.headPage)
+	node := LNode(db.freeRead(fl.headPage))
+	for seq := fl.headSeq; seq < fl.tailSeq; seq++ {
+		if fl.seq2idx(seq) == 0 && seq != fl.headSeq {
+			nodes = append(nodes, node.getNext())
+			node = LNode(db.freeRead(node.getNext()))
+		}
+		items = append(items, node.getPtr(fl.seq2idx(seq)))
+	}
+	if last := nodes[len(nodes)-1]; last != fl.tailPage {
+		nodes = append(nodes, fl.tailPage) // the empty tail node
+	}
+	return items, nodes
+}
+
+// a new free list with the pages below the new end. Its nodes are taken
+// from the free items, which the committed state doesn't use; the old
+// nodes are still in use until the update is durable, so they only go on
+// the list as items.
+func truncateFreeList(db *KV, items []uint64, nodes []uint64) {
+	var keep []uint64
+	for _, ptr := range items {
+		if ptr < db.page.flushed {
+			keep = append(keep, ptr)
+		}
+	}
+	next := 0 // the next item to push
+	db.free = FreeList{get: db.free.get, set: db.free.set, size: db.free.size}
+	defer func() { db.free.new = db.pageAppend }()
+	db.free.new = func(node []byte) uint64 {
+		if len(keep) <= next {
+			return db.pageAppend(node)
+		}
+		ptr := keep[len(keep)-1]
+		keep = keep[:len(keep)-1]
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	for ; next < len(keep); next++ {
+		db.free.PushTail(keep[next])
+	}
+	for _, ptr := range nodes {
+		if ptr < db.page.flushed {
+			db.free.PushTail(ptr)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package kv
+
+import (
+	"fmt"
+	"project/record"
+)
+
+// A tuple key is a list of segments, each encoded as a bytes column of a
+// record: escaped and terminated by 0x00. So keys sort segment by segment,
+// 0x00 bytes inside a segment included, and the keys sharing the leading
+// segments are exactly the keys with their encoding as a prefix.
+func EncodeTuple(segments ...[]byte) []byte {
+	vals := make([]record.Value, len(segments))
+	for i, seg := range segments {
+		vals[i] = record.Bytes(seg)
+	}
+	return record.EncodeRecord(vals)
+}
+
+// DecodeTuple splits a key made by EncodeTuple, the error wraps
+// record.ErrBadRecord.
+func DecodeTuple(key []byte) (segments [][]byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cause, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			segments, err = nil, fmt.Errorf("tuple: %w", cause)
+		}
+	}()
+	for i, v := range record.DecodeRecord(key) {
+		if v.Type != record.TYPE_BYTES {
+			return nil, fmt.Errorf("tuple: segment %d of type %d: %w", i, v.Type, record.ErrBadRecord)
+		}
+		segments = append(segments, v.Str)
+	}
+	return segments, nil
+}
+
+// ScanPrefixTuple returns the KVs whose tuple keys begin with the given
+// segments, in key order. No segments returns everything.
+func (db *KV) ScanPrefixTuple(segments ...[]byte) ([]KeyValue, error) {
+	return db.PrefixScan(EncodeTuple(segments...))
+}
@@ -0,0 +1,121 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"project/btree"
+)
+
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn updates several keys as one atomic unit. It works on its own copy
+// of the root pointer, so its updates are invisible to the KV until
+// Commit swaps the root. Pages freed by the txn stay on the free list
+// until it commits, so reads through the KV keep working meanwhile.
+// There can only be one writer at a time: don't update the KV directly
+// while a txn is open.
+type Txn struct {
+	db   *KV
+	tree btree.BTree
+	err  error      // ErrTxnDone or a corrupted page, only Rollback is possible
+	plan *PlanStats // counts the rejected updates of KV.Plan
+}
+
+func (db *KV) Begin() *Txn {
+	return &Txn{db: db, tree: db.tree}
+}
+
+// Get sees the updates of the txn.
+func (txn *Txn) Get(key []byte) ([]byte, bool, error) {
+	txn.db.mu.RLock()
+	defer txn.db.mu.RUnlock()
+
+	if txn.err != nil {
+		return nil, false, txn.err
+	}
+	stored, ok, err := txn.tree.Read(txn.db.encodeKey(key))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	val, _ := txn.db.decodeVal(stored)
+	return bytes.Clone(val), true, nil
+}
+
+func (txn *Txn) Set(key []byte, val []byte) error {
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	if txn.err != nil {
+		return txn.err
+	}
+	if txn.db.ReadOnly {
+		return ErrReadOnly
+	}
+	db := txn.db
+	_, _, err := treeReplace(db, &txn.tree, db.encodeKey(key), db.encodeVal(val, 0))
+	return txn.check(err)
+}
+
+func (txn *Txn) Del(key []byte) (bool, error) {
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	if txn.err != nil {
+		return false, txn.err
+	}
+	if txn.db.ReadOnly {
+		return false, ErrReadOnly
+	}
+	_, deleted, err := treeRemove(txn.db, &txn.tree, txn.db.encodeKey(key))
+	return deleted, txn.check(err)
+}
+
+func (txn *Txn) check(err error) error {
+	if err != nil && txn.plan != nil {
+		txn.plan.Rejected++
+		if txn.plan.Err == nil {
+			txn.plan.Err = err
+		}
+	}
+	if errors.Is(err, btree.ErrCorrupt) {
+		txn.err = err
+	}
+	return err
+}
+
+// Commit makes the updates visible and durable with a single root update.
+// On error the on-disk root is left untouched and the updates are dropped.
+func (txn *Txn) Commit() error {
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	if txn.err != nil {
+		return txn.err
+	}
+	if txn.plan != nil {
+		return ErrTxnDone
+	}
+	if txn.db.ReadOnly {
+		return ErrReadOnly
+	}
+	db := txn.db
+	txn.err = ErrTxnDone
+	db.tree.SetRoot(txn.tree.Root())
+	db.tree.SetCount(txn.tree.Count())
+	if err := updateFile(db); err != nil {
+		return abortUpdate(db, err)
+	}
+	return nil
+}
+
+// Rollback drops the root of the txn along with the pages it allocated.
+func (txn *Txn) Rollback() error {
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	if txn.err == ErrTxnDone || txn.plan != nil {
+		return ErrTxnDone
+	}
+	txn.err = ErrTxnDone
+	return discardUpdates(txn.db)
+}
@@ -0,0 +1,57 @@
+package kv
+
+import "errors"
+
+// on-disk format versions, kept in the meta page
+const (
+	FORMAT_PLAIN       = 0 // values are stored as-is
+	FORMAT_VALUE_FLAGS = 1 // values start with a 1-byte flags field
+	FORMAT_CHECKSUM    = 2 // pages end with a CRC32
+	FORMAT_OVERFLOW    = 3 // large values are kept in overflow pages, see overflow.go
+)
+
+// the format of newly created files
+const FORMAT_VERSION = FORMAT_OVERFLOW
+
+var ErrFormatVersion = errors.New("not supported by the file format version")
+
+// the stored form of a value. a large value is written to overflow pages,
+// which are freed by freeVal if the value doesn't end up in the tree.
+func (db *KV) encodeVal(val []byte, flags byte) []byte {
+	if db.version < FORMAT_VALUE_FLAGS {
+		return val
+	}
+	if db.version >= FORMAT_OVERFLOW {
+		return encodeOverflow(db, val, flags)
+	}
+	stored := make([]byte, 1+len(val))
+	stored[0] = flags
+	copy(stored[1:], val)
+	return stored
+}
+
+// the logical value and its flags
+func (db *KV) decodeVal(stored []byte) ([]byte, byte) {
+	if db.version < FORMAT_VALUE_FLAGS || len(stored) == 0 {
+		return stored, 0
+	}
+	if db.version >= FORMAT_OVERFLOW {
+		return decodeOverflow(stored, overflowData(db.page.size), db.pageRead), stored[0]
+	}
+	return stored[1:], stored[0]
+}
+
+// the length of the logical value, an overflow chain isn't read.
+func (db *KV) valSize(stored []byte) uint64 {
+	switch {
+	case db.version < FORMAT_VALUE_FLAGS || len(stored) == 0:
+		return uint64(len(stored))
+	case isOverflow(db, stored):
+		_, size := overflowHead(stored)
+		return size
+	case db.version >= FORMAT_OVERFLOW:
+		return uint64(len(stored) - VAL_HEADER)
+	default:
+		return uint64(len(stored) - 1)
+	}
+}
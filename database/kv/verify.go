@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"project/btree"
+)
+
+// part of VerifyAfterWrite: the written key reads back as expected, and
+// the nodes on the path to it pass btree.BTree.VerifyPath.
+func verifyWrite(db *KV, key []byte, val []byte, exists bool) error {
+	got, ok, err := db.tree.Read(key)
+	switch {
+	case err != nil:
+	case ok != exists:
+		err = fmt.Errorf("found %v after the write: %w", ok, btree.ErrCorrupt)
+	case exists && !bytes.Equal(got, val):
+		err = fmt.Errorf("value mismatch: %w", btree.ErrCorrupt)
+	default:
+		err = db.tree.VerifyPath(key)
+	}
+	if err != nil {
+		return fmt.Errorf("verify after write %q: %w", db.decodeKey(key), err)
+	}
+	return nil
+}
+
+// Verify checks the invariants of the whole tree, see BTree.Verify.
+func (db *KV) Verify() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.tree.Verify()
+}
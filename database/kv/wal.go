@@ -0,0 +1,195 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"project/btree"
+)
+
+// The write-ahead log holds the pages and the meta page of the last update,
+// written and fsync'ed before the database file is touched:
+//
+//	| magic | npages | meta page | ptr | page | ... | crc32 |
+//	|  8B   |   8B   | META_SIZE | 8B  |  *   |     |  4B   |
+//
+// The pages have the size given by the meta page.
+//
+// A complete record may not have reached the database file yet, so Open
+// writes it again, which is harmless if it did. A partial record is an
+// update that never started on the database file and is dropped.
+// The record is kept until the next update or Open replaces it.
+const WAL_MAGIC = "BMOXWAL1"
+const WAL_HEADER = len(WAL_MAGIC) + 8 + META_SIZE
+
+func walPath(db *KV) string {
+	return db.Path + ".wal"
+}
+
+// replay or drop the log left by the last run, and open it if db.WAL is set.
+func openWAL(db *KV) error {
+	if _, ok := db.Storage.(*FileStorage); !ok {
+		if db.WAL {
+			return fmt.Errorf("wal without a FileStorage: %w", errors.ErrUnsupported)
+		}
+		return nil // there's no file next to it
+	}
+	if db.ReadOnly {
+		return nil // see walOverlay
+	}
+	fp, err := os.OpenFile(walPath(db), os.O_RDWR, 0o644)
+	if errors.Is(err, os.ErrNotExist) {
+		if !db.WAL {
+			return nil
+		}
+		fp, err = os.OpenFile(walPath(db), os.O_RDWR|os.O_CREATE, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	if err = walRecover(db, fp); err != nil {
+		_ = fp.Close()
+		return err
+	}
+	if !db.WAL {
+		// a stale record must not be replayed after updates made without the log
+		_ = fp.Close()
+		if err = os.Remove(walPath(db)); err != nil {
+			return fmt.Errorf("remove wal: %w", err)
+		}
+		return nil
+	}
+	db.wal = fp
+	return nil
+}
+
+// ReadOnly can't replay the log, the pages of a complete record are put in
+// the pending updates instead, and its meta page replaces the file's.
+// size is extended to the pages of the record.
+func walOverlay(db *KV, meta []byte, size int64) ([]byte, int64, error) {
+	if _, ok := db.Storage.(*FileStorage); !ok {
+		return meta, size, nil
+	}
+	data, err := os.ReadFile(walPath(db))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, size, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("read wal: %w", err)
+	}
+	walMeta, pages, ok := walDecode(data)
+	if !ok {
+		return meta, size, nil
+	}
+	for ptr, page := range pages {
+		db.page.updates[ptr] = page
+		size = max(size, int64((ptr+1)*uint64(len(page))))
+	}
+	return walMeta, size, nil
+}
+
+func walRecover(db *KV, fp *os.File) error {
+	data, err := io.ReadAll(fp)
+	if err != nil {
+		return fmt.Errorf("read wal: %w", err)
+	}
+	if meta, pages, ok := walDecode(data); ok {
+		for ptr, page := range pages {
+			if err := db.Storage.WriteAt(int64(ptr*uint64(len(page))), page); err != nil {
+				return fmt.Errorf("replay wal: write page %d: %w", ptr, err)
+			}
+		}
+		if err := db.Storage.WriteAt(0, meta); err != nil {
+			return fmt.Errorf("replay wal: write meta page: %w", err)
+		}
+		if err := fsync(db); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync wal: %w", err)
+	}
+	return nil
+}
+
+// parse a record, ok is false for an incomplete or damaged one.
+func walDecode(data []byte) (meta []byte, pages map[uint64][]byte, ok bool) {
+	if len(data) < WAL_HEADER || !bytes.Equal(data[:len(WAL_MAGIC)], []byte(WAL_MAGIC)) {
+		return nil, nil, false
+	}
+	npages := binary.LittleEndian.Uint64(data[len(WAL_MAGIC):])
+	meta = data[WAL_HEADER-META_SIZE : WAL_HEADER]
+	pageSize := binary.LittleEndian.Uint64(meta[64:72])
+	if pageSize == 0 {
+		pageSize = btree.BTREE_PAGE_SIZE
+	}
+	if checkPageSize(pageSize) != nil {
+		return nil, nil, false
+	}
+	size := uint64(WAL_HEADER) + npages*(8+pageSize)
+	if npages > uint64(len(data)) || uint64(len(data)) < size+4 {
+		return nil, nil, false // cut short
+	}
+	if crc32.ChecksumIEEE(data[:size]) != binary.LittleEndian.Uint32(data[size:]) {
+		return nil, nil, false
+	}
+	pages = map[uint64][]byte{}
+	for pos := uint64(WAL_HEADER); pos < size; pos += 8 + pageSize {
+		ptr := binary.LittleEndian.Uint64(data[pos:])
+		pages[ptr] = data[pos+8 : pos+8+pageSize]
+	}
+	return meta, pages, true
+}
+
+func walEncode(db *KV) []byte {
+	out := make([]byte, WAL_HEADER, WAL_HEADER+len(db.page.updates)*(8+int(db.page.size))+4)
+	copy(out, WAL_MAGIC)
+	binary.LittleEndian.PutUint64(out[len(WAL_MAGIC):], uint64(len(db.page.updates)))
+	copy(out[WAL_HEADER-META_SIZE:], encodeMeta(db, db.page.flushed+db.page.nappend))
+	for ptr, page := range db.page.updates {
+		out = binary.LittleEndian.AppendUint64(out, ptr)
+		if db.version >= FORMAT_CHECKSUM {
+			page = pageSeal(page, db.page.size)
+		}
+		out = append(out, page...)
+		out = append(out, make([]byte, int(db.page.size)-len(page))...)
+	}
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// the update is durable once the log is, so the database file needs
+// only 1 fsync and no ordering between the pages and the meta page.
+// An update failing after the log is synced may still be applied by Open.
+func updateFileWAL(db *KV) error {
+	record := walEncode(db)
+	if err := db.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := db.wal.WriteAt(record, 0); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := db.wal.Sync(); err != nil {
+		return fmt.Errorf("fsync wal: %w", err)
+	}
+	if err := writePages(db); err != nil {
+		return err
+	}
+	if err := updateRoot(db); err != nil {
+		return err
+	}
+	if err := fsync(db); err != nil {
+		return err
+	}
+	setFreeListLimit(db, db.free.tailSeq)
+	return nil
+}
@@ -0,0 +1,110 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A record is a sequence of typed columns, encoded so that comparing the
+// encoded bytes orders records column by column, which makes them usable
+// as keys as well as values. Each column is a type tag and the data:
+//
+//	| type | int64, sign bit flipped, big-endian |
+//	|  1B  |                8B                   |
+//
+//	| type | string or bytes, escaped | 0x00 |
+//	|  1B  |           ...            |  1B  |
+//
+// In strings 0x00 is escaped as 0x01 0x01 and 0x01 as 0x01 0x02, so the
+// terminator sorts before any content and shorter strings sort first.
+const (
+	TYPE_INT64  = 1
+	TYPE_STRING = 2
+	TYPE_BYTES  = 3
+)
+
+var ErrBadRecord = errors.New("malformed record")
+
+// a column, Str holds both strings and bytes.
+type Value struct {
+	Type uint8
+	I64  int64
+	Str  []byte
+}
+
+func Int64(v int64) Value {
+	return Value{Type: TYPE_INT64, I64: v}
+}
+
+func String(s string) Value {
+	return Value{Type: TYPE_STRING, Str: []byte(s)}
+}
+
+func Bytes(b []byte) Value {
+	return Value{Type: TYPE_BYTES, Str: b}
+}
+
+func EncodeRecord(vals []Value) []byte {
+	var out []byte
+	for _, v := range vals {
+		out = append(out, v.Type)
+		switch v.Type {
+		case TYPE_INT64:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64)^(1<<63))
+		case TYPE_STRING, TYPE_BYTES:
+			for _, c := range v.Str {
+				if c <= 1 {
+					out = append(out, 0x01, c+1)
+				} else {
+					out = append(out, c)
+				}
+			}
+			out = append(out, 0x00)
+		default:
+			panic(fmt.Sprintf("record: bad value type %d", v.Type))
+		}
+	}
+	return out
+}
+
+// DecodeRecord panics with ErrBadRecord if data is not an encoded record.
+func DecodeRecord(data []byte) []Value {
+	var vals []Value
+	for pos := 0; pos < len(data); {
+		v := Value{Type: data[pos]}
+		pos++
+		switch v.Type {
+		case TYPE_INT64:
+			if len(data)-pos < 8 {
+				panic(fmt.Errorf("int64 at %d cut short: %w", pos, ErrBadRecord))
+			}
+			v.I64 = int64(binary.BigEndian.Uint64(data[pos:]) ^ (1 << 63))
+			pos += 8
+		case TYPE_STRING, TYPE_BYTES:
+			v.Str = []byte{}
+			for {
+				if pos >= len(data) {
+					panic(fmt.Errorf("unterminated string: %w", ErrBadRecord))
+				}
+				c := data[pos]
+				pos++
+				if c == 0x00 {
+					break
+				}
+				if c == 0x01 {
+					if pos >= len(data) || data[pos] < 1 || data[pos] > 2 {
+						panic(fmt.Errorf("bad escape at %d: %w", pos, ErrBadRecord))
+					}
+					c = data[pos] - 1
+					pos++
+				}
+				v.Str = append(v.Str, c)
+			}
+		default:
+			panic(fmt.Errorf("bad value type %d at %d: %w", v.Type, pos-1, ErrBadRecord))
+		}
+		vals = append(vals, v)
+	}
+	return vals
+}
@@ -1,10 +1,24 @@
 package test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"project/btree"
+	"project/testutil"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
 func TestBtreeRead(t *testing.T) {
 	c := btree.NewC()
 	c.Add("1", "1")
@@ -29,3 +43,1397 @@ func TestReadMissingKey(t *testing.T) {
 		t.Errorf("read missing key and got value %s", val)
 	}
 }
+
+func TestInsertTooLarge(t *testing.T) {
+	c := btree.NewC()
+	c.Add("a", "1")
+	if err := c.Add(strings.Repeat("k", 2000), "v"); !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Errorf("Add with a 2000-byte key: %v", err)
+	}
+	if err := c.Add("b", strings.Repeat("v", 4000)); !errors.Is(err, btree.ErrValueTooLarge) {
+		t.Errorf("Add with a 4000-byte value: %v", err)
+	}
+	// the limits themselves are fine and nothing else was changed
+	if err := c.Add(strings.Repeat("k", btree.BTREE_MAX_KEY_SIZE), strings.Repeat("v", btree.BTREE_MAX_VALUE_SIZE)); err != nil {
+		t.Errorf("Add at the limits: %v", err)
+	}
+	if _, ok := c.Read("b"); ok {
+		t.Error("rejected key was inserted")
+	}
+	if val, ok := c.Read("a"); !ok || val != "1" {
+		t.Errorf("Read(a) = %q, %v", val, ok)
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	tree := &btree.BTree{
+		Get: func(ptr uint64) []byte {
+			page, ok := pages[ptr]
+			if !ok {
+				panic(fmt.Sprintf("missing page %d", ptr))
+			}
+			return page
+		},
+		New: func(node []byte) uint64 {
+			next++
+			pages[next] = node
+			return next
+		},
+		Del: func(ptr uint64) { delete(pages, ptr) },
+	}
+	for i := 0; i < 500; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok, err := tree.Read([]byte("key100")); !ok || err != nil {
+		t.Fatalf("Read before corruption = %v, %v", ok, err)
+	}
+
+	// scribble over every page but the root
+	for ptr, page := range pages {
+		if ptr != tree.Root() {
+			for i := range page {
+				page[i] = 0xff
+			}
+		}
+	}
+	if _, _, err := tree.Read([]byte("key100")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Read of a corrupted page: %v", err)
+	}
+	if _, err := tree.Has([]byte("key100")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Has on a corrupted page: %v", err)
+	}
+	if err := tree.Insert([]byte("key100"), []byte("new")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Insert into a corrupted page: %v", err)
+	}
+	if _, err := tree.Delete([]byte("key100")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Delete from a corrupted page: %v", err)
+	}
+
+	// a missing page
+	delete(pages, tree.Root())
+	if _, _, err := tree.Read([]byte("key100")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Read of a missing page: %v", err)
+	}
+}
+
+func TestAsymmetricNodeSizes(t *testing.T) {
+	c := btree.NewC()
+	c.Tree().LeafPageSize = 8192
+	c.Tree().InternalPageSize = 3072
+	ref := btree.NewC()
+
+	val := strings.Repeat("v", 500)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		c.Add(key, val)
+		ref.Add(key, val)
+	}
+	if c.PageCount() >= ref.PageCount() {
+		t.Errorf("larger leaves should use fewer pages: got %d, default %d", c.PageCount(), ref.PageCount())
+	}
+	for key, want := range c.Ref {
+		if got, ok := c.Read(key); !ok || got != want {
+			t.Fatalf("Read(%q) after splits: ok=%v", key, ok)
+		}
+	}
+
+	// delete most keys to force merges on both levels
+	for i := 0; i < 3000; i++ {
+		if i%8 != 0 {
+			c.Del(fmt.Sprintf("key%05d", i))
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		_, ok := c.Read(key)
+		if ok != (i%8 == 0) {
+			t.Fatalf("Read(%q) after merges: ok=%v", key, ok)
+		}
+	}
+
+	// a leaf must hold a max-sized KV and an internal node 3 keys
+	for _, sizes := range [][2]uint16{{1024, 0}, {0, 256}} {
+		bad := btree.NewC()
+		bad.Tree().LeafPageSize, bad.Tree().InternalPageSize = sizes[0], sizes[1]
+		if err := bad.Tree().Insert([]byte("k"), []byte("v")); err == nil {
+			t.Errorf("Insert with node sizes %v went through", sizes)
+		}
+		err := bad.Tree().BulkLoad(func(yield func(key, val []byte) bool) {
+			yield([]byte("k"), []byte("v"))
+		})
+		if err == nil {
+			t.Errorf("BulkLoad with node sizes %v went through", sizes)
+		}
+	}
+}
+
+func TestRangeBytes(t *testing.T) {
+	c := btree.NewC()
+	for i := 0; i < 2000; i++ {
+		c.Add(fmt.Sprintf("key%05d", i), strings.Repeat("v", 50+i%100))
+	}
+
+	ranges := [][2]string{
+		{"key00000", "key02000"},
+		{"key00100", "key00900"},
+		{"key01234", "key01240"},
+		{"key00500", ""},
+		{"", "key00050"},
+	}
+	for _, r := range ranges {
+		exact := uint64(0)
+		for key, val := range c.Ref {
+			if key >= r[0] && (r[1] == "" || key < r[1]) {
+				exact += uint64(len(key) + len(val))
+			}
+		}
+		got := c.Tree().RangeBytes([]byte(r[0]), []byte(r[1]))
+		// the estimate adds node overhead on top of the raw KVs
+		if got < exact || float64(got) > 1.25*float64(exact)+64 {
+			t.Errorf("RangeBytes(%q, %q) = %d, exact KV bytes %d", r[0], r[1], got, exact)
+		}
+	}
+
+	if got := c.Tree().RangeBytes([]byte("zzz"), nil); got != 0 {
+		t.Errorf("RangeBytes past the last key = %d, want 0", got)
+	}
+}
+
+func TestSeekNth(t *testing.T) {
+	c := btree.NewC()
+	if _, _, ok := c.Tree().SeekNth(0); ok {
+		t.Error("SeekNth on an empty tree")
+	}
+	for i := 0; i < 1500; i++ {
+		c.Add(fmt.Sprintf("key%05d", (i*7919)%1500), fmt.Sprintf("val%d", i))
+	}
+
+	keys := make([]string, 0, len(c.Ref))
+	for key := range c.Ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, n := range []int{0, 1, 99, 750, 1498, 1499} {
+		key, val, ok := c.Tree().SeekNth(uint64(n))
+		if !ok || string(key) != keys[n] || string(val) != c.Ref[keys[n]] {
+			t.Errorf("SeekNth(%d) = %q, %q, %v; want %q", n, key, val, ok, keys[n])
+		}
+	}
+	if _, _, ok := c.Tree().SeekNth(1500); ok {
+		t.Error("SeekNth past the last key")
+	}
+}
+
+func TestStressOverwrite(t *testing.T) {
+	for _, dist := range []testutil.Dist{testutil.Uniform, testutil.SharedPrefix} {
+		c := btree.NewC()
+		data := testutil.GenKeysDist(42, 2000, 16, 100, dist)
+		for _, kv := range data {
+			c.Add(string(kv.Key), string(kv.Val))
+		}
+		// overwrite half of the keys and delete a quarter
+		update := testutil.GenKeys(43, len(data), 16, 120)
+		for i, kv := range data {
+			switch i % 4 {
+			case 0, 1:
+				c.Add(string(kv.Key), string(update[i].Val))
+			case 2:
+				c.Del(string(kv.Key))
+			}
+		}
+		for _, kv := range data {
+			want, exists := c.Ref[string(kv.Key)]
+			got, ok := c.Read(string(kv.Key))
+			if ok != exists || got != want {
+				t.Fatalf("dist %d: Read(%q) = %q, %v; want %q, %v", dist, kv.Key, got, ok, want, exists)
+			}
+		}
+	}
+}
+
+// the keys of c.Ref in [start, end) in order, an empty end is unbounded
+func refRange(c *btree.C, start, end string) []string {
+	var keys []string
+	for key := range c.Ref {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	c := btree.NewC()
+	if c.Tree().Scan(nil, nil).Next() {
+		t.Error("Scan on an empty tree yielded a key")
+	}
+	for _, kv := range testutil.GenKeys(7, 3000, 8, 40) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+
+	ranges := [][2]string{{"", ""}, {"a", "b"}, {"m", ""}, {"0", "0"}, {"zzzzzzzzz", ""}}
+	keys := refRange(c, "", "")
+	ranges = append(ranges, [2]string{keys[100], keys[200]}, [2]string{keys[100] + "\x00", keys[200]})
+	for _, r := range ranges {
+		var got []string
+		for it := c.Tree().Scan([]byte(r[0]), []byte(r[1])); it.Next(); {
+			if string(it.Val()) != c.Ref[string(it.Key())] {
+				t.Fatalf("Scan(%q, %q): wrong value for %q", r[0], r[1], it.Key())
+			}
+			got = append(got, string(it.Key()))
+		}
+		if want := refRange(c, r[0], r[1]); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Scan(%q, %q) yielded %d keys, want %d", r[0], r[1], len(got), len(want))
+		}
+	}
+}
+
+func TestScanReverse(t *testing.T) {
+	c := btree.NewC()
+	if c.Tree().ScanReverse(nil, nil).Prev() {
+		t.Error("ScanReverse on an empty tree yielded a key")
+	}
+	for _, kv := range testutil.GenKeys(8, 3000, 8, 40) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+
+	keys := refRange(c, "", "")
+	ranges := [][2]string{{"", ""}, {"a", "b"}, {"", "m"}, {keys[100], keys[200]}, {keys[100], keys[200] + "\x00"}}
+	for _, r := range ranges {
+		var got []string
+		for it := c.Tree().ScanReverse([]byte(r[0]), []byte(r[1])); it.Prev(); {
+			if string(it.Val()) != c.Ref[string(it.Key())] {
+				t.Fatalf("ScanReverse(%q, %q): wrong value for %q", r[0], r[1], it.Key())
+			}
+			got = append(got, string(it.Key()))
+		}
+		// the end is inclusive
+		var want []string
+		for i := len(keys) - 1; i >= 0; i-- {
+			if keys[i] >= r[0] && (r[1] == "" || keys[i] <= r[1]) {
+				want = append(want, keys[i])
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("ScanReverse(%q, %q) yielded %d keys, want %d", r[0], r[1], len(got), len(want))
+		}
+	}
+}
+
+// ScanReverse(nil, key) starts at nodeLookupLE(leaf, key) after descending
+// with nodeLookupLE, so its first key is the largest key <= the given one.
+func TestNodeLookupLE(t *testing.T) {
+	for _, leafSize := range []uint16{btree.BTREE_MAX_PAGE_SIZE, 0} {
+		c := btree.NewC()
+		c.Tree().LeafPageSize = leafSize
+		var keys []string
+		for i := 0; i < 400; i += 2 {
+			keys = append(keys, fmt.Sprintf("k%03d", i))
+			c.Add(keys[len(keys)-1], strings.Repeat("v", 40))
+		}
+		if single := c.PageCount() == 1; single != (leafSize != 0) {
+			t.Fatalf("leaf size %d: %d pages", leafSize, c.PageCount())
+		}
+		// every key, every gap key, and keys before and after all of them
+		probes := []string{"a", "k", "z", "k398\x00"}
+		for i := 0; i < 400; i++ {
+			probes = append(probes, fmt.Sprintf("k%03d", i), fmt.Sprintf("k%03d\x00", i))
+		}
+		for _, probe := range probes {
+			want := ""
+			for _, key := range keys { // linear reference
+				if key <= probe {
+					want = key
+				}
+			}
+			got := ""
+			if it := c.Tree().ScanReverse(nil, []byte(probe)); it.Prev() {
+				got = string(it.Key())
+			}
+			if got != want {
+				t.Fatalf("leaf size %d: largest key <= %q is %q, want %q", leafSize, probe, got, want)
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	data := testutil.GenKeys(11, 20000, 12, 60)
+	sort.Slice(data, func(i, j int) bool { return string(data[i].Key) < string(data[j].Key) })
+	pairs := func(yield func(key, val []byte) bool) {
+		for _, kv := range data {
+			if !yield(kv.Key, kv.Val) {
+				return
+			}
+		}
+	}
+
+	c, ref := btree.NewC(), btree.NewC()
+	if err := c.Tree().BulkLoad(pairs); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range data {
+		ref.Add(string(kv.Key), string(kv.Val))
+		c.Ref[string(kv.Key)] = string(kv.Val)
+	}
+	if c.Tree().Count() != uint64(len(data)) {
+		t.Errorf("Count() = %d, want %d", c.Tree().Count(), len(data))
+	}
+	if c.PageCount() >= ref.PageCount() {
+		t.Errorf("bulk load used %d pages, repeated inserts %d", c.PageCount(), ref.PageCount())
+	}
+	if got, want := refRange(c, "", ""), refRange(ref, "", ""); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("scan after bulk load: %d keys, want %d", len(got), len(want))
+	}
+	for _, kv := range data[:1000] {
+		if val, ok := c.Read(string(kv.Key)); !ok || val != string(kv.Val) {
+			t.Fatalf("Read(%q) = %q, %v", kv.Key, val, ok)
+		}
+	}
+	// the tree is a regular one afterwards
+	for _, kv := range data[:5000] {
+		c.Del(string(kv.Key))
+	}
+	c.Add("0", "first")
+	if val, ok := c.Read("0"); !ok || val != "first" {
+		t.Errorf("Read after updates = %q, %v", val, ok)
+	}
+
+	if err := c.Tree().BulkLoad(pairs); !errors.Is(err, btree.ErrNotEmpty) {
+		t.Errorf("BulkLoad into a non-empty tree: %v", err)
+	}
+	unsorted := btree.NewC()
+	err := unsorted.Tree().BulkLoad(func(yield func(key, val []byte) bool) {
+		for _, kv := range data[:3000] {
+			yield(kv.Key, kv.Val)
+		}
+		yield(data[0].Key, nil)
+	})
+	if !errors.Is(err, btree.ErrUnsorted) {
+		t.Errorf("BulkLoad of unsorted keys: %v", err)
+	}
+	if unsorted.PageCount() != 0 || unsorted.Tree().Root() != 0 {
+		t.Errorf("failed bulk load left %d pages", unsorted.PageCount())
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	data := testutil.GenKeys(12, 100000, 16, 50)
+	sort.Slice(data, func(i, j int) bool { return string(data[i].Key) < string(data[j].Key) })
+	b.Run("Insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := btree.NewC()
+			for _, kv := range data {
+				c.Tree().Insert(kv.Key, kv.Val)
+			}
+			b.ReportMetric(float64(c.PageCount()), "pages")
+		}
+	})
+	b.Run("BulkLoad", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := btree.NewC()
+			c.Tree().BulkLoad(func(yield func(key, val []byte) bool) {
+				for _, kv := range data {
+					if !yield(kv.Key, kv.Val) {
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(c.PageCount()), "pages")
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	c := btree.NewC()
+	if stats, err := c.Tree().Stats(); stats.Height != 0 || err != nil {
+		t.Errorf("Stats of an empty tree = %+v, %v", stats, err)
+	}
+	data := testutil.GenKeys(21, 100000, 16, 10)
+	prev, inserted := 0, 0
+	for n := 10; n <= len(data); n *= 10 {
+		for _, kv := range data[inserted:n] {
+			c.Tree().Insert(kv.Key, kv.Val)
+		}
+		inserted = n
+		stats, err := c.Tree().Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalKeys != n || stats.InternalNodes+stats.LeafNodes != c.PageCount() {
+			t.Errorf("%d keys: %+v, %d pages", n, stats, c.PageCount())
+		}
+		if stats.AvgFillPercent <= 0 || stats.AvgFillPercent > 100 {
+			t.Errorf("%d keys: fill %.1f%%", n, stats.AvgFillPercent)
+		}
+		// 10x the keys adds at most one level
+		if stats.Height < prev || stats.Height > prev+1 {
+			t.Errorf("%d keys: height %d after %d", n, stats.Height, prev)
+		}
+		prev = stats.Height
+	}
+	if prev > 4 {
+		t.Errorf("height %d for %d keys", prev, len(data))
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	c := btree.NewC()
+	for _, kv := range testutil.GenKeys(22, 20000, 12, 40) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+	keys := refRange(c, "", "")
+	check := func(what string) {
+		t.Helper()
+		var got []string
+		for it := c.Tree().Scan(nil, nil); it.Next(); {
+			if string(it.Val()) != c.Ref[string(it.Key())] {
+				t.Fatalf("%s: wrong value for %q", what, it.Key())
+			}
+			got = append(got, string(it.Key()))
+		}
+		if want := refRange(c, "", ""); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: %d keys left, want %d", what, len(got), len(want))
+		}
+		if err := c.Tree().Verify(); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		stats, err := c.Tree().Stats()
+		if err != nil || stats.InternalNodes+stats.LeafNodes != c.PageCount() || c.Tree().Count() != uint64(len(got)) {
+			t.Fatalf("%s: %+v, %v, %d pages, count %d", what, stats, err, c.PageCount(), c.Tree().Count())
+		}
+	}
+
+	ranges := [][2]string{
+		{keys[5000], keys[15000]},       // many subtrees in the middle
+		{keys[100], keys[103]},          // a few keys in a leaf
+		{keys[200] + "\x00", keys[201]}, // nothing
+		{keys[19000], ""},               // to the end
+	}
+	for _, r := range ranges {
+		want := refRange(c, r[0], r[1])
+		n, err := c.Tree().DeleteRange([]byte(r[0]), []byte(r[1]))
+		if err != nil || n != len(want) {
+			t.Fatalf("DeleteRange(%q, %q) = %d, %v, want %d", r[0], r[1], n, err, len(want))
+		}
+		for _, key := range want {
+			delete(c.Ref, key)
+		}
+		check(fmt.Sprintf("DeleteRange(%q, %q)", r[0], r[1]))
+	}
+	// the keys around the range are still there
+	for _, key := range []string{keys[4999], keys[15000], keys[18999]} {
+		if _, ok := c.Read(key); !ok {
+			t.Errorf("%q is gone", key)
+		}
+	}
+
+	// the whole tree, only the root leaf is left
+	n, err := c.Tree().DeleteRange(nil, nil)
+	if err != nil || n != len(c.Ref) {
+		t.Fatalf("DeleteRange(nil, nil) = %d, %v, want %d", n, err, len(c.Ref))
+	}
+	c.Ref = map[string]string{}
+	check("DeleteRange(nil, nil)")
+	if c.PageCount() != 0 || c.Tree().Root() != 0 {
+		t.Errorf("%d pages left in an empty tree, root %d", c.PageCount(), c.Tree().Root())
+	}
+	c.Add("a", "1")
+	check("Add after DeleteRange")
+}
+
+func TestCompare(t *testing.T) {
+	c := btree.NewC()
+	// decimal numbers without leading zeros: shorter is smaller
+	c.Tree().Compare = func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}
+	for i := 1; i <= 3000; i++ {
+		c.Add(fmt.Sprint(i), "v")
+	}
+	for _, key := range []string{"2", "10", "999", "3000"} {
+		if _, ok := c.Read(key); !ok {
+			t.Errorf("Read(%q) not found", key)
+		}
+	}
+	var got []string
+	for it := c.Tree().Scan([]byte("2"), []byte("11")); it.Next(); {
+		got = append(got, string(it.Key()))
+	}
+	if want := "2,3,4,5,6,7,8,9,10"; strings.Join(got, ",") != want {
+		t.Errorf("Scan(2, 11) = %v, want %v", got, want)
+	}
+	if n, _ := c.Tree().DeleteRange([]byte("10"), []byte("100")); n != 90 {
+		t.Errorf("DeleteRange(10, 100) removed %d keys", n)
+	}
+	if _, ok := c.Read("9"); !ok {
+		t.Error("9 was deleted")
+	}
+}
+
+func TestDeleteFound(t *testing.T) {
+	c := btree.NewC()
+	c.Add("k", "v")
+	if ok, err := c.Tree().Delete([]byte("k")); !ok || err != nil {
+		t.Errorf("Delete(last key) = %v, %v", ok, err)
+	}
+	if ok, err := c.Tree().Delete([]byte("k")); ok || err != nil {
+		t.Errorf("Delete(last key) again = %v, %v", ok, err)
+	}
+	if _, ok, _ := c.Tree().Read([]byte("k")); ok || c.Tree().Count() != 0 {
+		t.Errorf("the emptied tree still has %d keys", c.Tree().Count())
+	}
+	if err := c.Tree().Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// every key of a deeper tree is deleted exactly once
+	for i := range 2000 {
+		c.Add(fmt.Sprintf("key%04d", i), strings.Repeat("v", 50))
+	}
+	for _, i := range rand.New(rand.NewSource(28)).Perm(2000) {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if ok, err := c.Tree().Delete(key); !ok || err != nil {
+			t.Fatalf("Delete(%s) = %v, %v", key, ok, err)
+		}
+		if ok, err := c.Tree().Delete(key); ok || err != nil {
+			t.Fatalf("Delete(%s) again = %v, %v", key, ok, err)
+		}
+	}
+	if stats, err := c.Tree().Stats(); err != nil || stats.TotalKeys != 0 || stats.Height != 0 {
+		t.Errorf("Stats of the emptied tree = %+v, %v", stats, err)
+	}
+	c.Add("k", "v")
+	if val, ok := c.Read("k"); !ok || val != "v" {
+		t.Errorf("Read after emptying = %q, %v", val, ok)
+	}
+}
+
+func TestDeleteLastKeyResetsRoot(t *testing.T) {
+	c := btree.NewC()
+	c.Add("k", "v")
+	c.Del("k")
+	if c.Tree().Count() != 0 || c.Tree().Root() != 0 || c.PageCount() != 0 {
+		t.Errorf("%d keys, root %d and %d pages after deleting the only key", c.Tree().Count(), c.Tree().Root(), c.PageCount())
+	}
+	if _, ok := c.Read("k"); ok {
+		t.Error("the deleted key is still there")
+	}
+
+	// the last 2 leaves are merged into one with only the dummy key
+	for i := range 200 {
+		c.Add(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	for key := range c.Ref {
+		c.Del(key)
+	}
+	if c.Tree().Root() != 0 || c.PageCount() != 0 {
+		t.Errorf("root %d and %d pages after deleting every key", c.Tree().Root(), c.PageCount())
+	}
+	c.Add("k", "v")
+	if val, ok := c.Read("k"); !ok || val != "v" {
+		t.Errorf("Read after emptying = %q, %v", val, ok)
+	}
+}
+
+func TestIterErr(t *testing.T) {
+	c := btree.NewC()
+	for i := range 1000 {
+		c.Add(fmt.Sprintf("key%04d", i), strings.Repeat("v", 50))
+	}
+	errRead := errors.New("injected read error")
+	get, fail := c.Tree().Get, false
+	c.Tree().Get = func(ptr uint64) []byte {
+		if fail {
+			panic(fmt.Errorf("page %d: %w", ptr, errRead))
+		}
+		return get(ptr)
+	}
+
+	it := c.Tree().Scan(nil, nil)
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 1000 || it.Err() != nil {
+		t.Errorf("clean scan: %d keys, %v", n, it.Err())
+	}
+
+	// the first leaf is read by Scan, the next one fails
+	it, n = c.Tree().Scan(nil, nil), 0
+	fail = true
+	for it.Next() {
+		n++
+	}
+	if n == 0 || n == 1000 || !errors.Is(it.Err(), errRead) || !errors.Is(it.Err(), btree.ErrCorrupt) {
+		t.Errorf("failed scan: %d keys, %v", n, it.Err())
+	}
+	if it.Next() || it.Seek([]byte("key0000")) {
+		t.Error("the cursor moved after an error")
+	}
+
+	fail = false
+	it, n = c.Tree().ScanReverse(nil, nil), 0
+	fail = true
+	for it.Prev() {
+		n++
+	}
+	if n == 0 || n == 1000 || !errors.Is(it.Err(), errRead) {
+		t.Errorf("failed reverse scan: %d keys, %v", n, it.Err())
+	}
+
+	// the descent of Scan itself fails
+	if it = c.Tree().Scan(nil, nil); it.Next() || !errors.Is(it.Err(), errRead) {
+		t.Errorf("scan failing on the root: %v", it.Err())
+	}
+}
+
+func TestIterSeek(t *testing.T) {
+	c := btree.NewC()
+	if c.Tree().Scan(nil, nil).Seek([]byte("a")) {
+		t.Error("Seek on an empty tree found a key")
+	}
+	for _, kv := range testutil.GenKeys(23, 5000, 8, 40) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+	keys := refRange(c, "", "")
+	end := keys[4000]
+	it := c.Tree().Scan(nil, []byte(end))
+	for it.Next() { // exhaust it first, Seek must recover from there
+	}
+	rng := rand.New(rand.NewSource(23))
+	probes := []string{"", "0", keys[0], keys[3999], end, "zzzzzzzzz", keys[10] + "\x00"}
+	for i := 0; i < 2000; i++ {
+		probes = append(probes, keys[rng.Intn(len(keys))], keys[rng.Intn(len(keys))]+"\x00")
+	}
+	for _, probe := range probes {
+		idx := sort.SearchStrings(keys, probe)
+		want := idx < len(keys) && keys[idx] < end
+		if got := it.Seek([]byte(probe)); got != want {
+			t.Fatalf("Seek(%q) = %v, want %v", probe, got, want)
+		}
+		if !want {
+			continue
+		}
+		if string(it.Key()) != keys[idx] || string(it.Val()) != c.Ref[keys[idx]] {
+			t.Fatalf("Seek(%q) is on %q, want %q", probe, it.Key(), keys[idx])
+		}
+		// Next continues from there
+		if ok := it.Next(); ok != (keys[idx+1] < end) || ok && string(it.Key()) != keys[idx+1] {
+			t.Fatalf("Next after Seek(%q) = %v on %q, want %q", probe, ok, it.Key(), keys[idx+1])
+		}
+	}
+}
+
+func BenchmarkIterSeek(b *testing.B) {
+	c := btree.NewC()
+	data := testutil.GenKeys(24, 100000, 16, 10)
+	for _, kv := range data {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+	keys := refRange(c, "", "")
+	b.Run("Seek", func(b *testing.B) {
+		it := c.Tree().Scan(nil, nil)
+		for i := 0; i < b.N; i++ {
+			it.Seek([]byte(keys[i%len(keys)]))
+		}
+	})
+	b.Run("Scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.Tree().Scan([]byte(keys[i%len(keys)]), nil).Next()
+		}
+	})
+}
+
+func TestIterClose(t *testing.T) {
+	a, b := btree.NewC(), btree.NewC()
+	for i := range 500 {
+		a.Add(fmt.Sprintf("a%04d", i), "1")
+		b.Add(fmt.Sprintf("b%04d", i), "2")
+	}
+	for range 10 {
+		it := a.Tree().ScanReverse(nil, nil)
+		it.Prev()
+		it.Close()
+
+		// a reused cursor starts over
+		n := 0
+		it = b.Tree().Scan([]byte("b0100"), []byte("b0200"))
+		for it.Next() {
+			if want := fmt.Sprintf("b%04d", 100+n); string(it.Key()) != want || string(it.Val()) != "2" {
+				t.Fatalf("Scan = %q, want %q", it.Key(), want)
+			}
+			n++
+		}
+		if n != 100 || it.Err() != nil {
+			t.Fatalf("Scan: %d keys, %v", n, it.Err())
+		}
+		it.Close()
+	}
+}
+
+func BenchmarkScanShort(b *testing.B) {
+	c := btree.NewC()
+	for _, kv := range testutil.GenKeys(24, 100000, 16, 10) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+	keys := refRange(c, "", "")
+	starts := make([][]byte, len(keys))
+	for i, key := range keys {
+		starts[i] = []byte(key)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := c.Tree().Scan(starts[i%len(starts)], nil)
+		for j := 0; j < 10 && it.Next(); j++ {
+		}
+		it.Close()
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	rng := rand.New(rand.NewSource(25))
+	var keys []string
+	for _, i := range rng.Perm(20000) {
+		keys = append(keys, fmt.Sprintf("user:%010d", i))
+	}
+	leaves := map[bool]int{}
+	for _, compress := range []bool{false, true} {
+		c := btree.NewC()
+		c.Tree().PrefixCompression = compress
+		for i, key := range keys {
+			val := "v"
+			if i%1000 == 0 { // now and then a value that forces a 3-way split
+				val = strings.Repeat("v", btree.BTREE_MAX_VALUE_SIZE)
+			}
+			if err := c.Add(key, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range keys[:10000] {
+			if i := rng.Intn(3); i == 0 {
+				c.Del(key)
+			} else if i == 1 {
+				c.Add(key, "updated")
+			}
+		}
+		sorted := refRange(c, "", "")
+		n, _ := c.Tree().DeleteRange([]byte(sorted[100]), []byte(sorted[200]))
+		for _, key := range sorted[100:200] {
+			delete(c.Ref, key)
+		}
+		if n != 100 {
+			t.Errorf("compress %v: DeleteRange removed %d keys", compress, n)
+		}
+
+		for key, val := range c.Ref {
+			if got, ok := c.Read(key); !ok || got != val {
+				t.Fatalf("compress %v: Read(%q) = %q, %v", compress, key, got, ok)
+			}
+		}
+		for _, key := range []string{"a", "user:", "user:00000000001", "user:1", "z"} {
+			if _, ok := c.Read(key); ok {
+				t.Errorf("compress %v: Read(%q) found a missing key", compress, key)
+			}
+		}
+		var got []string
+		for it := c.Tree().Scan(nil, nil); it.Next(); {
+			got = append(got, string(it.Key()))
+		}
+		if want := refRange(c, "", ""); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("compress %v: Scan yielded %d keys, want %d", compress, len(got), len(want))
+		}
+		if err := c.Tree().Verify(); err != nil {
+			t.Fatalf("compress %v: %v", compress, err)
+		}
+		stats, err := c.Tree().Stats()
+		if err != nil || stats.InternalNodes+stats.LeafNodes != c.PageCount() {
+			t.Fatalf("compress %v: %+v, %v, %d pages", compress, stats, err, c.PageCount())
+		}
+		leaves[compress] = stats.LeafNodes
+	}
+	t.Logf("leaves: %d plain, %d compressed", leaves[false], leaves[true])
+	if leaves[true] >= leaves[false]*3/4 {
+		t.Errorf("compression saved little: %d leaves, %d without", leaves[true], leaves[false])
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	c := btree.NewC()
+	if _, _, ok := c.Tree().First(); ok {
+		t.Error("First on an empty tree")
+	}
+	if _, _, ok := c.Tree().Last(); ok {
+		t.Error("Last on an empty tree")
+	}
+	check := func(first, last string) {
+		t.Helper()
+		if key, val, ok := c.Tree().First(); !ok || string(key) != first || string(val) != c.Ref[first] {
+			t.Errorf("First = %q, %q, %v, want %q", key, val, ok, first)
+		}
+		if key, val, ok := c.Tree().Last(); !ok || string(key) != last || string(val) != c.Ref[last] {
+			t.Errorf("Last = %q, %q, %v, want %q", key, val, ok, last)
+		}
+	}
+	c.Add("m", "1")
+	check("m", "m")
+	for _, kv := range testutil.GenKeys(26, 10000, 8, 40) {
+		c.Add(string(kv.Key), string(kv.Val))
+	}
+	keys := refRange(c, "", "")
+	check(keys[0], keys[len(keys)-1])
+	// without the smallest keys the first leaf may hold only the dummy key
+	c.Tree().DeleteRange(nil, []byte(keys[5000]))
+	for _, key := range keys[:5000] {
+		delete(c.Ref, key)
+	}
+	check(keys[5000], keys[len(keys)-1])
+}
+
+func TestCompactRange(t *testing.T) {
+	c := btree.NewC()
+	c.Tree().LazyMerge = true // the deletes leave sparse leaves behind
+	for i := 0; i < 5000; i++ {
+		c.Add(fmt.Sprintf("key%05d", i), strings.Repeat("v", 30))
+	}
+	for i := 0; i < 5000; i++ {
+		if i%4 != 0 {
+			c.Del(fmt.Sprintf("key%05d", i))
+		}
+	}
+	// the leaves by page number, with their first and last keys
+	leaves := func() map[uint64][2]string {
+		out := map[uint64][2]string{}
+		err := c.Tree().Pages(func(ptr uint64) {
+			sub := btree.BTree{Get: c.Tree().Get}
+			sub.SetRoot(ptr)
+			if stats, _ := sub.Stats(); stats.Height == 1 {
+				first, _, _ := sub.First()
+				last, _, _ := sub.Last()
+				out[ptr] = [2]string{string(first), string(last)}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	start, end := "key01000", "key04000"
+	inside := func(leaves map[uint64][2]string) (n int) {
+		for _, keys := range leaves {
+			if keys[0] >= start && keys[1] < end {
+				n++
+			}
+		}
+		return n
+	}
+	before := leaves()
+
+	if err := c.Tree().CompactRange([]byte(start), []byte(end)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Tree().Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range c.Ref {
+		if got, ok := c.Read(key); !ok || got != val {
+			t.Fatalf("Read(%s) = %q, %v", key, got, ok)
+		}
+	}
+	if stats, _ := c.Tree().Stats(); stats.TotalKeys != len(c.Ref) || stats.InternalNodes+stats.LeafNodes != c.PageCount() {
+		t.Errorf("Stats = %+v for %d keys in %d pages", stats, len(c.Ref), c.PageCount())
+	}
+	after := leaves()
+	// the 750 keys left in the range fill about a quarter as many leaves
+	if n, m := inside(before), inside(after); m > n/3 {
+		t.Errorf("%d leaves in the range, %d before", m, n)
+	}
+	for ptr, keys := range before {
+		if (keys[1] < start || keys[0] >= end) && after[ptr] != keys {
+			t.Errorf("leaf %d %q outside the range was rewritten", ptr, keys)
+		}
+	}
+
+	// packed already, then the whole tree
+	pages := c.PageCount()
+	if err := c.Tree().CompactRange([]byte(start), []byte(end)); err != nil || c.PageCount() != pages {
+		t.Errorf("CompactRange again: %v, %d pages, %d before", err, c.PageCount(), pages)
+	}
+	if err := c.Tree().CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Tree().Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := c.Tree().Stats(); stats.AvgFillPercent < 70 || stats.TotalKeys != len(c.Ref) {
+		t.Errorf("Stats after packing everything = %+v", stats)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	tree := &btree.BTree{
+		Get: func(ptr uint64) []byte { return pages[ptr] },
+		New: func(node []byte) uint64 {
+			next++
+			pages[next] = node
+			return next
+		},
+		Del: func(ptr uint64) { delete(pages, ptr) },
+	}
+	if err := tree.Verify(); err != nil {
+		t.Errorf("Verify of an empty tree: %v", err)
+	}
+	rng := rand.New(rand.NewSource(27))
+	for _, i := range rng.Perm(3000) {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte("val"))
+	}
+	for _, i := range rng.Perm(3000)[:1000] {
+		tree.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	tree.DeleteRange([]byte("key1000"), []byte("key1500"))
+	if err := tree.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// break the order in each leaf in turn, the error names the page
+	// or its parent when the key is the first one
+	for ptr, page := range pages {
+		if binary.LittleEndian.Uint16(page) != btree.BNODE_LEAF || ptr == tree.Root() {
+			continue // not a leaf
+		}
+		idx := bytes.LastIndex(page, []byte("key"))
+		saved := append([]byte(nil), page[idx:idx+7]...)
+		copy(page[idx:], "key0000")
+		err := tree.Verify()
+		if !errors.Is(err, btree.ErrCorrupt) || !strings.Contains(err.Error(), "page ") {
+			t.Fatalf("Verify with a bad key in page %d: %v", ptr, err)
+		}
+		// the path to the key goes through the page
+		if err := tree.VerifyPath(saved); !errors.Is(err, btree.ErrCorrupt) {
+			t.Fatalf("VerifyPath(%s) with a bad key in page %d: %v", saved, ptr, err)
+		}
+		copy(page[idx:], saved)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatalf("Verify after restoring: %v", err)
+	}
+	for i := 0; i < 3000; i += 100 {
+		if err := tree.VerifyPath([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatalf("VerifyPath(key%04d): %v", i, err)
+		}
+	}
+}
+
+func TestLazyMerge(t *testing.T) {
+	eager, lazy := btree.NewC(), btree.NewC()
+	lazy.Tree().LazyMerge = true
+	rng := rand.New(rand.NewSource(26))
+	for _, c := range []*btree.C{eager, lazy} {
+		for i := 0; i < 5000; i++ {
+			c.Add(fmt.Sprintf("key%05d", i), strings.Repeat("v", 20))
+		}
+	}
+	for _, i := range rng.Perm(5000)[:4500] {
+		for _, c := range []*btree.C{eager, lazy} {
+			c.Del(fmt.Sprintf("key%05d", i))
+		}
+	}
+	for _, c := range []*btree.C{eager, lazy} {
+		if err := c.Tree().Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range c.Ref {
+			if got, ok := c.Read(key); !ok || got != val {
+				t.Fatalf("Read(%s) = %q, %v", key, got, ok)
+			}
+		}
+	}
+	eagerStats, _ := eager.Tree().Stats()
+	lazyStats, _ := lazy.Tree().Stats()
+	if lazyStats.LeafNodes <= eagerStats.LeafNodes {
+		t.Errorf("%d leaves with lazy merging, %d without", lazyStats.LeafNodes, eagerStats.LeafNodes)
+	}
+
+	// emptied nodes are still removed
+	for key := range lazy.Ref {
+		lazy.Del(key)
+	}
+	if stats, _ := lazy.Tree().Stats(); stats.LeafNodes != 0 || stats.TotalKeys != 0 {
+		t.Errorf("Stats of the emptied tree = %+v", stats)
+	}
+}
+
+func TestMergeThreshold(t *testing.T) {
+	merges := func(threshold float64) (uint64, btree.TreeStats) {
+		c := btree.NewC()
+		var m btree.Metrics
+		c.Tree().Metrics, c.Tree().MergeThreshold = &m, threshold
+		for i := 0; i < 5000; i++ {
+			c.Add(fmt.Sprintf("key%05d", i), strings.Repeat("v", 20))
+		}
+		for _, i := range rand.New(rand.NewSource(27)).Perm(5000)[:4500] {
+			c.Del(fmt.Sprintf("key%05d", i))
+		}
+		if err := c.Tree().Verify(); err != nil {
+			t.Fatal(err)
+		}
+		stats, _ := c.Tree().Stats()
+		return m.Merges.Load(), stats
+	}
+	defaults, defaultStats := merges(0)
+	quarter, _ := merges(0.25)
+	few, fewStats := merges(0.001)
+	dense, denseStats := merges(0.5)
+	if quarter != defaults {
+		t.Errorf("%d merges at 0.25, %d by default", quarter, defaults)
+	}
+	if few*10 > defaults || fewStats.LeafNodes <= defaultStats.LeafNodes {
+		t.Errorf("%d merges and %d leaves near 0, %d and %d by default", few, fewStats.LeafNodes, defaults, defaultStats.LeafNodes)
+	}
+	if dense <= defaults || denseStats.LeafNodes > defaultStats.LeafNodes {
+		t.Errorf("%d merges and %d leaves at 0.5, %d and %d by default", dense, denseStats.LeafNodes, defaults, defaultStats.LeafNodes)
+	}
+
+	c := btree.NewC()
+	c.Add("a", "1")
+	for _, threshold := range []float64{0.6, -0.1} {
+		c.Tree().MergeThreshold = threshold
+		if _, err := c.Tree().Delete([]byte("a")); err == nil {
+			t.Errorf("Delete with a threshold of %v: no error", threshold)
+		}
+		if _, err := c.Tree().DeleteRange(nil, nil); err == nil {
+			t.Errorf("DeleteRange with a threshold of %v: no error", threshold)
+		}
+	}
+	if c.Tree().Count() != 1 {
+		t.Errorf("Count after the failed deletes = %d", c.Tree().Count())
+	}
+}
+
+func BenchmarkLazyMerge(b *testing.B) {
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("LazyMerge=%v", lazy), func(b *testing.B) {
+			c := btree.NewC()
+			c.Tree().LazyMerge = lazy
+			for i := 0; i < 20000; i++ {
+				c.Tree().Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("val"))
+			}
+			b.ResetTimer()
+			// delete a run of keys, then insert them back
+			for i := 0; i < b.N; i++ {
+				base := i * 97 % 19900
+				for j := 0; j < 100; j++ {
+					c.Tree().Delete([]byte(fmt.Sprintf("key%06d", base+j)))
+				}
+				for j := 0; j < 100; j++ {
+					c.Tree().Insert([]byte(fmt.Sprintf("key%06d", base+j)), []byte("val"))
+				}
+			}
+		})
+	}
+}
+
+func TestCDeterministic(t *testing.T) {
+	build := func() *btree.C {
+		c := btree.NewC()
+		for _, kv := range testutil.GenKeys(27, 2000, 8, 20) {
+			c.Add(string(kv.Key), string(kv.Val))
+		}
+		return c
+	}
+	a, b := build(), build()
+	if a.Tree().Root() != b.Tree().Root() || a.PageCount() != b.PageCount() {
+		t.Errorf("root %d with %d pages, then %d with %d", a.Tree().Root(), a.PageCount(), b.Tree().Root(), b.PageCount())
+	}
+
+	// freed page numbers are reused
+	for round := 0; round < 5; round++ {
+		for key := range a.Ref {
+			a.Del(key)
+		}
+		for _, kv := range testutil.GenKeys(27, 2000, 8, 20) {
+			a.Add(string(kv.Key), string(kv.Val))
+		}
+	}
+	if root := a.Tree().Root(); root > 10*uint64(a.PageCount()) {
+		t.Errorf("root page %d with %d pages", root, a.PageCount())
+	}
+}
+
+func TestBtreeDump(t *testing.T) {
+	c := btree.NewC()
+	for i := range 40 {
+		c.Add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)+strings.Repeat(".", 93))
+	}
+	c.Add("bin\x00\xff", "\x01")
+	var out bytes.Buffer
+	if err := c.Tree().Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "dump.golden")
+	if *update {
+		if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Dump:\n%s\nwant:\n%s", out.Bytes(), want)
+	}
+
+	out.Reset()
+	if err := btree.NewC().Tree().Dump(&out); err != nil || out.String() != "empty\n" {
+		t.Errorf("Dump of an empty tree = %q, %v", out.String(), err)
+	}
+}
+
+// the plain leaf layout, see BNode
+func encodeLeaf(keys, vals [][]byte) []byte {
+	n := len(keys)
+	node := binary.LittleEndian.AppendUint16(nil, btree.BNODE_LEAF)
+	node = binary.LittleEndian.AppendUint16(node, uint16(n))
+	node = append(node, make([]byte, 8*n)...)
+	offset := 0
+	for i := range keys {
+		offset += 4 + len(keys[i]) + len(vals[i])
+		node = binary.LittleEndian.AppendUint16(node, uint16(offset))
+	}
+	for i := range keys {
+		node = binary.LittleEndian.AppendUint16(node, uint16(len(keys[i])))
+		node = binary.LittleEndian.AppendUint16(node, uint16(len(vals[i])))
+		node = append(append(node, keys[i]...), vals[i]...)
+	}
+	return node
+}
+
+func decodeLeaf(node []byte) (keys, vals [][]byte) {
+	n := int(binary.LittleEndian.Uint16(node[2:]))
+	pos := btree.HEADER + 10*n
+	for i := 0; i < n; i++ {
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		keys = append(keys, node[pos+4:][:klen])
+		vals = append(vals, node[pos+4+klen:][:vlen])
+		pos += 4 + klen + vlen
+	}
+	return keys, vals
+}
+
+func TestOverwriteLeaf(t *testing.T) {
+	pages := map[uint64][]byte{}
+	next := uint64(0)
+	var created []uint64
+	tree := &btree.BTree{
+		Get: func(ptr uint64) []byte { return pages[ptr] },
+		New: func(node []byte) uint64 {
+			next++
+			pages[next] = node
+			created = append(created, next)
+			return next
+		},
+		Del: func(ptr uint64) { delete(pages, ptr) },
+	}
+	ref := map[string]string{}
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("%04d%s", i, strings.Repeat("k", rng.Intn(996)))
+		ref[key] = strings.Repeat("v", rng.Intn(100))
+		tree.Insert([]byte(key), []byte(ref[key]))
+	}
+	checked := 0
+	for key := range ref {
+		ref[key] = strings.Repeat("w", rng.Intn(100))
+		created = created[:0]
+		if err := tree.Insert([]byte(key), []byte(ref[key])); err != nil {
+			t.Fatal(err)
+		}
+		var leaves [][]byte
+		for _, ptr := range created {
+			if binary.LittleEndian.Uint16(pages[ptr]) == btree.BNODE_LEAF {
+				leaves = append(leaves, pages[ptr])
+			}
+		}
+		if len(leaves) != 1 {
+			continue // split
+		}
+		// the leaf is the same as one built from scratch
+		keys, vals := decodeLeaf(leaves[0])
+		for i := range keys {
+			if want, ok := ref[string(keys[i])]; ok && string(vals[i]) != want {
+				t.Fatalf("%.8q = %.8q, want %.8q", keys[i], vals[i], want)
+			}
+		}
+		if want := encodeLeaf(keys, vals); !bytes.Equal(leaves[0][:len(want)], want) {
+			t.Fatalf("overwriting %.8q: leaf differs", key)
+		}
+		checked++
+	}
+	if checked < 200 {
+		t.Errorf("only %d overwrites checked", checked)
+	}
+}
+
+func BenchmarkOverwriteLongKey(b *testing.B) {
+	c := btree.NewC()
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%03d%s", i, strings.Repeat("k", 997))
+		c.Add(keys[i], "val")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Tree().Insert([]byte(keys[i%len(keys)]), []byte("val"))
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	c := btree.NewC()
+	if stats, err := c.Tree().SizeHistogram(nil); err != nil || stats.Keys.N != 0 || stats.Values.Max != 0 {
+		t.Errorf("empty tree: %+v, %v", stats, err)
+	}
+	for i := 0; i < 1000; i++ {
+		val := strings.Repeat("v", 10)
+		if i%10 == 0 {
+			val = strings.Repeat("v", 2000)
+		}
+		c.Add(fmt.Sprintf("key%04d", i), val)
+	}
+	c.Add("k", "") // empty values count
+	stats, err := c.Tree().SizeHistogram([]int{16, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, vals := stats.Keys, stats.Values
+	if keys.N != 1001 || !slices.Equal(keys.Counts, []uint64{1001, 0, 0}) || keys.Min != 1 || keys.Max != 7 || keys.P50 != 7 || keys.P99 != 7 {
+		t.Errorf("keys: %+v", keys)
+	}
+	if vals.N != 1001 || !slices.Equal(vals.Counts, []uint64{901, 0, 100}) || vals.Min != 0 || vals.Max != 2000 || vals.P50 != 10 || vals.P99 != 2000 {
+		t.Errorf("values: %+v", vals)
+	}
+	// a bound is inclusive
+	stats, _ = c.Tree().SizeHistogram([]int{9, 10, 1999, 2000})
+	if !slices.Equal(stats.Values.Counts, []uint64{1, 900, 0, 100, 0}) {
+		t.Errorf("values by %v: %v", stats.Values.Bounds, stats.Values.Counts)
+	}
+	if _, err := c.Tree().SizeHistogram([]int{64, 16}); err == nil {
+		t.Error("decreasing bounds accepted")
+	}
+}
+
+// a node without keys is never written, not even the dummy key is left
+// in an emptied tree. one read from a damaged page is rejected.
+func TestEmptyNode(t *testing.T) {
+	empty := make([]byte, btree.BTREE_PAGE_SIZE)
+	binary.LittleEndian.PutUint16(empty, btree.BNODE_LEAF)
+	for _, height := range []int{1, 2} {
+		pages := map[uint64][]byte{}
+		next := uint64(0)
+		tree := &btree.BTree{
+			Get: func(ptr uint64) []byte { return pages[ptr] },
+			New: func(node []byte) uint64 {
+				next++
+				pages[next] = node
+				return next
+			},
+			Del: func(ptr uint64) { delete(pages, ptr) },
+		}
+		for i := 0; height == 2 && i < 500; i++ {
+			tree.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("val"))
+		}
+		if height == 1 {
+			tree.SetRoot(tree.New(empty))
+		} else {
+			for ptr := range pages {
+				if ptr != tree.Root() {
+					pages[ptr] = empty // every leaf
+				}
+			}
+		}
+		check := func(op string, err error) {
+			t.Helper()
+			if !errors.Is(err, btree.ErrCorrupt) {
+				t.Errorf("height %d: %s: %v", height, op, err)
+			}
+		}
+		_, _, err := tree.Read([]byte("key100"))
+		check("Read", err)
+		check("Insert", tree.Insert([]byte("key100"), []byte("new")))
+		_, err = tree.Delete([]byte("key100"))
+		check("Delete", err)
+		_, _, err = tree.Modify([]byte("key100"), func(old []byte, exists bool) ([]byte, bool) {
+			return []byte("new"), true
+		})
+		check("Modify", err)
+		it := tree.Scan([]byte("key100"), nil)
+		for it.Next() {
+			t.Fatalf("height %d: Scan found %q", height, it.Key())
+		}
+		check("Scan", it.Err())
+		it = tree.ScanReverse(nil, nil)
+		for it.Prev() {
+			t.Fatalf("height %d: ScanReverse found %q", height, it.Key())
+		}
+		check("ScanReverse", it.Err())
+		check("Verify", tree.Verify())
+	}
+}
+
+func TestEstimateRange(t *testing.T) {
+	c := btree.NewC()
+	for i := 0; i < 20000; i++ {
+		c.Add(fmt.Sprintf("key%05d", i), strings.Repeat("v", i%50))
+	}
+	tree := c.Tree()
+	get, reads := tree.Get, 0
+	tree.Get = func(ptr uint64) []byte {
+		reads++
+		return get(ptr)
+	}
+	stats, _ := tree.Stats()
+	for _, bounds := range [][2]string{
+		{"", ""}, {"key05000", "key15000"}, {"key00100", "key00110"},
+		{"key19990", ""}, {"a", "key00500"}, {"key12345", "key12999"},
+	} {
+		start, end := []byte(bounds[0]), []byte(bounds[1])
+		wantKeys := uint64(0)
+		tree.Walk(start, end, func(key, val []byte) bool {
+			wantKeys++
+			return true
+		})
+		wantBytes := tree.RangeBytes(start, end)
+		reads = 0
+		keys, bytes := tree.EstimateRange(start, end)
+		if reads > 2*stats.Height {
+			t.Errorf("[%q, %q): %d pages read, height %d", start, end, reads, stats.Height)
+		}
+		if keys < wantKeys*2/3 || keys > wantKeys*3/2 || bytes < wantBytes*2/3 || bytes > wantBytes*3/2 {
+			t.Errorf("[%q, %q): estimated %d keys %d bytes, actual %d keys %d bytes", start, end, keys, bytes, wantKeys, wantBytes)
+		}
+	}
+	// exact within a leaf, nothing for empty ranges
+	if keys, _ := tree.EstimateRange([]byte("key00100"), []byte("key00105")); keys != 5 {
+		t.Errorf("5 keys estimated as %d", keys)
+	}
+	for _, bounds := range [][2]string{{"key1", "key0"}, {"key1", "key1"}, {"z", ""}} {
+		if keys, bytes := tree.EstimateRange([]byte(bounds[0]), []byte(bounds[1])); keys != 0 || bytes != 0 {
+			t.Errorf("[%q, %q): %d keys %d bytes", bounds[0], bounds[1], keys, bytes)
+		}
+	}
+	if keys, bytes := btree.NewC().Tree().EstimateRange(nil, nil); keys != 0 || bytes != 0 {
+		t.Errorf("empty tree: %d keys %d bytes", keys, bytes)
+	}
+}
@@ -0,0 +1,3738 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"project/btree"
+	"project/kv"
+	"project/record"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openKV(t *testing.T, path string) *kv.KV {
+	t.Helper()
+	db := &kv.KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return db
+}
+
+func TestKVRename(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	if _, _, err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := db.Rename([]byte("a"), []byte("c"))
+	if !ok || err != nil {
+		t.Fatalf("Rename(a, c) = %v, %v", ok, err)
+	}
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Error("old key still exists")
+	}
+	if val, ok, _ := db.Get([]byte("c")); !ok || string(val) != "1" {
+		t.Errorf("new key = %q, %v", val, ok)
+	}
+
+	if ok, err := db.Rename([]byte("missing"), []byte("d")); ok || err != nil {
+		t.Errorf("Rename of a missing key = %v, %v", ok, err)
+	}
+	if _, err := db.Rename([]byte("c"), []byte("b")); !errors.Is(err, kv.ErrKeyExists) {
+		t.Errorf("Rename onto an existing key: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rename was committed with one root update
+	db = openKV(t, path)
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Error("old key exists after reopen")
+	}
+	if val, ok, _ := db.Get([]byte("c")); !ok || string(val) != "1" {
+		t.Errorf("new key after reopen = %q, %v", val, ok)
+	}
+}
+
+// a crash at any step of the update leaves either the old key or the new one
+func TestKVRenameCrash(t *testing.T) {
+	big := bytes.Repeat([]byte("v"), 3*btree.BTREE_PAGE_SIZE)
+	for step := kv.StepPagesWritten; step <= kv.StepRootWritten; step++ {
+		path := filepath.Join(t.TempDir(), "db")
+		db := openKV(t, path)
+		for i := range 500 {
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v"))
+		}
+		db.Set([]byte("old"), big)
+		db.UpdateHook = func(at kv.UpdateStep) error {
+			if at == step {
+				return errors.New("crash")
+			}
+			return nil
+		}
+		if ok, err := db.Rename([]byte("old"), []byte("new")); ok || err == nil {
+			t.Fatalf("step %d: Rename = %v, %v", step, ok, err)
+		}
+		db.Close()
+
+		db = openKV(t, path)
+		oldVal, oldOK, err1 := db.Get([]byte("old"))
+		newVal, newOK, err2 := db.Get([]byte("new"))
+		if err1 != nil || err2 != nil || oldOK == newOK {
+			t.Errorf("step %d: old %v, new %v, %v, %v", step, oldOK, newOK, err1, err2)
+		}
+		if !bytes.Equal(oldVal, big) && !bytes.Equal(newVal, big) {
+			t.Errorf("step %d: the value is lost", step)
+		}
+		// the root isn't durable before the last fsync, but the page cache has it
+		if want := step == kv.StepRootWritten; newOK != want {
+			t.Errorf("step %d: new key %v, want %v", step, newOK, want)
+		}
+		if err := db.Verify(); err != nil {
+			t.Errorf("step %d: %v", step, err)
+		}
+		db.Close()
+	}
+}
+
+// a minimal SSTable reader: returns the data entries in file order
+// and checks the sparse index against them.
+func readSSTable(t *testing.T, path string) [][2]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := data[len(data)-kv.SSTABLE_FOOTER_SIZE:]
+	if string(footer[24:]) != kv.SSTABLE_MAGIC {
+		t.Fatalf("bad magic %q", footer[24:])
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	nindex := binary.LittleEndian.Uint64(footer[8:16])
+	count := binary.LittleEndian.Uint64(footer[16:24])
+
+	var entries [][2]string
+	offsets := map[uint64]string{}
+	for pos := uint64(0); pos < indexOffset; {
+		klen := uint64(binary.LittleEndian.Uint32(data[pos:]))
+		vlen := uint64(binary.LittleEndian.Uint32(data[pos+4:]))
+		key := string(data[pos+8 : pos+8+klen])
+		offsets[pos] = key
+		entries = append(entries, [2]string{key, string(data[pos+8+klen : pos+8+klen+vlen])})
+		pos += 8 + klen + vlen
+	}
+	if uint64(len(entries)) != count {
+		t.Fatalf("footer says %d entries, data block has %d", count, len(entries))
+	}
+
+	pos := indexOffset
+	for i := uint64(0); i < nindex; i++ {
+		klen := uint64(binary.LittleEndian.Uint32(data[pos:]))
+		key := string(data[pos+4 : pos+4+klen])
+		offset := binary.LittleEndian.Uint64(data[pos+4+klen:])
+		if offsets[offset] != key {
+			t.Fatalf("index entry %q points at %q", key, offsets[offset])
+		}
+		pos += 4 + klen + 8
+	}
+	return entries
+}
+
+func TestKVExportSSTable(t *testing.T) {
+	dir := t.TempDir()
+	db := openKV(t, filepath.Join(dir, "db"))
+	defer db.Close()
+	ref := map[string]string{}
+	for i := 0; i < 500; i++ {
+		key, val := fmt.Sprintf("key%04d", (i*37)%500), fmt.Sprintf("val%d", i)
+		if _, _, err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+
+	path := filepath.Join(dir, "export.sst")
+	if err := db.ExportSSTable(path); err != nil {
+		t.Fatal(err)
+	}
+	entries := readSSTable(t, path)
+	if len(entries) != len(ref) {
+		t.Fatalf("exported %d entries, want %d", len(entries), len(ref))
+	}
+	for i, ent := range entries {
+		if i > 0 && entries[i-1][0] >= ent[0] {
+			t.Fatalf("entries out of order: %q, %q", entries[i-1][0], ent[0])
+		}
+		if ref[ent[0]] != ent[1] {
+			t.Errorf("entry %q = %q, want %q", ent[0], ent[1], ref[ent[0]])
+		}
+	}
+}
+
+// a failed export leaves the file it would replace alone
+func TestKVExportSSTableFailed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	db := openKV(t, path)
+	db.Set([]byte("small"), []byte("v"))
+	db.Set([]byte("big"), bytes.Repeat([]byte("b"), 3*btree.BTREE_PAGE_SIZE))
+	db.Close()
+	// damage the overflow pages, the ones past the root leaf
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := make([]byte, kv.META_SIZE)
+	fp.ReadAt(meta, 0)
+	root, npages := binary.LittleEndian.Uint64(meta), binary.LittleEndian.Uint64(meta[8:])
+	for ptr := uint64(1); ptr < npages; ptr++ {
+		if ptr != root {
+			fp.WriteAt([]byte{0xff}, int64(ptr*btree.BTREE_PAGE_SIZE+100))
+		}
+	}
+	fp.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	sst := filepath.Join(dir, "export.sst")
+	if err := os.WriteFile(sst, []byte("previous"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ExportSSTable(sst); !errors.Is(err, kv.ErrCorrupt) {
+		t.Errorf("ExportSSTable of a damaged value: %v", err)
+	}
+	if data, _ := os.ReadFile(sst); string(data) != "previous" {
+		t.Errorf("the failed export left %q", data)
+	}
+	if tmp, _ := filepath.Glob(sst + ".tmp.*"); len(tmp) > 0 {
+		t.Errorf("the failed export left %v", tmp)
+	}
+}
+
+func TestKVAggregateSum(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		val := make([]byte, 8)
+		binary.BigEndian.PutUint64(val, uint64(i*3))
+		if _, _, err := db.Set([]byte(fmt.Sprintf("n%03d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sum := func(acc, key, val []byte) []byte {
+		total := binary.BigEndian.Uint64(acc) + binary.BigEndian.Uint64(val)
+		return binary.BigEndian.AppendUint64(nil, total)
+	}
+	got, err := db.Aggregate([]byte("n050"), []byte("n150"), sum, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(0)
+	for i := 50; i < 150; i++ {
+		want += uint64(i * 3)
+	}
+	if binary.BigEndian.Uint64(got) != want {
+		t.Errorf("sum = %d, want %d", binary.BigEndian.Uint64(got), want)
+	}
+}
+
+func TestKVScanBounded(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		val := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		if _, _, err := db.Set([]byte(fmt.Sprintf("row%03d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start, next := []byte("row010"), 10
+	calls := 0
+	for start != nil {
+		page, resume, err := db.ScanBounded(start, []byte("row090"), 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		size := 0
+		for _, ent := range page {
+			if string(ent.Key) != fmt.Sprintf("row%03d", next) || len(ent.Val) != 1000+next {
+				t.Fatalf("got %q (%d bytes), want row%03d", ent.Key, len(ent.Val), next)
+			}
+			size += len(ent.Val)
+			next++
+		}
+		if size > 4000 {
+			t.Errorf("page holds %d value bytes", size)
+		}
+		start = resume
+	}
+	if next != 90 {
+		t.Errorf("scan stopped at row%03d", next)
+	}
+	if calls < 20 {
+		t.Errorf("expected partial pages, got %d calls", calls)
+	}
+}
+
+func TestKVVerifyAfterWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	defer db.Close()
+	db.VerifyAfterWrite = true
+
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(300) {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range rng.Perm(300)[:100] {
+		if i == 50 || i == 51 {
+			continue
+		}
+		if _, _, err := db.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// corrupt the leaf behind the writer's back: key0051 sorts after key0052 now.
+	// the checksums are fixed up, as a buggy writer would have done.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off, pos := 0, 0; ; off += pos + 1 {
+		if pos = bytes.Index(data[off:], []byte("key0051")); pos < 0 {
+			break
+		}
+		copy(data[off+pos:], "key0099")
+		page := data[(off+pos)/btree.BTREE_PAGE_SIZE*btree.BTREE_PAGE_SIZE:][:btree.BTREE_PAGE_SIZE]
+		binary.LittleEndian.PutUint32(page[kv.PAGE_DATA_SIZE:], crc32.ChecksumIEEE(page[:kv.PAGE_DATA_SIZE]))
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.Set([]byte("key0050a"), []byte("new")); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("the corrupted leaf wasn't detected: %v", err)
+	}
+}
+
+func TestKVGetCapped(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	if _, _, err := db.Set([]byte("small"), bytes.Repeat([]byte("s"), 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Set([]byte("large"), bytes.Repeat([]byte("l"), 2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, ok, err := db.GetCapped([]byte("small"), 100); err != nil || !ok || len(val) != 10 {
+		t.Errorf("GetCapped(small) = %d bytes, %v, %v", len(val), ok, err)
+	}
+	if _, ok, err := db.GetCapped([]byte("large"), 100); !ok || !errors.Is(err, kv.ErrValueTooLarge) {
+		t.Errorf("GetCapped(large) = %v, %v", ok, err)
+	}
+	if _, ok, err := db.GetCapped([]byte("missing"), 100); ok || err != nil {
+		t.Errorf("GetCapped(missing) = %v, %v", ok, err)
+	}
+
+	// a value in overflow pages is capped by its whole length
+	huge := bytes.Repeat([]byte("0123456789"), 2000)
+	if _, _, err := db.Set([]byte("huge"), huge); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := db.GetCapped([]byte("huge"), len(huge)); err != nil || !ok || !bytes.Equal(val, huge) {
+		t.Errorf("GetCapped(huge) at its length = %d bytes, %v, %v", len(val), ok, err)
+	}
+	if _, ok, err := db.GetCapped([]byte("huge"), len(huge)-1); !ok || !errors.Is(err, kv.ErrValueTooLarge) {
+		t.Errorf("GetCapped(huge) a byte short = %v, %v", ok, err)
+	}
+}
+
+func TestKVMerge(t *testing.T) {
+	dir := t.TempDir()
+	dst := openKV(t, filepath.Join(dir, "dst"))
+	defer dst.Close()
+	src := openKV(t, filepath.Join(dir, "src"))
+	defer src.Close()
+	for i := 0; i < 300; i++ {
+		if _, _, err := dst.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("dst")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 200; i < 500; i++ {
+		if _, _, err := src.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("src")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conflicts := 0
+	err := kv.Merge(dst, src, func(key, dstVal, srcVal []byte) []byte {
+		conflicts++
+		return append(append([]byte(nil), dstVal...), srcVal...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != 100 {
+		t.Errorf("onConflict called %d times, want 100", conflicts)
+	}
+	for i := 0; i < 500; i++ {
+		want := "dst"
+		if i >= 300 {
+			want = "src"
+		} else if i >= 200 {
+			want = "dstsrc"
+		}
+		if val, ok, _ := dst.Get([]byte(fmt.Sprintf("k%03d", i))); !ok || string(val) != want {
+			t.Fatalf("k%03d = %q, %v; want %q", i, val, ok, want)
+		}
+	}
+
+	if err := kv.Merge(dst, dst, nil); err == nil {
+		t.Error("merged a KV into itself")
+	}
+	// the locks are ordered, merges both ways at once don't deadlock
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*kv.KV{{dst, src}, {src, dst}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := kv.Merge(pair[0], pair[1], nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if dst.Count() != 500 || src.Count() != 500 {
+		t.Errorf("Count after merging both ways = %d, %d", dst.Count(), src.Count())
+	}
+}
+
+func TestKVKeyTransform(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	defer db.Close()
+	db.KeyTransform = kv.KeyTransform{
+		Encode: func(user []byte) []byte { return append([]byte("tenant1/"), user...) },
+		Decode: func(stored []byte) []byte { return bytes.TrimPrefix(stored, []byte("tenant1/")) },
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, _, err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := db.Del([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, ok, _ := db.Get([]byte("a")); !ok || string(val) != "va" {
+		t.Errorf("Get(a) = %q, %v", val, ok)
+	}
+	page, _, err := db.ScanBounded([]byte("a"), []byte("z"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || string(page[0].Key) != "a" || string(page[1].Key) != "c" {
+		t.Errorf("scan yielded %q", page)
+	}
+
+	// the storage holds the transformed keys
+	raw := openKV(t, path)
+	defer raw.Close()
+	if _, ok, _ := raw.Get([]byte("a")); ok {
+		t.Error("untransformed key is stored")
+	}
+	if val, ok, _ := raw.Get([]byte("tenant1/a")); !ok || string(val) != "va" {
+		t.Errorf("stored key tenant1/a = %q, %v", val, ok)
+	}
+}
+
+func TestKVKeyTransformNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tenant := func(name string) kv.KeyTransform {
+		prefix := []byte(name + "/")
+		return kv.KeyTransform{
+			Encode: func(user []byte) []byte { return append(bytes.Clone(prefix), user...) },
+			Decode: func(stored []byte) []byte { return bytes.TrimPrefix(stored, prefix) },
+		}
+	}
+	// "b/" sorts after "a/", the keys of each tenant are contiguous
+	for _, name := range []string{"a", "b", "c"} {
+		db := openKV(t, path)
+		db.KeyTransform = tenant(name)
+		for _, key := range []string{"k1", "k2", "k3"} {
+			if _, _, err := db.Set([]byte(key), []byte(name+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+	}
+
+	db := openKV(t, path)
+	defer db.Close()
+	db.KeyTransform = tenant("b")
+	var got []string
+	for key, val := range db.All() {
+		got = append(got, string(key)+"="+string(val))
+	}
+	if strings.Join(got, ",") != "k1=bk1,k2=bk2,k3=bk3" {
+		t.Errorf("All yielded %q", got)
+	}
+	got = nil
+	for key := range db.Keys([]byte("k2"), nil) {
+		got = append(got, string(key))
+	}
+	if strings.Join(got, ",") != "k2,k3" {
+		t.Errorf("Keys(k2, nil) yielded %q", got)
+	}
+	page, _, err := db.ScanBounded(nil, nil, 1000)
+	if err != nil || len(page) != 3 {
+		t.Errorf("ScanBounded = %q, %v", page, err)
+	}
+	n, err := db.Aggregate(nil, nil, func(acc, key, val []byte) []byte {
+		return append(acc, 'x')
+	}, nil)
+	if err != nil || len(n) != 3 {
+		t.Errorf("Aggregate visited %d keys, %v", len(n), err)
+	}
+	if key, val, ok, err := db.First(); !ok || err != nil || string(key) != "k1" || string(val) != "bk1" {
+		t.Errorf("First = %q, %q, %v, %v", key, val, ok, err)
+	}
+	if key, val, ok, err := db.Last(); !ok || err != nil || string(key) != "k3" || string(val) != "bk3" {
+		t.Errorf("Last = %q, %q, %v, %v", key, val, ok, err)
+	}
+	vals, found, err := db.GetMany([][]byte{[]byte("k3"), []byte("k1")})
+	if err != nil || !found[0] || !found[1] || string(vals[0]) != "bk3" || string(vals[1]) != "bk1" {
+		t.Errorf("GetMany = %q, %v, %v", vals, found, err)
+	}
+
+	// the other tenants are left alone
+	out, err := db.PopFront(10)
+	if err != nil || len(out) != 3 || string(out[2].Key) != "k3" {
+		t.Fatalf("PopFront = %q, %v", out, err)
+	}
+	if _, _, ok, err := db.First(); ok || err != nil {
+		t.Errorf("First of an empty namespace = %v, %v", ok, err)
+	}
+	if _, _, ok, err := db.Last(); ok || err != nil {
+		t.Errorf("Last of an empty namespace = %v, %v", ok, err)
+	}
+	db.KeyTransform = tenant("a")
+	if key, _, ok, _ := db.Last(); !ok || string(key) != "k3" {
+		t.Errorf("Last of tenant a = %q, %v", key, ok)
+	}
+	db.KeyTransform = kv.KeyTransform{}
+	got = nil
+	for key := range db.Keys(nil, nil) {
+		got = append(got, string(key))
+	}
+	if strings.Join(got, ",") != "a/k1,a/k2,a/k3,c/k1,c/k2,c/k3" {
+		t.Errorf("stored keys %q", got)
+	}
+}
+
+func TestKVValueFlags(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	if err := db.SetWithFlags([]byte("pinned"), []byte("v1"), 0x81); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Set([]byte("plain"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, flags, ok, _ := db.GetWithFlags([]byte("pinned")); !ok || string(val) != "v1" || flags != 0x81 {
+		t.Errorf("GetWithFlags(pinned) = %q, %#x, %v", val, flags, ok)
+	}
+	if val, ok, _ := db.Get([]byte("pinned")); !ok || string(val) != "v1" {
+		t.Errorf("Get(pinned) = %q, %v", val, ok)
+	}
+	if val, flags, ok, _ := db.GetWithFlags([]byte("plain")); !ok || string(val) != "v2" || flags != 0 {
+		t.Errorf("GetWithFlags(plain) = %q, %#x, %v", val, flags, ok)
+	}
+}
+
+func TestKVValueFlagsPlainFormat(t *testing.T) {
+	// make a file in the format predating value flags
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	if _, _, err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Del([]byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(make([]byte, 8), 16); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	if _, _, err := db.Set([]byte("k"), []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if val, flags, ok, _ := db.GetWithFlags([]byte("k")); !ok || string(val) != "plain" || flags != 0 {
+		t.Errorf("GetWithFlags = %q, %#x, %v", val, flags, ok)
+	}
+	if err := db.SetWithFlags([]byte("k"), []byte("v"), 1); !errors.Is(err, kv.ErrFormatVersion) {
+		t.Errorf("SetWithFlags on a plain file: %v", err)
+	}
+	// no overflow pages either
+	if _, _, err := db.Set([]byte("k"), bytes.Repeat([]byte("v"), 4000)); !errors.Is(err, btree.ErrValueTooLarge) {
+		t.Errorf("Set with a 4000-byte value on a plain file: %v", err)
+	}
+}
+
+func TestKVFreeListReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if _, _, err := db.Set(key, bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := stat.Size()
+
+	// overwrites free as many pages as they allocate
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i%200))
+		val := []byte(fmt.Sprintf("%0100d", i))
+		if _, _, err := db.Set(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stat, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 2*size {
+		t.Errorf("file grew from %d to %d bytes", size, stat.Size())
+	}
+	db.Close()
+
+	// the free list survives reopening
+	db = openKV(t, path)
+	defer db.Close()
+	for i := 1800; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i%200))
+		if val, ok, _ := db.Get(key); !ok || string(val) != fmt.Sprintf("%0100d", i) {
+			t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+		}
+	}
+	if _, _, err := db.Set([]byte("key0000"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVFreeListPendingPages(t *testing.T) {
+	// pages freed by an update are still referenced by the previous
+	// version of the tree, they must not be reused before the update commits.
+	path := filepath.Join(t.TempDir(), "db")
+	writer := openKV(t, path)
+	defer writer.Close()
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if _, _, err := writer.Set(key, []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := openKV(t, path)
+	defer reader.Close()
+
+	// a single update through the writer, the reader is at the old version
+	if _, _, err := writer.Set([]byte("key0000"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if val, ok, _ := reader.Get(key); !ok || string(val) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+		}
+	}
+}
+
+func TestKVSetTooLarge(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	if _, _, err := db.Set(bytes.Repeat([]byte("k"), 2000), []byte("v")); !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Errorf("Set with a 2000-byte key: %v", err)
+	}
+	if _, _, err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := db.Get([]byte("k")); !ok || string(val) != "v" {
+		t.Errorf("Get(k) = %q, %v", val, ok)
+	}
+}
+
+func TestKVMmapGrowth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a file larger than the first mmap chunk")
+	}
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	val := bytes.Repeat([]byte("v"), 2900) // about one leaf per KV
+	var first []byte
+	n := 0
+	for ; ; n++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%06d", n)), val); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			first, _, _ = db.Get([]byte("key000000"))
+		}
+		if n%1000 == 0 {
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() > 72<<20 {
+				break // well into the second chunk
+			}
+		}
+	}
+	// values read before the growth are still intact
+	if !bytes.Equal(first, val) {
+		t.Error("value read before the mmap growth changed")
+	}
+	check := func() {
+		for i := 0; i <= n; i += 97 {
+			key := []byte(fmt.Sprintf("key%06d", i))
+			if got, ok, _ := db.Get(key); !ok || !bytes.Equal(got, val) {
+				t.Fatalf("Get(%s) = %d bytes, %v", key, len(got), ok)
+			}
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openKV(t, path)
+	defer db.Close()
+	check()
+}
+
+func TestKVBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	if _, _, err := db.Set([]byte("key0000"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	before := db.FsyncCount()
+	b := db.Batch()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := b.Set(key, []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deleted, err := b.Del([]byte("key0999")); !deleted || err != nil {
+		t.Fatalf("Batch.Del = %v, %v", deleted, err)
+	}
+	// a rejected KV doesn't fail the batch
+	if err := b.Set(bytes.Repeat([]byte("k"), 2000), nil); !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Errorf("Batch.Set with a large key: %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.FsyncCount() - before; n != 2 {
+		t.Errorf("batch of 1000 keys took %d fsyncs, want 2", n)
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	for i := 0; i < 999; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if val, ok, _ := db.Get(key); !ok || string(val) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(%s) = %q, %v", key, val, ok)
+		}
+	}
+	if _, ok, _ := db.Get([]byte("key0999")); ok {
+		t.Error("deleted key exists")
+	}
+}
+
+func TestKVSnapshot(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := db.Snapshot()
+
+	// enough updates for the free list to cycle pages many times over
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if i%3 == 0 {
+				if _, _, err := db.Del(key); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, _, err := db.Set(key, []byte(fmt.Sprintf("new%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if val, ok, err := snap.Get([]byte("key0001")); !ok || err != nil || string(val) != "old" {
+		t.Errorf("snapshot Get(key0001) = %q, %v, %v", val, ok, err)
+	}
+	if val, ok, _ := db.Get([]byte("key0001")); !ok || string(val) != "new4" {
+		t.Errorf("Get(key0001) = %q, %v", val, ok)
+	}
+	n := 0
+	err := snap.Scan(nil, nil, func(key, val []byte) bool {
+		if want := fmt.Sprintf("key%04d", n); string(key) != want || string(val) != "old" {
+			t.Fatalf("snapshot scan: got %q=%q, want %q=old", key, val, want)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 300 {
+		t.Errorf("snapshot scan: %d keys, %v", n, err)
+	}
+	snap.Close()
+
+	// pages are reused again once the snapshot is closed
+	for i := 0; i < 300; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("last")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, ok, _ := db.Get([]byte("key0000")); !ok || string(val) != "last" {
+		t.Errorf("Get(key0000) = %q, %v", val, ok)
+	}
+}
+
+func TestKVSnapshotConcurrent(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := range 300 {
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old"))
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte{'o'}, 3*btree.BTREE_PAGE_SIZE))
+	snap := db.Snapshot()
+	defer snap.Close()
+
+	// a snapshot read doesn't wait for the write lock
+	err := db.Modify([]byte("key0000"), func(old []byte, exists bool) ([]byte, bool) {
+		if val, _, err := snap.Get([]byte("key0000")); string(val) != "old" || err != nil {
+			t.Errorf("snapshot Get under the write lock = %q, %v", val, err)
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := 0
+				err := snap.Scan(nil, nil, func(key, val []byte) bool {
+					if string(key) != "big" && string(val) != "old" {
+						t.Errorf("snapshot scan: %q=%q", key, val)
+						return false
+					}
+					n++
+					return true
+				})
+				if err != nil || n != 301 {
+					t.Errorf("snapshot scan: %d keys, %v", n, err)
+					return
+				}
+				if val, _, err := snap.Get([]byte("big")); err != nil || len(val) != 3*btree.BTREE_PAGE_SIZE || val[0] != 'o' {
+					t.Errorf("snapshot Get(big) = %d bytes, %v", len(val), err)
+					return
+				}
+			}
+		}()
+	}
+	for round := range 5 {
+		for i := range 300 {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if i%3 == round%3 {
+				db.Del(key)
+			} else {
+				db.Set(key, []byte(fmt.Sprintf("new%d", round)))
+			}
+		}
+		db.Set([]byte("big"), bytes.Repeat([]byte{byte('a' + round)}, 3*btree.BTREE_PAGE_SIZE))
+	}
+	close(done)
+	wg.Wait()
+}
+
+// a failed update reloads the meta page while snapshots read without the lock
+func TestKVSnapshotFailedUpdate(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := range 300 {
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old"))
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte{'o'}, 3*btree.BTREE_PAGE_SIZE))
+	snap := db.Snapshot()
+	defer snap.Close()
+	db.UpdateHook = func(step kv.UpdateStep) error {
+		return errors.New("crash") // before the root is written
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := 0
+				err := snap.Scan(nil, nil, func(key, val []byte) bool {
+					n++
+					return true
+				})
+				if err != nil || n != 301 {
+					t.Errorf("snapshot scan: %d keys, %v", n, err)
+					return
+				}
+				if val, _, err := snap.Get([]byte("big")); err != nil || len(val) != 3*btree.BTREE_PAGE_SIZE {
+					t.Errorf("snapshot Get(big) = %d bytes, %v", len(val), err)
+					return
+				}
+			}
+		}()
+	}
+	// a failed commit discards the batch and reads the meta page again
+	for i := range 300 {
+		b := db.Batch()
+		b.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("new"))
+		if err := b.Commit(); err == nil {
+			t.Error("the batch went through")
+		}
+	}
+	close(done)
+	wg.Wait()
+	if val, _, err := db.Get([]byte("key0000")); string(val) != "old" || err != nil {
+		t.Errorf("Get(key0000) = %q, %v", val, err)
+	}
+}
+
+func TestKVUpdateInPlace(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a committed leaf is visible to the snapshot, it must be copied
+	snap := db.Snapshot()
+	defer snap.Close()
+	if _, _, err := db.Set([]byte("key0050"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := snap.Get([]byte("key0050")); string(val) != "v0" {
+		t.Errorf("snapshot sees %q after an equal-length update", val)
+	}
+
+	// the leaf copied by the first update of a batch is patched by the rest
+	b := db.Batch()
+	for i := 2; i < 10; i++ {
+		if err := b.Set([]byte("key0050"), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if val, _, _ := db.Get([]byte("key0050")); string(val) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get in batch = %q", val)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := db.Get([]byte("key0050")); string(val) != "v9" {
+		t.Errorf("Get after commit = %q", val)
+	}
+	if val, _, _ := snap.Get([]byte("key0050")); string(val) != "v0" {
+		t.Errorf("snapshot sees %q after the batch", val)
+	}
+}
+
+func BenchmarkKVBatchOverwrite(b *testing.B) {
+	db := &kv.KV{Path: filepath.Join(b.TempDir(), "db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("val00000")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	batch := db.Batch()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// equal-length values, in place after the first round
+		key := []byte(fmt.Sprintf("key%04d", i%1000))
+		if err := batch.Set(key, []byte(fmt.Sprintf("val%05d", i%100000))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if err := batch.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestKVTxn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	for i := 0; i < 200; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first txn commits
+	txn := db.Begin()
+	for i := 0; i < 200; i += 2 {
+		if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, _, _ := db.Get([]byte("key0000")); string(val) != "v0" {
+		t.Errorf("uncommitted update is visible: %q", val)
+	}
+	if val, _, _ := txn.Get([]byte("key0000")); string(val) != "v1" {
+		t.Errorf("txn doesn't see its own update: %q", val)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set([]byte("k"), []byte("v")); !errors.Is(err, kv.ErrTxnDone) {
+		t.Errorf("Set after Commit: %v", err)
+	}
+
+	// the second txn frees the pages of the first, they must not be
+	// reused while the committed root still references them
+	txn = db.Begin()
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i%3 == 0 {
+			if _, err := txn.Del(key); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := txn.Set(key, []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		want := []string{"v1", "v0"}[i%2]
+		if val, ok, _ := db.Get([]byte(fmt.Sprintf("key%04d", i))); !ok || string(val) != want {
+			t.Fatalf("Get(key%04d) during the txn = %q, %v", i, val, ok)
+		}
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := db.Get([]byte("key0003")); !ok || string(val) != "v0" {
+		t.Errorf("Get after rollback = %q, %v", val, ok)
+	}
+
+	// the KV is writable again after a rollback
+	txn = db.Begin()
+	if _, err := txn.Del([]byte("key0001")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openKV(t, path)
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("key0001")); ok {
+		t.Error("deleted key exists after reopen")
+	}
+	if val, ok, _ := db.Get([]byte("key0002")); !ok || string(val) != "v1" {
+		t.Errorf("Get(key0002) after reopen = %q, %v", val, ok)
+	}
+}
+
+func TestKVPrefixScan(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	keys := []string{"ap", "app", "app:1", "apple", "apple:1", "apples", "apq", "b",
+		"\xff", "\xff\xff", "\xff\xff\x01", "\xfe\xff", "\xfe\xff\x00", "\xff\x00"}
+	for _, key := range keys {
+		if _, _, err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"app", []string{"app", "app:1", "apple", "apple:1", "apples"}},
+		{"apple", []string{"apple", "apple:1", "apples"}},
+		{"apple:", []string{"apple:1"}},
+		{"c", nil},
+		{"\xfe\xff", []string{"\xfe\xff", "\xfe\xff\x00"}},
+		{"\xff", []string{"\xff", "\xff\x00", "\xff\xff", "\xff\xff\x01"}},
+		{"\xff\xff", []string{"\xff\xff", "\xff\xff\x01"}},
+	}
+	for _, c := range cases {
+		kvs, err := db.PrefixScan([]byte(c.prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, kv := range kvs {
+			if string(kv.Val) != "v"+string(kv.Key) {
+				t.Errorf("PrefixScan(%q): %q=%q", c.prefix, kv.Key, kv.Val)
+			}
+			got = append(got, string(kv.Key))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("PrefixScan(%q) = %q, want %q", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestKVChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	for i := 0; i < 100; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("val%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// flip a bit in the leaves holding val0042, including the freed ones
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off, pos := 0, 0; ; off += pos + 1 {
+		if pos = bytes.Index(data[off:], []byte("val0042")); pos < 0 {
+			break
+		}
+		data[off+pos] ^= 0x01
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openKV(t, path)
+	defer db.Close()
+	if _, _, err := db.GetCapped([]byte("key0042"), 100); !errors.Is(err, kv.ErrChecksumMismatch) {
+		t.Errorf("GetCapped from the corrupted page: %v", err)
+	}
+	if _, _, err := db.Set([]byte("key0042"), []byte("new")); !errors.Is(err, kv.ErrChecksumMismatch) {
+		t.Errorf("Set into the corrupted page: %v", err)
+	}
+	if _, err := db.PrefixScan([]byte("key")); !errors.Is(err, kv.ErrChecksumMismatch) {
+		t.Errorf("PrefixScan over the corrupted page: %v", err)
+	}
+}
+
+func TestKVReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	db.Close()
+	// the meta page is written on creation
+	if stat, err := os.Stat(path); err != nil || stat.Size() != kv.META_SIZE {
+		t.Fatalf("new file: %v, %v", stat, err)
+	}
+
+	for round := 0; round < 3; round++ {
+		db = openKV(t, path)
+		for i := round; i < 300; i += 3 {
+			if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := db.Del([]byte(fmt.Sprintf("key%04d", round))); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	db = openKV(t, path)
+	for i := 0; i < 300; i++ {
+		val, ok, _ := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if ok != (i >= 3) || (ok && string(val) != fmt.Sprintf("val%d", i)) {
+			t.Fatalf("Get(key%04d) after reopen = %q, %v", i, val, ok)
+		}
+	}
+	db.Close()
+
+	// a root pointer past the end of the file
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := make([]byte, 8)
+	binary.LittleEndian.PutUint64(root, 1<<40)
+	if _, err := fp.WriteAt(root, 0); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	db = &kv.KV{Path: path}
+	if err := db.Open(); !errors.Is(err, btree.ErrCorrupt) {
+		t.Errorf("Open with a bad root: %v", err)
+	}
+}
+
+func TestKVCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	want := map[string]bool{}
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(500))
+		if rng.Intn(3) == 0 {
+			if _, _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		} else {
+			// inserts and updates
+			if _, _, err := db.Set([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = true
+		}
+		if db.Count() != uint64(len(want)) {
+			t.Fatalf("step %d: Count() = %d, want %d", i, db.Count(), len(want))
+		}
+	}
+
+	// rolled back updates don't count
+	txn := db.Begin()
+	txn.Set([]byte("new"), []byte("v"))
+	txn.Rollback()
+	if db.Count() != uint64(len(want)) {
+		t.Errorf("Count() after rollback = %d, want %d", db.Count(), len(want))
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	if db.Count() != uint64(len(want)) {
+		t.Errorf("Count() after reopen = %d, want %d", db.Count(), len(want))
+	}
+	db.Close()
+
+	// files predating the counter are counted on open
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(make([]byte, 8), 56); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	db = openKV(t, path)
+	defer db.Close()
+	if db.Count() != uint64(len(want)) {
+		t.Errorf("Count() of a file without the counter = %d, want %d", db.Count(), len(want))
+	}
+}
+
+func TestStore(t *testing.T) {
+	file := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer file.Close()
+	for name, db := range map[string]kv.Store{"KV": file, "MemKV": kv.NewMemKV()} {
+		ref := map[string]string{}
+		rng := rand.New(rand.NewSource(5))
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%04d", rng.Intn(1000))
+			if rng.Intn(4) == 0 {
+				_, deleted, err := db.Del([]byte(key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := ref[key]; deleted != ok {
+					t.Fatalf("%s: Del(%s) = %v", name, key, deleted)
+				}
+				delete(ref, key)
+			} else {
+				val := strings.Repeat("v", rng.Intn(200))
+				if _, _, err := db.Set([]byte(key), []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+				ref[key] = val
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			val, ok, _ := db.Get([]byte(key))
+			if want, exists := ref[key]; ok != exists || string(val) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v", name, key, val, ok)
+			}
+		}
+	}
+}
+
+// run with -race
+func TestKVConcurrentReaders(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	const nkeys = 50
+	for i := 0; i < nkeys; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				// every round is committed as a whole
+				kvs, err := db.PrefixScan([]byte("key"))
+				if err == nil && len(kvs) != nkeys {
+					err = fmt.Errorf("scan: %d keys", len(kvs))
+				}
+				for _, kv := range kvs {
+					if err == nil && !bytes.Equal(kv.Val, kvs[0].Val) {
+						err = fmt.Errorf("scan: %s=%s, %s=%s", kvs[0].Key, kvs[0].Val, kv.Key, kv.Val)
+					}
+				}
+				if _, ok, _ := db.Get([]byte("key07")); err == nil && !ok {
+					err = errors.New("Get: key07 is missing")
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for round := 1; round <= 30; round++ {
+		txn := db.Begin()
+		for i := 0; i < nkeys; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprint(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for r := 0; r < 4; r++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestKVSetDelOldValue(t *testing.T) {
+	file := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer file.Close()
+	for name, db := range map[string]kv.Store{"KV": file, "MemKV": kv.NewMemKV()} {
+		if old, existed, err := db.Set([]byte("k"), []byte("v1")); old != nil || existed || err != nil {
+			t.Errorf("%s: first Set = %q, %v, %v", name, old, existed, err)
+		}
+		old, existed, err := db.Set([]byte("k"), []byte("v2"))
+		if string(old) != "v1" || !existed || err != nil {
+			t.Errorf("%s: Set over v1 = %q, %v, %v", name, old, existed, err)
+		}
+		// the old value is a copy, not a view into a page that gets reused
+		for i := 0; i < 200; i++ {
+			db.Set([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte("x"), 50))
+		}
+		if string(old) != "v1" {
+			t.Errorf("%s: old value changed to %q", name, old)
+		}
+		if old, existed, err := db.Del([]byte("k")); string(old) != "v2" || !existed || err != nil {
+			t.Errorf("%s: Del = %q, %v, %v", name, old, existed, err)
+		}
+		if old, existed, err := db.Del([]byte("k")); old != nil || existed || err != nil {
+			t.Errorf("%s: Del of a missing key = %q, %v, %v", name, old, existed, err)
+		}
+	}
+}
+
+func TestKVCompareAndSwap(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	cas := func(expected, val string, nilExpected bool, want bool) {
+		t.Helper()
+		var exp []byte
+		if !nilExpected {
+			exp = []byte(expected)
+		}
+		if ok, err := db.CompareAndSwap([]byte("k"), exp, []byte(val)); ok != want || err != nil {
+			t.Errorf("CompareAndSwap(%q, %q) = %v, %v", exp, val, ok, err)
+		}
+	}
+	cas("", "x", false, false) // absent, but an empty value expected
+	cas("", "v1", true, true)  // absent
+	cas("", "v2", true, false) // no longer absent
+	cas("v0", "v2", false, false)
+	if val, _, _ := db.Get([]byte("k")); string(val) != "v1" {
+		t.Errorf("value after failed swaps = %q", val)
+	}
+	cas("v1", "", false, true)
+	cas("", "v3", false, true) // present with an empty value
+	if val, _, _ := db.Get([]byte("k")); string(val) != "v3" {
+		t.Errorf("value after swaps = %q", val)
+	}
+}
+
+func TestKVHas(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("empty"), nil)
+	for key, want := range map[string]bool{"a": true, "empty": true, "b": false} {
+		if ok, err := db.Has([]byte(key)); ok != want || err != nil {
+			t.Errorf("Has(%q) = %v, %v", key, ok, err)
+		}
+	}
+	db.Del([]byte("a"))
+	if ok, _ := db.Has([]byte("a")); ok {
+		t.Error("Has(a) after Del")
+	}
+}
+
+func TestKVWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	open := func() *kv.KV {
+		t.Helper()
+		db := &kv.KV{Path: path, WAL: true}
+		if err := db.Open(); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		return db
+	}
+	db := open()
+	db.Set([]byte("a"), []byte("1"))
+	// the database file before the last update, as if the crash hit
+	// right after the log was synced
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("b"), []byte("2"))
+	db.Close()
+	record, err := os.ReadFile(path + ".wal")
+	if err != nil || len(record) == 0 {
+		t.Fatalf("wal: %d bytes, %v", len(record), err)
+	}
+
+	// a complete record is replayed
+	os.WriteFile(path, before, 0o644)
+	db = open()
+	for _, key := range []string{"a", "b"} {
+		if _, ok, _ := db.Get([]byte(key)); !ok {
+			t.Errorf("%s is missing after replaying the log", key)
+		}
+	}
+	db.Close()
+
+	// a partial record is dropped, the update never reached the database file
+	os.WriteFile(path, before, 0o644)
+	os.WriteFile(path+".wal", record[:len(record)/2], 0o644)
+	db = open()
+	if _, ok, _ := db.Get([]byte("a")); !ok {
+		t.Error("a is missing after dropping the log")
+	}
+	if _, ok, _ := db.Get([]byte("b")); ok {
+		t.Error("b is there after dropping the log")
+	}
+	if _, _, err := db.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// opening without the log replays it once and removes it
+	db = openKV(t, path)
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("c")); !ok {
+		t.Error("c is missing")
+	}
+	if _, err := os.Stat(path + ".wal"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("wal left behind: %v", err)
+	}
+}
+
+func TestKVSyncMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, SyncMode: kv.SyncNever}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := db.FsyncCount()
+	for i := 0; i < 100; i++ {
+		if _, _, err := db.Set([]byte(fmt.Sprint(i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Del([]byte("0"))
+	if n := db.FsyncCount() - before; n != 0 {
+		t.Errorf("%d fsyncs without Flush", n)
+	}
+	if val, ok, _ := db.Get([]byte("99")); !ok || string(val) != "v" {
+		t.Errorf("Get(99) before Flush = %q, %v", val, ok)
+	}
+	// the file as a crash would leave it still has the old meta page
+	crashed := openKV(t, path)
+	if n := crashed.Count(); n != 0 {
+		t.Errorf("%d keys on disk before Flush", n)
+	}
+	crashed.Close()
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.FsyncCount() - before; n != 2 {
+		t.Errorf("%d fsyncs by Flush", n)
+	}
+	reopened := openKV(t, path)
+	if n := reopened.Count(); n != 99 {
+		t.Errorf("%d keys on disk after Flush", n)
+	}
+	if err := reopened.Verify(); err != nil {
+		t.Error(err)
+	}
+	reopened.Close()
+
+	// pages of the durable tree are not reused before the next Flush
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprint(i%100)), []byte(strings.Repeat("x", i%50)))
+	}
+	crashed = openKV(t, path)
+	if n := crashed.Count(); n != 99 {
+		t.Errorf("%d keys on disk after unflushed overwrites", n)
+	}
+	if val, ok, _ := crashed.Get([]byte("50")); !ok || string(val) != "v" {
+		t.Errorf("Get(50) on disk = %q, %v", val, ok)
+	}
+	crashed.Close()
+}
+
+func TestKVSyncInterval(t *testing.T) {
+	db := &kv.KV{Path: filepath.Join(t.TempDir(), "db"), SyncMode: kv.SyncInterval, SyncPeriod: time.Millisecond}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := db.FsyncCount()
+	db.Set([]byte("k"), []byte("v"))
+	for deadline := time.Now().Add(5 * time.Second); db.FsyncCount() == before; {
+		if time.Now().After(deadline) {
+			t.Fatal("no background flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// nothing more to flush
+	time.Sleep(20 * time.Millisecond)
+	if n := db.FsyncCount() - before; n != 2 {
+		t.Errorf("%d fsyncs for 1 update", n)
+	}
+}
+
+func TestKVGetMany(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	b := db.Batch()
+	for i := 0; i < 5000; i += 2 {
+		b.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(i)))
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var adjacent, spread []string
+	for i := 1000; i < 1040; i++ { // in 1 or 2 leaves, half of them missing
+		adjacent = append(adjacent, fmt.Sprintf("k%05d", i))
+	}
+	for i := 4999; i >= 0; i -= 97 { // all over the tree, in reverse
+		spread = append(spread, fmt.Sprintf("k%05d", i))
+	}
+	spread = append(spread, "a", "z", "k01000", "k01000") // out of range and repeated
+	for _, set := range [][]string{adjacent, spread, nil} {
+		keys := make([][]byte, len(set))
+		for i, key := range set {
+			keys[i] = []byte(key)
+		}
+		vals, found, err := db.GetMany(keys)
+		if err != nil || len(vals) != len(keys) || len(found) != len(keys) {
+			t.Fatalf("GetMany: %d values, %d found, %v", len(vals), len(found), err)
+		}
+		for i, key := range keys {
+			val, ok, _ := db.Get(key)
+			if found[i] != ok || string(vals[i]) != string(val) {
+				t.Errorf("GetMany[%q] = %q, %v, want %q, %v", key, vals[i], found[i], val, ok)
+			}
+		}
+	}
+}
+
+func TestKVFirstLast(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	if _, _, ok, err := db.First(); ok || err != nil {
+		t.Errorf("First on an empty database = %v, %v", ok, err)
+	}
+	for _, key := range []string{"b", "c", "a"} {
+		db.Set([]byte(key), []byte("v"+key))
+	}
+	if key, val, ok, err := db.First(); string(key) != "a" || string(val) != "va" || !ok || err != nil {
+		t.Errorf("First = %q, %q, %v, %v", key, val, ok, err)
+	}
+	if key, val, ok, err := db.Last(); string(key) != "c" || string(val) != "vc" || !ok || err != nil {
+		t.Errorf("Last = %q, %q, %v, %v", key, val, ok, err)
+	}
+}
+
+func TestKVPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, PageSize: 8192}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", i%200)))
+	}
+	for i := 0; i < 3000; i += 3 {
+		db.Del([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	stats, _ := db.Stats()
+	db.Close()
+	if stat, err := os.Stat(path); err != nil || stat.Size()%8192 != 0 {
+		t.Fatalf("file size %v, %v", stat.Size(), err)
+	}
+
+	// the page size comes from the file
+	db = openKV(t, path)
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Stats(); got != stats {
+		t.Errorf("Stats after reopening = %+v, want %+v", got, stats)
+	}
+	for i := 0; i < 3000; i++ {
+		val, ok, _ := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if ok != (i%3 != 0) || ok && len(val) != i%200 {
+			t.Fatalf("Get(key%05d) = %d bytes, %v", i, len(val), ok)
+		}
+	}
+	db.Close()
+
+	for _, size := range []int{4096, 16384} {
+		db = &kv.KV{Path: path, PageSize: size}
+		if err := db.Open(); !errors.Is(err, kv.ErrPageSize) {
+			t.Errorf("reopen with %d-byte pages: %v", size, err)
+		}
+	}
+	for _, size := range []int{1000, 5000, 32768} {
+		db = &kv.KV{Path: filepath.Join(t.TempDir(), "db"), PageSize: size}
+		if err := db.Open(); !errors.Is(err, kv.ErrPageSize) {
+			t.Errorf("create with %d-byte pages: %v", size, err)
+		}
+	}
+}
+
+func TestKVRange(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("val%04d", i)))
+	}
+
+	n := 0
+	for key, val := range db.All() {
+		if string(key) != fmt.Sprintf("key%04d", n) || string(val) != fmt.Sprintf("val%04d", n) {
+			t.Fatalf("All #%d = %q, %q", n, key, val)
+		}
+		n++
+	}
+	if n != 1000 {
+		t.Errorf("All yielded %d KVs", n)
+	}
+	var got []string
+	for key := range db.Range([]byte("key0100"), []byte("key0103")) {
+		got = append(got, string(key))
+	}
+	if strings.Join(got, ",") != "key0100,key0101,key0102" {
+		t.Errorf("Range yielded %q", got)
+	}
+
+	// the yielded slices stay valid and the scan stops at the break
+	decoded := 0
+	db.KeyTransform.Decode = func(stored []byte) []byte {
+		decoded++
+		return stored
+	}
+	var kept [][]byte
+	for key := range db.Range([]byte("key0500"), nil) {
+		kept = append(kept, key)
+		if len(kept) == 3 {
+			break
+		}
+	}
+	if decoded != 3 {
+		t.Errorf("%d keys read for 3 yielded", decoded)
+	}
+	db.KeyTransform.Decode = nil
+	// the read lock is released
+	for i := 0; i < 1000; i += 2 {
+		db.Del([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	for i, key := range kept {
+		if string(key) != fmt.Sprintf("key%04d", 500+i) {
+			t.Errorf("kept key #%d = %q", i, key)
+		}
+	}
+}
+
+func TestKVEmptyValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	if _, _, err := db.Set([]byte("k"), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("k2"), []byte{})
+	if val, ok, _ := db.Get([]byte("k")); !ok || val == nil || len(val) != 0 {
+		t.Errorf("Get(k) = %#v, %v", val, ok)
+	}
+	if val, ok, _ := db.Get([]byte("missing")); ok || val != nil {
+		t.Errorf("Get(missing) = %#v, %v", val, ok)
+	}
+	if old, existed, _ := db.Set([]byte("k2"), []byte("v")); !existed || old == nil || len(old) != 0 {
+		t.Errorf("Set(k2) old = %#v, %v", old, existed)
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	if val, ok, _ := db.Get([]byte("k")); !ok || val == nil || len(val) != 0 {
+		t.Errorf("Get(k) after reopening = %#v, %v", val, ok)
+	}
+	for key, val := range db.All() {
+		if string(key) == "k" && (val == nil || len(val) != 0) {
+			t.Errorf("All yielded %#v for k", val)
+		}
+	}
+	if old, existed, _ := db.Del([]byte("k")); !existed || old == nil || len(old) != 0 {
+		t.Errorf("Del(k) old = %#v, %v", old, existed)
+	}
+	if _, ok, _ := db.Get([]byte("k")); ok {
+		t.Error("k still present after Del")
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", i%100)))
+	}
+	for i := 0; i < 5000; i++ {
+		if i%10 != 0 {
+			db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		}
+	}
+	snap := db.Snapshot()
+	if _, err := db.Compact(); !errors.Is(err, kv.ErrSnapshotsOpen) {
+		t.Errorf("Compact with an open snapshot: %v", err)
+	}
+	snap.Close()
+
+	stats, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.After >= stats.Before/2 {
+		t.Errorf("compacted from %d to %d bytes", stats.Before, stats.After)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != stats.After {
+		t.Errorf("file size %v, %v", stat.Size(), err)
+	}
+	check := func() {
+		t.Helper()
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if n := db.Count(); n != 500 {
+			t.Errorf("Count = %d", n)
+		}
+		for i := 0; i < 5000; i++ {
+			val, ok, _ := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if ok != (i%10 == 0) || ok && len(val) != i%100 {
+				t.Fatalf("Get(key%05d) = %d bytes, %v", i, len(val), ok)
+			}
+		}
+	}
+	check()
+	// the compacted file takes updates and survives reopening
+	db.Set([]byte("new"), []byte("v"))
+	db.Del([]byte("new"))
+	db.Close()
+	db = &kv.KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestKVCompactRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, LazyMerge: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 30)))
+	}
+	large := bytes.Repeat([]byte("l"), 3*btree.BTREE_PAGE_SIZE)
+	db.Set([]byte("key02000x"), large)
+	for i := 1000; i < 4000; i++ {
+		if i%4 != 0 {
+			db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		}
+	}
+	before, err := db.FileStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CompactRange([]byte("key01000"), []byte("key04000")); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.FileStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.LivePages >= before.LivePages*3/4 {
+		t.Errorf("%d live pages after CompactRange, %d before", after.LivePages, before.LivePages)
+	}
+	check := func() {
+		t.Helper()
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if n := db.Count(); n != 2000+750+1 {
+			t.Errorf("Count = %d", n)
+		}
+		for i := 0; i < 5000; i++ {
+			_, ok, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if ok != (i < 1000 || i >= 4000 || i%4 == 0) || err != nil {
+				t.Fatalf("Get(key%05d) = %v, %v", i, ok, err)
+			}
+		}
+		if val, _, err := db.Get([]byte("key02000x")); !bytes.Equal(val, large) || err != nil {
+			t.Errorf("Get(key02000x) = %d bytes, %v", len(val), err)
+		}
+	}
+	// the old leaves are free for later updates
+	if after.FreePages <= before.FreePages {
+		t.Errorf("%d free pages after CompactRange, %d before", after.FreePages, before.FreePages)
+	}
+	check()
+	db.Close()
+	db = &kv.KV{Path: path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+	if err := db.CompactRange(nil, nil); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("CompactRange on a read-only KV: %v", err)
+	}
+}
+
+func TestKVDeferredFree(t *testing.T) {
+	dir := t.TempDir()
+	deletes := func(db *kv.KV) uint64 {
+		t.Helper()
+		for i := 0; i < 3000; i++ {
+			if _, _, err := db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 100))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := db.WriteCount()
+		for i := 0; i < 3000; i += 2 {
+			if _, _, err := db.Del([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db.WriteCount() - before
+	}
+	plain := openKV(t, filepath.Join(dir, "plain"))
+	defer plain.Close()
+	path := filepath.Join(dir, "db")
+	db := &kv.KV{Path: path, DeferredFree: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// no tail node of the free list to write
+	if n, m := deletes(db), deletes(plain); n >= m {
+		t.Errorf("%d page writes with DeferredFree, %d without", n, m)
+	}
+	fileStats := func() kv.FileStats {
+		t.Helper()
+		stats, err := db.FileStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalPages != 1+stats.LivePages+stats.FreePages+stats.FreeListPages+stats.DeferredPages {
+			t.Fatalf("pages don't add up: %+v", stats)
+		}
+		return stats
+	}
+	queued := fileStats()
+	if queued.DeferredPages == 0 {
+		t.Fatalf("no deferred pages: %+v", queued)
+	}
+
+	// a failed update gives back the pages it queued
+	db.UpdateHook = func(kv.UpdateStep) error { return errors.New("crash") }
+	b := db.Batch()
+	for i := 1; i < 3000; i += 2 {
+		b.Del([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	if err := b.Commit(); err == nil {
+		t.Fatal("commit with a failing UpdateHook")
+	}
+	db.UpdateHook = nil
+	if stats := fileStats(); stats.DeferredPages != queued.DeferredPages {
+		t.Errorf("%d deferred pages after a failed update, %d before", stats.DeferredPages, queued.DeferredPages)
+	}
+
+	// the reclaimed pages aren't reused under an open snapshot
+	snap := db.Snapshot()
+	n, err := db.Reclaim()
+	if err != nil || int64(n) != queued.DeferredPages {
+		t.Fatalf("Reclaim = %d, %v, want %d", n, err, queued.DeferredPages)
+	}
+	reclaimed := fileStats()
+	if reclaimed.DeferredPages != 0 || reclaimed.FreePages < queued.FreePages+int64(n) {
+		t.Errorf("after Reclaim: %+v, before: %+v", reclaimed, queued)
+	}
+	for i := 1; i < 3000; i += 2 {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("w", 100)))
+	}
+	for i := 1; i < 3000; i += 2 {
+		val, ok, err := snap.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if !ok || err != nil || string(val) != strings.Repeat("v", 100) {
+			t.Fatalf("snapshot Get(key%05d) = %q, %v, %v", i, val, ok, err)
+		}
+	}
+	snap.Close()
+
+	// and the file stops growing once they can be
+	for i := 0; i < 3000; i += 2 {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 100)))
+	}
+	db.Reclaim()
+	grown := fileStats()
+	for r := 0; r < 3; r++ {
+		for i := 0; i < 3000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("x", 100)))
+		}
+		db.Reclaim()
+	}
+	if stats := fileStats(); stats.TotalPages > grown.TotalPages*5/4 {
+		t.Errorf("%d pages after rewriting the keys, %d before", stats.TotalPages, grown.TotalPages)
+	}
+
+	// Close pushes the rest
+	for i := 0; i < 1000; i++ {
+		db.Del([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &kv.KV{Path: path, DeferredFree: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if stats := fileStats(); stats.DeferredPages != 0 {
+		t.Errorf("%d deferred pages after reopening", stats.DeferredPages)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Count(); n != 2000 {
+		t.Errorf("Count = %d", n)
+	}
+}
+
+var soakSteps = flag.Int("soak", 5000, "number of random operations in TestSoak")
+
+// the open file descriptors of the process, -1 without /proc
+func openFds() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// TestSoak runs random updates, reads, snapshots, compactions and reopens
+// against a map, and checks that no pages or file descriptors leak.
+// go test ./test -run TestSoak -soak 1000000 for a long run.
+func TestSoak(t *testing.T) {
+	steps := *soakSteps
+	if testing.Short() {
+		steps /= 10
+	}
+	path := filepath.Join(t.TempDir(), "db")
+	rng := rand.New(rand.NewSource(1))
+	fds := openFds()
+	open := func() *kv.KV {
+		t.Helper()
+		db := &kv.KV{Path: path, WAL: rng.Intn(4) == 0, LazyMerge: rng.Intn(2) == 0, DeferredFree: rng.Intn(2) == 0}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	ref := map[string]string{}
+	var snap *kv.Snapshot
+	var snapRef map[string]string
+	same := func(what string, m map[string]string, scan func(fn func(key, val []byte) bool) error) {
+		t.Helper()
+		n := 0
+		err := scan(func(key, val []byte) bool {
+			if want, ok := m[string(key)]; !ok || want != string(val) {
+				t.Fatalf("%s: %q = %d bytes, want %d bytes, %v", what, key, len(val), len(want), ok)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != len(m) {
+			t.Fatalf("%s: %d keys, want %d, %v", what, n, len(m), err)
+		}
+	}
+	check := func(step int) {
+		t.Helper()
+		if err := db.Verify(); err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+		same("db", ref, func(fn func(key, val []byte) bool) error {
+			for key, val := range db.All() {
+				if !fn(key, val) {
+					break
+				}
+			}
+			return nil
+		})
+		if n := db.Count(); n != uint64(len(ref)) {
+			t.Fatalf("step %d: Count = %d, want %d", step, n, len(ref))
+		}
+		if snap != nil {
+			same("snapshot", snapRef, func(fn func(key, val []byte) bool) error {
+				return snap.Scan(nil, nil, fn)
+			})
+		}
+		stats, err := db.FileStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalPages != 1+stats.LivePages+stats.FreePages+stats.FreeListPages+stats.DeferredPages {
+			t.Fatalf("step %d: pages don't add up: %+v", step, stats)
+		}
+	}
+	closeSnap := func() {
+		if snap != nil {
+			snap.Close()
+			snap, snapRef = nil, nil
+		}
+	}
+	for i := 0; i < steps; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(1000))
+		switch r := rng.Intn(100); {
+		case r < 45:
+			val := strings.Repeat(string(rune('a'+rng.Intn(26))), rng.Intn(200))
+			if rng.Intn(20) == 0 {
+				val = strings.Repeat("o", 2*btree.BTREE_PAGE_SIZE) // overflow pages
+			}
+			if _, _, err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			ref[key] = val
+		case r < 70:
+			if _, _, err := db.Del([]byte(key)); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			delete(ref, key)
+		case r < 85:
+			val, ok, err := db.Get([]byte(key))
+			if want, exists := ref[key]; ok != exists || string(val) != want || err != nil {
+				t.Fatalf("step %d: Get(%s) = %d bytes, %v, %v", i, key, len(val), ok, err)
+			}
+		case r < 90:
+			if snap != nil {
+				same("snapshot", snapRef, func(fn func(key, val []byte) bool) error {
+					return snap.Scan(nil, nil, fn)
+				})
+				closeSnap()
+			} else {
+				snap, snapRef = db.Snapshot(), maps.Clone(ref)
+			}
+		case r < 92:
+			_, err := db.Compact()
+			if snap != nil && !errors.Is(err, kv.ErrSnapshotsOpen) || snap == nil && err != nil {
+				t.Fatalf("step %d: Compact: %v", i, err)
+			}
+		case r < 95:
+			end := fmt.Sprintf("key%04d", rng.Intn(1000))
+			if err := db.CompactRange([]byte(key), []byte(end)); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		case r < 97:
+			if _, err := db.Reclaim(); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		default:
+			closeSnap()
+			if err := db.Close(); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			if n := openFds(); n != fds {
+				t.Fatalf("step %d: %d open fds, %d before", i, n, fds)
+			}
+			db = open()
+			check(i)
+		}
+		if i%500 == 499 {
+			check(i)
+		}
+	}
+	check(steps)
+	closeSnap()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := openFds(); n != fds {
+		t.Errorf("%d open fds, %d before", n, fds)
+	}
+}
+
+func TestKVOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	large := make([]byte, 50<<10)
+	rand.New(rand.NewSource(1)).Read(large)
+	if _, _, err := db.Set([]byte("large"), large); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("small"), []byte("v"))
+	if val, ok, _ := db.Get([]byte("large")); !ok || !bytes.Equal(val, large) {
+		t.Fatalf("Get(large) = %d bytes, %v", len(val), ok)
+	}
+	if err := db.SetWithFlags([]byte("large"), large[:20000], 7); err != nil {
+		t.Fatal(err)
+	}
+	if val, flags, ok, _ := db.GetWithFlags([]byte("large")); !ok || flags != 7 || !bytes.Equal(val, large[:20000]) {
+		t.Errorf("GetWithFlags(large) = %d bytes, %#x, %v", len(val), flags, ok)
+	}
+
+	// the chains of replaced and deleted values are reused
+	stat, _ := os.Stat(path)
+	for i := 0; i < 20; i++ {
+		if _, _, err := db.Set([]byte("large"), large); err != nil {
+			t.Fatal(err)
+		}
+		if old, existed, err := db.Del([]byte("large")); err != nil || !existed || !bytes.Equal(old, large) {
+			t.Fatalf("Del #%d: old %d bytes, %v", i, len(old), err)
+		}
+	}
+	if grown, _ := os.Stat(path); grown.Size() > stat.Size()+int64(len(large))*2 {
+		t.Errorf("file grew from %d to %d bytes", stat.Size(), grown.Size())
+	}
+
+	db.Set([]byte("large"), large)
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openKV(t, path)
+	defer db.Close()
+	for key, val := range db.All() {
+		if string(key) == "large" && !bytes.Equal(val, large) {
+			t.Errorf("All yielded %d bytes for large", len(val))
+		}
+	}
+	if val, ok, _ := db.Get([]byte("small")); !ok || string(val) != "v" {
+		t.Errorf("Get(small) = %q, %v", val, ok)
+	}
+}
+
+func TestKVReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("a"), []byte("va"))
+	db.Close()
+	old, _ := os.ReadFile(path)
+	db = &kv.KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("b"), []byte("vb"))
+	db.Close()
+	// the last update only made it to the log
+	if err := os.WriteFile(path, old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &kv.KV{Path: path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := db.Get([]byte("b")); !ok || string(val) != "vb" {
+		t.Errorf("Get(b) = %q, %v", val, ok)
+	}
+	var keys []string
+	for key := range db.All() {
+		keys = append(keys, string(key))
+	}
+	if strings.Join(keys, ",") != "a,b" || db.Count() != 2 {
+		t.Errorf("All yielded %q, Count = %d", keys, db.Count())
+	}
+	if _, _, err := db.Set([]byte("c"), []byte("vc")); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Set: %v", err)
+	}
+	if _, _, err := db.Del([]byte("a")); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Del: %v", err)
+	}
+	if err := db.Batch().Commit(); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Batch.Commit: %v", err)
+	}
+	if err := db.Begin().Commit(); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Txn.Commit: %v", err)
+	}
+	if _, err := db.Compact(); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Compact: %v", err)
+	}
+	if _, ok, _ := db.Get([]byte("c")); ok {
+		t.Error("c was set")
+	}
+	db.Close()
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, old) {
+		t.Error("the file was modified")
+	}
+
+	db = &kv.KV{Path: filepath.Join(t.TempDir(), "missing"), ReadOnly: true}
+	if err := db.Open(); err == nil {
+		t.Error("opened a missing file")
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, nil, 0o644)
+	db = &kv.KV{Path: empty, ReadOnly: true}
+	if err := db.Open(); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("open an empty file: %v", err)
+	}
+}
+
+func TestKVOpenFsyncError(t *testing.T) {
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip(err)
+		}
+		return len(entries)
+	}
+	before := fds()
+	failed := errors.New("fsync failed")
+	db := &kv.KV{Path: filepath.Join(t.TempDir(), "db")}
+	calls := 0
+	db.FsyncHook = func(fd int) error {
+		// only the first one, on the directory
+		calls++
+		if calls == 1 {
+			return failed
+		}
+		return nil
+	}
+	if err := db.Open(); !errors.Is(err, failed) {
+		t.Fatalf("Open with a failing directory fsync: %v", err)
+	}
+	if after := fds(); after != before {
+		t.Errorf("%d descriptors open before, %d after", before, after)
+	}
+}
+
+func TestKVIndex(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	idx := db.Index()
+	cities := map[string]string{
+		"alice": "NYC", "bob": "NY", "carol": "NYC", "dave": "SF", "erin": "NYC\x00",
+	}
+	for name, city := range cities {
+		if err := idx.Put([]byte(name), []byte("lives in "+city)); err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.IndexInsert([]byte(city), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(city string) string {
+		t.Helper()
+		keys, err := idx.IndexScan([]byte(city))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, key := range keys {
+			names = append(names, string(key))
+		}
+		return strings.Join(names, ",")
+	}
+	for city, want := range map[string]string{"NYC": "alice,carol", "NY": "bob", "SF": "dave", "LA": ""} {
+		if got := scan(city); got != want {
+			t.Errorf("IndexScan(%q) = %q, want %q", city, got, want)
+		}
+	}
+
+	if deleted, err := idx.Delete([]byte("alice"), []byte("NYC")); !deleted || err != nil {
+		t.Fatalf("Delete(alice) = %v, %v", deleted, err)
+	}
+	if _, ok, _ := idx.Get([]byte("alice")); ok {
+		t.Error("the row of alice is still there")
+	}
+	if got := scan("NYC"); got != "carol" {
+		t.Errorf("IndexScan(NYC) after Delete = %q", got)
+	}
+	if row, ok, _ := idx.Get([]byte("carol")); !ok || string(row) != "lives in NYC" {
+		t.Errorf("Get(carol) = %q, %v", row, ok)
+	}
+}
+
+func TestKVExportImport(t *testing.T) {
+	src := openKV(t, filepath.Join(t.TempDir(), "src"))
+	defer src.Close()
+	for i := 0; i < 3000; i++ {
+		src.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", i%50)))
+	}
+	src.SetWithFlags([]byte("flagged"), []byte("f"), 3)
+	src.Set([]byte("large"), bytes.Repeat([]byte("L"), 20000))
+	var stream bytes.Buffer
+	if err := src.Export(&stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// a cut short stream imports nothing
+	path := filepath.Join(t.TempDir(), "dst")
+	dst := openKV(t, path)
+	defer dst.Close()
+	if err := dst.Import(bytes.NewReader(stream.Bytes()[:stream.Len()-1])); err == nil {
+		t.Error("imported a truncated stream")
+	}
+	if err := dst.Import(strings.NewReader("not an export")); !errors.Is(err, kv.ErrExportFormat) {
+		t.Errorf("import garbage: %v", err)
+	}
+	// damaged lengths in the header of an entry
+	entry := func(klen, vlen uint32) io.Reader {
+		head := stream.Bytes()[:len(kv.EXPORT_MAGIC)+4]
+		head = binary.LittleEndian.AppendUint32(bytes.Clone(head), klen)
+		head = binary.LittleEndian.AppendUint32(head, vlen)
+		return bytes.NewReader(append(head, 0, 'k', 'v'))
+	}
+	if err := dst.Import(entry(btree.BTREE_MAX_KEY_SIZE+1, 1)); !errors.Is(err, kv.ErrExportFormat) {
+		t.Errorf("import an oversized key: %v", err)
+	}
+	if err := dst.Import(entry(1, math.MaxUint32-1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("import a 4GB value cut short: %v", err)
+	}
+	if dst.Count() != 0 {
+		t.Fatalf("Count after failed imports = %d", dst.Count())
+	}
+
+	if err := dst.Import(bytes.NewReader(stream.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var want, got []string
+	for key, val := range src.All() {
+		want = append(want, string(key)+"="+string(val))
+	}
+	for key, val := range dst.All() {
+		got = append(got, string(key)+"="+string(val))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imported %d KVs, exported %d", len(got), len(want))
+	}
+	if _, flags, _, _ := dst.GetWithFlags([]byte("flagged")); flags != 3 {
+		t.Errorf("flags of the imported key = %d", flags)
+	}
+	if err := dst.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Import(bytes.NewReader(stream.Bytes())); !errors.Is(err, btree.ErrNotEmpty) {
+		t.Errorf("import into a non-empty KV: %v", err)
+	}
+}
+
+func TestKVMetrics(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// read concurrently with the updates
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			db.Metrics()
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 100)))
+	}
+	wg.Wait()
+	m := db.Metrics()
+	if m.Inserts != 2000 || m.Splits < 50 {
+		t.Errorf("Metrics after 2000 inserts = %+v", m)
+	}
+	for i := 0; i < 2000; i++ {
+		db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		db.Del([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	after := db.Metrics()
+	if after.Reads != m.Reads+2000 || after.Deletes != 2000 || after.Merges == 0 {
+		t.Errorf("Metrics after 2000 reads and deletes = %+v", after)
+	}
+}
+
+func TestKVNumericKeys(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for _, i := range []int64{100, -5, 0, math.MinInt64, -300, math.MaxInt64, 256} {
+		db.Set(kv.EncodeInt64(i), nil)
+	}
+	var got []int64
+	for key := range db.Range(kv.EncodeInt64(-5), kv.EncodeInt64(101)) {
+		got = append(got, kv.DecodeInt64(key))
+	}
+	if !reflect.DeepEqual(got, []int64{-5, 0, 100}) {
+		t.Errorf("Range(-5, 101) = %v", got)
+	}
+	for _, u := range []uint64{0, 255, 1 << 40, math.MaxUint64} {
+		if got := kv.DecodeUint64(kv.EncodeUint64(u)); got != u {
+			t.Errorf("DecodeUint64(EncodeUint64(%d)) = %d", u, got)
+		}
+	}
+	if bytes.Compare(kv.EncodeUint64(255), kv.EncodeUint64(256)) >= 0 {
+		t.Error("255 doesn't sort before 256")
+	}
+}
+
+func TestKVDeleteAllFreesPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	defer db.Close()
+	var sizes []int64
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 2000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 50)))
+		}
+		for i := 0; i < 2000; i++ {
+			db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		}
+		if stats, err := db.Stats(); err != nil || stats.LeafNodes+stats.InternalNodes != 0 {
+			t.Fatalf("round %d: %+v, %v", round, stats, err)
+		}
+		stat, _ := os.Stat(path)
+		sizes = append(sizes, stat.Size())
+	}
+	// the pages of the previous rounds are reused, none leaked. the free
+	// list may take a page more until it settles
+	if sizes[5] != sizes[2] || sizes[2] > sizes[0]+4096 {
+		t.Errorf("file sizes by round: %v", sizes)
+	}
+}
+
+func TestKVScanContext(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for i := 0; i < 5000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("v"))
+	}
+
+	it := db.ScanContext(context.Background(), []byte("key01000"), []byte("key02000"))
+	n := 0
+	for it.Next() {
+		if string(it.Key()) != fmt.Sprintf("key%05d", 1000+n) {
+			t.Fatalf("key #%d = %q", n, it.Key())
+		}
+		n++
+	}
+	if n != 1000 || it.Err() != nil {
+		t.Errorf("scanned %d keys, %v", n, it.Err())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it = db.ScanContext(ctx, nil, nil)
+	defer it.Close()
+	n = 0
+	for it.Next() {
+		n++
+		if n == 100 {
+			cancel()
+		}
+	}
+	if !errors.Is(it.Err(), context.Canceled) || n > 100+kv.SCAN_CONTEXT_INTERVAL {
+		t.Errorf("stopped after %d keys with %v", n, it.Err())
+	}
+	if _, _, err := db.Set([]byte("new"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// an open cursor doesn't hold up writers, nor see their updates
+	it = db.ScanContext(context.Background(), []byte("key04990"), nil)
+	defer it.Close()
+	it.Next()
+	done := make(chan error)
+	go func() {
+		_, _, err := db.Del([]byte("key04995"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Del waits for the open cursor")
+	}
+	n = 1
+	for it.Next() {
+		n++
+	}
+	if n != 10+1 || it.Err() != nil {
+		t.Errorf("scanned %d keys, %v", n, it.Err())
+	}
+	if _, err := db.Compact(); err != nil {
+		t.Errorf("Compact after the cursor ended: %v", err)
+	}
+
+	// in the middle of a batch the cursor sees its updates so far
+	b := db.Batch()
+	b.Set([]byte("b1"), []byte("v"))
+	it = db.ScanContext(context.Background(), []byte("b"), []byte("c"))
+	b.Set([]byte("b1"), []byte("w")) // in place
+	b.Set([]byte("b2"), []byte("v"))
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key())+"="+string(it.Val()))
+	}
+	if !slices.Equal(keys, []string{"b1=v"}) || it.Err() != nil {
+		t.Errorf("scan in a batch = %q, %v", keys, it.Err())
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVModify(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	incr := func(old []byte, exists bool) ([]byte, bool) {
+		n := uint64(0)
+		if exists {
+			n = kv.DecodeUint64(old)
+		}
+		return kv.EncodeUint64(n + 1), true
+	}
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if err := db.Modify([]byte("n"), incr); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, _, _ := db.Get([]byte("n")); kv.DecodeUint64(val) != workers*rounds {
+		t.Errorf("counter = %d, want %d", kv.DecodeUint64(val), workers*rounds)
+	}
+
+	// skip, then delete
+	err := db.Modify([]byte("n"), func(old []byte, exists bool) ([]byte, bool) {
+		return []byte("x"), false
+	})
+	if val, _, _ := db.Get([]byte("n")); err != nil || kv.DecodeUint64(val) != workers*rounds {
+		t.Errorf("skipped Modify changed the value to %q, %v", val, err)
+	}
+	err = db.Modify([]byte("n"), func(old []byte, exists bool) ([]byte, bool) {
+		return nil, true
+	})
+	if _, ok, _ := db.Get([]byte("n")); err != nil || ok {
+		t.Errorf("Modify returning nil kept the key, %v", err)
+	}
+	err = db.Modify([]byte("e"), func(old []byte, exists bool) ([]byte, bool) {
+		if exists {
+			t.Errorf("absent key reported as existing")
+		}
+		return []byte{}, true
+	})
+	if val, ok, _ := db.Get([]byte("e")); err != nil || !ok || len(val) != 0 {
+		t.Errorf("empty value = %q, %v, %v", val, ok, err)
+	}
+
+	// a panic in fn isn't taken for a corrupted page
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the panic of fn", r)
+			}
+		}()
+		db.Modify([]byte("e"), func(old []byte, exists bool) ([]byte, bool) {
+			panic("boom")
+		})
+	}()
+	if _, _, err := db.Set([]byte("after"), []byte("v")); err != nil {
+		t.Errorf("Set after a panic in Modify: %v", err)
+	}
+}
+
+func TestKVFileStats(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	check := func(what string) kv.FileStats {
+		t.Helper()
+		stats, err := db.FileStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := 1 + stats.LivePages + stats.FreePages + stats.FreeListPages; sum != stats.TotalPages {
+			t.Errorf("%s: %+v, the pages add up to %d", what, stats, sum)
+		}
+		return stats
+	}
+	check("empty")
+	for i := range 500 {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'v'}, 100))
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte{'b'}, 3*btree.BTREE_PAGE_SIZE))
+	full := check("after inserts")
+	if full.FileSize < full.TotalPages*btree.BTREE_PAGE_SIZE {
+		t.Errorf("file size %d for %d pages", full.FileSize, full.TotalPages)
+	}
+	for i := range 400 {
+		db.Del([]byte(fmt.Sprintf("k%04d", i)))
+	}
+	db.Del([]byte("big"))
+	after := check("after deletes")
+	if after.LivePages >= full.LivePages || after.FreePages <= full.FreePages {
+		t.Errorf("deletes didn't free pages: %+v then %+v", full, after)
+	}
+
+	// pending pages of a batch count too
+	b := db.Batch()
+	for i := range 100 {
+		b.Set([]byte(fmt.Sprintf("n%04d", i)), bytes.Repeat([]byte{'v'}, 100))
+	}
+	check("in a batch")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check("after the batch")
+}
+
+func TestKVDeletePrefix(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	for _, sess := range []string{"a", "b"} {
+		for i := range 200 {
+			db.Set([]byte(fmt.Sprintf("sess:%s:%04d", sess, i)), []byte("v"))
+		}
+	}
+	db.Set([]byte("sess:a:big"), bytes.Repeat([]byte{'b'}, 3*btree.BTREE_PAGE_SIZE))
+	db.Set([]byte("sess:a"), []byte("not a field"))
+	db.Set([]byte("\xff\xff"), []byte("1"))
+	db.Set([]byte("\xff\xff\x00"), []byte("2"))
+	db.Set([]byte("\xff\xfe"), []byte("3"))
+
+	if n, err := db.DeletePrefix([]byte("sess:a:")); n != 201 || err != nil {
+		t.Errorf("DeletePrefix(sess:a:) = %d, %v", n, err)
+	}
+	if kvs, _ := db.PrefixScan([]byte("sess:a:")); len(kvs) != 0 {
+		t.Errorf("%d keys of session a left", len(kvs))
+	}
+	if kvs, _ := db.PrefixScan([]byte("sess:b:")); len(kvs) != 200 {
+		t.Errorf("%d keys of session b, want 200", len(kvs))
+	}
+	if _, ok, _ := db.Get([]byte("sess:a")); !ok {
+		t.Error("the key equal to the prefix without the colon is gone")
+	}
+	stats, err := db.FileStats()
+	if sum := 1 + stats.LivePages + stats.FreePages + stats.FreeListPages; err != nil || sum != stats.TotalPages {
+		t.Errorf("pages leaked: %+v, %v", stats, err)
+	}
+
+	// no successor of an all 0xff prefix
+	if n, err := db.DeletePrefix([]byte("\xff\xff")); n != 2 || err != nil {
+		t.Errorf("DeletePrefix(ffff) = %d, %v", n, err)
+	}
+	if _, ok, _ := db.Get([]byte("\xff\xfe")); !ok {
+		t.Error("ff fe deleted with the ff ff prefix")
+	}
+	if n, err := db.DeletePrefix([]byte("nothing")); n != 0 || err != nil {
+		t.Errorf("DeletePrefix(nothing) = %d, %v", n, err)
+	}
+	if n, err := db.DeletePrefix(nil); n != 202 || err != nil || db.Count() != 0 {
+		t.Errorf("DeletePrefix(nil) = %d, %v, %d keys left", n, err, db.Count())
+	}
+}
+
+func TestKVGrowBy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &kv.KV{Path: path, GrowBy: 64}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	chunk := int64(64 * btree.BTREE_PAGE_SIZE)
+	sizes := map[int64]bool{}
+	for i := range 2000 {
+		db.Set([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{'v'}, 100))
+		stats, err := db.FileStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.FileSize < stats.TotalPages*btree.BTREE_PAGE_SIZE {
+			t.Fatalf("file size %d for %d pages", stats.FileSize, stats.TotalPages)
+		}
+		sizes[stats.FileSize] = true
+	}
+	stats, _ := db.FileStats()
+	if limit := stats.FileSize/chunk + 1; int64(len(sizes)) > limit {
+		t.Errorf("%d file sizes up to %d bytes, want at most %d", len(sizes), stats.FileSize, limit)
+	}
+
+	// Preallocate reserves space the next updates fill
+	if err := db.Preallocate(1000); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := db.FileStats()
+	if before.FileSize < (before.TotalPages+1000)*btree.BTREE_PAGE_SIZE {
+		t.Errorf("file size %d after reserving 1000 pages past %d", before.FileSize, before.TotalPages)
+	}
+	for i := range 500 {
+		db.Set([]byte(fmt.Sprintf("new%06d", i)), bytes.Repeat([]byte{'v'}, 100))
+	}
+	after, _ := db.FileStats()
+	db.Close()
+	if after.FileSize != before.FileSize || after.TotalPages <= before.TotalPages {
+		t.Errorf("file size %d -> %d while pages went %d -> %d", before.FileSize, after.FileSize, before.TotalPages, after.TotalPages)
+	}
+
+	reopened := openKV(t, path)
+	defer reopened.Close()
+	if n := reopened.Count(); n != 2500 {
+		t.Errorf("%d keys after reopening", n)
+	}
+}
+
+func TestKVGetReader(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	db.Set([]byte("big"), big)
+	db.Set([]byte("small"), []byte("inline"))
+
+	r, ok, err := db.GetReader([]byte("big"))
+	if err != nil || !ok {
+		t.Fatalf("GetReader(big) = %v, %v", ok, err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, r, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// the pages being read are kept until Close
+	db.Set([]byte("big"), []byte("replaced"))
+	for i := range 50 {
+		db.Set([]byte(fmt.Sprintf("fill%d", i)), bytes.Repeat([]byte{'x'}, 3000))
+	}
+	if _, err := io.CopyBuffer(h, r, make([]byte, 777)); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(big); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Error("streamed value differs from the one written")
+	}
+	r.Close()
+
+	r, ok, err = db.GetReader([]byte("small"))
+	if err != nil || !ok {
+		t.Fatalf("GetReader(small) = %v, %v", ok, err)
+	}
+	if val, err := io.ReadAll(r); string(val) != "inline" || err != nil {
+		t.Errorf("inline value = %q, %v", val, err)
+	}
+	r.Close()
+	if _, ok, err := db.GetReader([]byte("none")); ok || err != nil {
+		t.Errorf("GetReader(none) = %v, %v", ok, err)
+	}
+}
+
+// crash the update of a child process at each step of updateFile, the file
+// must then hold the state before or after the update.
+func TestKVCrash(t *testing.T) {
+	if step := os.Getenv("BMOX_CRASH_STEP"); step != "" {
+		crashChild(t, os.Getenv("BMOX_CRASH_PATH"), step)
+		return
+	}
+	for step, after := range map[kv.UpdateStep]bool{
+		kv.StepPagesWritten: false,
+		kv.StepPagesSynced:  false,
+		kv.StepRootWritten:  true,
+	} {
+		path := filepath.Join(t.TempDir(), "db")
+		db := openKV(t, path)
+		for i := range 300 {
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old"))
+		}
+		db.Close()
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestKVCrash$", "-test.count=1")
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("BMOX_CRASH_STEP=%d", step), "BMOX_CRASH_PATH="+path)
+		out, err := cmd.CombinedOutput()
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != 3 {
+			t.Fatalf("step %d: child didn't crash: %v\n%s", step, err, out)
+		}
+
+		db = openKV(t, path)
+		if err := db.Verify(); err != nil {
+			t.Errorf("step %d: %v", step, err)
+		}
+		want, count := "old", uint64(300)
+		if after {
+			want, count = "new", 200
+		}
+		if db.Count() != count {
+			t.Errorf("step %d: %d keys, want %d", step, db.Count(), count)
+		}
+		for i := 100; i < 300; i++ {
+			if val, _, _ := db.Get([]byte(fmt.Sprintf("key%04d", i))); string(val) != want {
+				t.Fatalf("step %d: key%04d = %q, want %q", step, i, val, want)
+			}
+		}
+		// and it takes updates again
+		if _, _, err := db.Set([]byte("key0000"), []byte("later")); err != nil {
+			t.Errorf("step %d: %v", step, err)
+		}
+		db.Close()
+	}
+}
+
+// the committed tail node of the free list is written in place, a crash
+// in the middle of that write must not make the file unusable.
+func TestKVTornFreeListTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	for i := range 300 {
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old"))
+	}
+	db.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	meta := make([]byte, kv.META_SIZE)
+	fp.ReadAt(meta, 0)
+	tail := int64(binary.LittleEndian.Uint64(meta[40:])) * btree.BTREE_PAGE_SIZE
+	old := make([]byte, btree.BTREE_PAGE_SIZE)
+	fp.ReadAt(old, tail)
+
+	db = openKV(t, path)
+	db.UpdateHook = func(step kv.UpdateStep) error {
+		// only the first sectors of the node reached the disk
+		torn := make([]byte, btree.BTREE_PAGE_SIZE)
+		fp.ReadAt(torn, tail)
+		copy(torn[btree.BTREE_PAGE_SIZE-512:], old[btree.BTREE_PAGE_SIZE-512:])
+		data := len(torn) - kv.PAGE_CHECKSUM_SIZE
+		if crc32.ChecksumIEEE(torn[:data]) == binary.LittleEndian.Uint32(torn[data:]) {
+			t.Fatal("the update didn't change the tail node")
+		}
+		fp.WriteAt(torn, tail)
+		return errors.New("crash")
+	}
+	if _, _, err := db.Set([]byte("key0000"), []byte("new")); err == nil {
+		t.Fatal("the update went through")
+	}
+	db.Close()
+
+	db = openKV(t, path)
+	defer db.Close()
+	if _, err := db.FileStats(); err != nil {
+		t.Error(err)
+	}
+	for i := range 300 {
+		if _, _, err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("later")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+	if val, _, err := db.Get([]byte("key0299")); err != nil || string(val) != "later" {
+		t.Errorf("Get after the crash = %q, %v", val, err)
+	}
+}
+
+func crashChild(t *testing.T, path string, step string) {
+	n, err := strconv.Atoi(step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openKV(t, path)
+	db.UpdateHook = func(at kv.UpdateStep) error {
+		if at == kv.UpdateStep(n) {
+			os.Exit(3)
+		}
+		return nil
+	}
+	b := db.Batch()
+	for i := range 300 {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i < 100 {
+			b.Del(key)
+		} else {
+			b.Set(key, []byte("new"))
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	t.Fatal("the update finished without crashing")
+}
+
+func TestKVClone(t *testing.T) {
+	dir := t.TempDir()
+	db := &kv.KV{Path: filepath.Join(dir, "db"), SyncMode: kv.SyncNever}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := range 500 {
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("src"))
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte{'b'}, 3*btree.BTREE_PAGE_SIZE))
+	for i := range 100 {
+		db.Del([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	// the last updates are not durable in the source yet
+	clonePath := filepath.Join(dir, "clone")
+	if err := db.Clone(clonePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Clone(clonePath); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Clone over an existing file: %v", err)
+	}
+
+	clone := openKV(t, clonePath)
+	defer clone.Close()
+	if err := clone.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if clone.Count() != db.Count() {
+		t.Fatalf("clone has %d keys, source %d", clone.Count(), db.Count())
+	}
+	for i := range 500 {
+		clone.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("clone"))
+	}
+	clone.Del([]byte("big"))
+	clone.Set([]byte("new"), []byte("1"))
+
+	for i := range 500 {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if val, ok, _ := db.Get(key); ok != (i >= 100) || ok && string(val) != "src" {
+			t.Fatalf("source %s = %q, %v", key, val, ok)
+		}
+	}
+	if val, _, _ := db.Get([]byte("big")); len(val) != 3*btree.BTREE_PAGE_SIZE {
+		t.Errorf("source big value is %d bytes", len(val))
+	}
+	if _, ok, _ := db.Get([]byte("new")); ok {
+		t.Error("a key set in the clone is in the source")
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// the mem backend
+	mem := kv.NewMemKV()
+	mem.Set([]byte("a"), []byte("1"))
+	memClone := mem.Clone()
+	memClone.Set([]byte("a"), []byte("2"))
+	memClone.Set([]byte("b"), []byte("3"))
+	if val, _, _ := mem.Get([]byte("a")); string(val) != "1" || mem.Count() != 1 {
+		t.Errorf("mem source a = %q with %d keys", val, mem.Count())
+	}
+	if val, _, _ := memClone.Get([]byte("a")); string(val) != "2" || memClone.Count() != 2 {
+		t.Errorf("mem clone a = %q with %d keys", val, memClone.Count())
+	}
+}
+
+func TestKVPopFront(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	const total = 1000
+	for i := range total {
+		db.Set(kv.EncodeUint64(uint64(i)), []byte(fmt.Sprintf("job%d", i)))
+	}
+	if kvs, err := db.PopFront(0); len(kvs) != 0 || err != nil {
+		t.Errorf("PopFront(0) = %d KVs, %v", len(kvs), err)
+	}
+
+	var mu sync.Mutex
+	seen := map[uint64]bool{}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				kvs, err := db.PopFront(7)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(kvs) == 0 {
+					return
+				}
+				mu.Lock()
+				prev := int64(-1)
+				for _, item := range kvs {
+					id := kv.DecodeUint64(item.Key)
+					if seen[id] || int64(id) <= prev || string(item.Val) != fmt.Sprintf("job%d", id) {
+						t.Errorf("popped %d = %q again or out of order", id, item.Val)
+					}
+					seen[id], prev = true, int64(id)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != total || db.Count() != 0 {
+		t.Errorf("popped %d keys, %d left", len(seen), db.Count())
+	}
+
+	// more than there are
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+	if kvs, err := db.PopFront(10); len(kvs) != 2 || err != nil || string(kvs[1].Key) != "b" {
+		t.Errorf("PopFront(10) = %v, %v", kvs, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKVTupleKeys(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	// users that are prefixes of each other or hold 0x00 and 0x01
+	users := []string{"a", "a\x00", "a\x00b", "a\x01", "ab", "b"}
+	for _, user := range users {
+		for order := uint64(1); order <= 5; order++ {
+			key := kv.EncodeTuple([]byte(user), kv.EncodeUint64(order))
+			db.Set(key, []byte(fmt.Sprintf("%q/%d", user, order)))
+		}
+	}
+	for _, user := range users {
+		kvs, err := db.ScanPrefixTuple([]byte(user))
+		if err != nil || len(kvs) != 5 {
+			t.Fatalf("ScanPrefixTuple(%q) = %d KVs, %v", user, len(kvs), err)
+		}
+		for i, item := range kvs {
+			segs, err := kv.DecodeTuple(item.Key)
+			if err != nil || len(segs) != 2 || string(segs[0]) != user || kv.DecodeUint64(segs[1]) != uint64(i+1) {
+				t.Fatalf("ScanPrefixTuple(%q)[%d] = %q, %v", user, i, segs, err)
+			}
+			if want := fmt.Sprintf("%q/%d", user, i+1); string(item.Val) != want {
+				t.Errorf("value %q, want %q", item.Val, want)
+			}
+		}
+	}
+	// segment by segment order
+	all, _ := db.ScanPrefixTuple()
+	for i := 1; i < len(all); i++ {
+		prev, _ := kv.DecodeTuple(all[i-1].Key)
+		cur, _ := kv.DecodeTuple(all[i].Key)
+		if c := bytes.Compare(prev[0], cur[0]); c > 0 || c == 0 && bytes.Compare(prev[1], cur[1]) >= 0 {
+			t.Fatalf("%q sorted before %q", prev, cur)
+		}
+	}
+	if len(all) != 5*len(users) {
+		t.Errorf("%d keys in all", len(all))
+	}
+	if kvs, _ := db.ScanPrefixTuple([]byte("a"), kv.EncodeUint64(3)); len(kvs) != 1 {
+		t.Errorf("both segments fixed: %d KVs", len(kvs))
+	}
+	if _, err := kv.DecodeTuple([]byte("\x03ab")); !errors.Is(err, record.ErrBadRecord) {
+		t.Errorf("DecodeTuple of a cut key: %v", err)
+	}
+}
+
+func TestKVPlan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	defer db.Close()
+	db.Set([]byte("existing"), []byte("value"))
+	before, err := db.FileStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsyncs := db.FsyncCount()
+
+	stats, err := db.Plan(func(txn *kv.Txn) {
+		for i := 0; i < 1000; i++ {
+			txn.Set([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte("v"), 100))
+		}
+		txn.Set(bytes.Repeat([]byte("k"), btree.BTREE_MAX_KEY_SIZE+1), nil)
+		if err := txn.Commit(); !errors.Is(err, kv.ErrTxnDone) {
+			t.Errorf("Commit in a plan: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ~120 KB of leaves in 4 KB pages at least, and at most a copied
+	// path of 2 levels plus a split for each insert
+	if stats.PagesAppended < 30 || stats.PagesAppended > 3000 {
+		t.Errorf("%d pages appended", stats.PagesAppended)
+	}
+	if stats.Splits < 30 || stats.Merges != 0 {
+		t.Errorf("%d splits %d merges", stats.Splits, stats.Merges)
+	}
+	if stats.Rejected != 1 || !errors.Is(stats.Err, btree.ErrKeyTooLarge) {
+		t.Errorf("rejected %d: %v", stats.Rejected, stats.Err)
+	}
+
+	after, err := db.FileStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before || db.FsyncCount() != fsyncs {
+		t.Errorf("file changed: %+v -> %+v, %d fsyncs", before, after, db.FsyncCount()-fsyncs)
+	}
+	if _, ok, _ := db.Get([]byte("key0000")); ok || db.Count() != 1 {
+		t.Errorf("planned update visible, %d keys", db.Count())
+	}
+
+	// the planned counts match the real update
+	txn := db.Begin()
+	for i := 0; i < 1000; i++ {
+		txn.Set([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte("v"), 100))
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ = db.FileStats()
+	if grown := after.TotalPages - before.TotalPages; grown != int64(stats.PagesAppended) {
+		t.Errorf("%d pages appended, %d planned", grown, stats.PagesAppended)
+	}
+
+	stats, err = db.Plan(func(txn *kv.Txn) {
+		for i := 0; i < 1000; i++ {
+			txn.Del([]byte(fmt.Sprintf("key%04d", i)))
+		}
+	})
+	if err != nil || stats.Merges == 0 || stats.PagesFreed == 0 {
+		t.Errorf("planned delete: %+v, %v", stats, err)
+	}
+	if db.Count() != 1001 {
+		t.Errorf("%d keys after a planned delete", db.Count())
+	}
+}
+
+func TestKVStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	file, err := kv.OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := kv.NewMemStorage()
+	for name, storage := range map[string]kv.Storage{"file": file, "mem": mem} {
+		t.Run(name, func(t *testing.T) {
+			db := &kv.KV{Storage: storage}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			ref := map[string]string{}
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("key%d", i*7919%2000)
+				if i%3 == 2 {
+					db.Del([]byte(key))
+					delete(ref, key)
+				} else {
+					val := fmt.Sprintf("val%d-%s", i, bytes.Repeat([]byte("x"), i%300))
+					db.Set([]byte(key), []byte(val))
+					ref[key] = val
+				}
+			}
+			db.Set([]byte("large"), bytes.Repeat([]byte("l"), 20000))
+			ref["large"] = strings.Repeat("l", 20000)
+			if _, err := db.Truncate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the pages are still there once the KV is closed
+			if name == "file" {
+				storage = nil // closed, the file is opened at Path
+			}
+			db = &kv.KV{Path: path, Storage: storage}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if db.Count() != uint64(len(ref)) {
+				t.Errorf("%d keys, want %d", db.Count(), len(ref))
+			}
+			for key, val := range ref {
+				if got, ok, err := db.Get([]byte(key)); err != nil || !ok || string(got) != val {
+					t.Fatalf("Get(%q) = %q, %v, %v", key, got, ok, err)
+				}
+			}
+			// snapshots read without the lock while the writer goes on
+			snap := db.Snapshot()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key, val := range ref {
+					if got, _, err := snap.Get([]byte(key)); err != nil || string(got) != val {
+						t.Errorf("snapshot Get(%q) = %q, %v", key, got, err)
+						return
+					}
+				}
+			}()
+			for i := 0; i < 500; i++ {
+				db.Set([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte("n"), 200))
+			}
+			wg.Wait()
+			snap.Close()
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := db.FileStats()
+			if err != nil || stats.FileSize != stats.TotalPages*btree.BTREE_PAGE_SIZE {
+				t.Errorf("FileStats = %+v, %v", stats, err)
+			}
+		})
+	}
+
+	// the log and Compact work on files
+	db := &kv.KV{Storage: mem}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Compact(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Compact on a MemStorage: %v", err)
+	}
+	db.Close()
+	db = &kv.KV{Storage: mem, WAL: true}
+	if err := db.Open(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Open with a log on a MemStorage: %v", err)
+	}
+	empty := &kv.KV{Storage: kv.NewMemStorage(), ReadOnly: true}
+	if err := empty.Open(); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("open an empty MemStorage read-only: %v", err)
+	}
+
+	// a page read before it's written again keeps its bytes
+	page, err := mem.ReadAt(0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := bytes.Clone(page)
+	if err := mem.WriteAt(0, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(page, before) {
+		t.Error("WriteAt changed the bytes returned by an earlier ReadAt")
+	}
+}
+
+func TestKVRepairFreeList(t *testing.T) {
+	for name, head := range map[string]func(root uint64) uint64{
+		"past the end": func(uint64) uint64 { return 1 << 40 },
+		"tree page":    func(root uint64) uint64 { return root },
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db := openKV(t, path)
+			for i := 0; i < 2000; i++ {
+				db.Set([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte("v"), 100))
+			}
+			db.Set([]byte("big"), bytes.Repeat([]byte("b"), 20000)) // overflow pages
+			for i := 0; i < 2000; i += 2 {
+				db.Del([]byte(fmt.Sprintf("key%04d", i)))
+			}
+			before, _ := db.FileStats()
+			db.Close()
+
+			fp, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := make([]byte, 8)
+			if _, err := fp.ReadAt(root, 0); err != nil {
+				t.Fatal(err)
+			}
+			bad := binary.LittleEndian.AppendUint64(nil, head(binary.LittleEndian.Uint64(root)))
+			if _, err := fp.WriteAt(bad, 24); err != nil {
+				t.Fatal(err)
+			}
+			fp.Close()
+
+			db = &kv.KV{Path: path, RepairFreeList: true}
+			if err := db.Open(); err != nil {
+				t.Fatalf("open with RepairFreeList: %v", err)
+			}
+			// the old free list nodes are free pages now
+			if n := db.RepairedPages(); n < int(before.FreePages) || n > int(before.FreePages+before.FreeListPages) {
+				t.Errorf("%d pages repaired, %+v before", n, before)
+			}
+			stats, err := db.FileStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.LivePages != before.LivePages || stats.TotalPages != 1+stats.LivePages+stats.FreePages+stats.FreeListPages {
+				t.Errorf("%+v after the repair, %+v before", stats, before)
+			}
+			if err := db.Verify(); err != nil || db.Count() != 1001 {
+				t.Fatalf("verify: %v, %d keys", err, db.Count())
+			}
+			if val, ok, _ := db.Get([]byte("big")); !ok || len(val) != 20000 {
+				t.Errorf("overflow value: %d bytes", len(val))
+			}
+			// the free pages are reused
+			for i := 0; i < 2000; i += 2 {
+				db.Set([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte("w"), 100))
+			}
+			if after, _ := db.FileStats(); after.TotalPages > stats.TotalPages+stats.TotalPages/4 {
+				t.Errorf("%d pages after refilling, %d before", after.TotalPages, stats.TotalPages)
+			}
+			db.Close()
+			db = openKV(t, path) // durable without RepairFreeList
+			defer db.Close()
+			if db.RepairedPages() != 0 || db.Count() != 2001 {
+				t.Errorf("reopen: %d repaired, %d keys", db.RepairedPages(), db.Count())
+			}
+		})
+	}
+}
+
+// snapshots taken while renames run see the value under exactly one key
+func TestKVRenameSnapshot(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	keys := [2][]byte{[]byte("left"), []byte("right")}
+	big := bytes.Repeat([]byte{'v'}, 2*btree.BTREE_PAGE_SIZE) // with overflow pages
+	db.Set(keys[0], big)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			if ok, err := db.Rename(keys[i%2], keys[(i+1)%2]); !ok || err != nil {
+				t.Errorf("rename %d: %v, %v", i, ok, err)
+				return
+			}
+		}
+	}()
+	for checked := 0; ; checked++ {
+		select {
+		case <-done:
+			if checked == 0 {
+				t.Error("no snapshot checked")
+			}
+			return
+		default:
+		}
+		snap := db.Snapshot()
+		found := 0
+		for _, key := range keys {
+			val, ok, err := snap.Get(key)
+			if err != nil || ok && !bytes.Equal(val, big) {
+				t.Fatalf("snapshot Get(%s) = %d bytes, %v", key, len(val), err)
+			}
+			if ok {
+				found++
+			}
+		}
+		snap.Close()
+		if found != 1 {
+			t.Fatalf("the value under %d keys", found)
+		}
+	}
+}
+
+func TestKVWriteBatchPages(t *testing.T) {
+	for _, limit := range []int{1, 3, 0} {
+		path := filepath.Join(t.TempDir(), "db")
+		db := &kv.KV{Path: path, WriteBatchPages: limit}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		batch := db.Batch()
+		for i := 0; i < 10000; i++ {
+			batch.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("val"))
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		stats, _ := db.FileStats()
+		pages := uint64(stats.TotalPages - 1)
+		switch writes := db.WriteCount(); {
+		case limit == 1 && writes != pages:
+			t.Errorf("one by one: %d writes for %d pages", writes, pages)
+		case limit == 3 && writes != (pages+2)/3:
+			t.Errorf("by 3: %d writes for %d pages", writes, pages)
+		case limit == 0 && writes != (pages+kv.WRITE_BATCH_PAGES-1)/kv.WRITE_BATCH_PAGES:
+			t.Errorf("%d writes for %d pages", writes, pages)
+		}
+		// the pages were written where they belong
+		for i := 0; i < 5000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i*2)), []byte("new"))
+		}
+		db.Close()
+		db = openKV(t, path)
+		if err := db.Verify(); err != nil || db.Count() != 10000 {
+			t.Fatalf("reopen: %v, %d keys", err, db.Count())
+		}
+		for i := 0; i < 10000; i++ {
+			want := map[bool]string{true: "new", false: "val"}[i%2 == 0]
+			if val, _, _ := db.Get([]byte(fmt.Sprintf("key%05d", i))); string(val) != want {
+				t.Fatalf("key%05d = %q", i, val)
+			}
+		}
+		db.Close()
+	}
+}
+
+func BenchmarkKVInsert10k(b *testing.B) {
+	for _, limit := range []int{1, 0} {
+		b.Run(fmt.Sprintf("WriteBatchPages=%d", limit), func(b *testing.B) {
+			writes := uint64(0)
+			for i := 0; i < b.N; i++ {
+				db := &kv.KV{Path: filepath.Join(b.TempDir(), "db"), WriteBatchPages: limit}
+				if err := db.Open(); err != nil {
+					b.Fatal(err)
+				}
+				batch := db.Batch()
+				for j := 0; j < 10000; j++ {
+					batch.Set([]byte(fmt.Sprintf("key%05d", j)), []byte("val"))
+				}
+				if err := batch.Commit(); err != nil {
+					b.Fatal(err)
+				}
+				writes += db.WriteCount()
+				db.Close()
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestKVKeys(t *testing.T) {
+	db := openKV(t, filepath.Join(t.TempDir(), "db"))
+	defer db.Close()
+	batch := db.Batch()
+	for i := 0; i < 1000; i++ {
+		val := bytes.Repeat([]byte("v"), 100)
+		if i%100 == 0 {
+			val = bytes.Repeat([]byte("o"), 3*btree.BTREE_PAGE_SIZE) // overflow
+		}
+		batch.Set([]byte(fmt.Sprintf("key%04d", i)), val)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bounds := range [][2]string{{"", ""}, {"key0100", "key0200"}, {"key0995", ""}, {"z", ""}} {
+		start, end := []byte(bounds[0]), []byte(bounds[1])
+		var want, got []string
+		for key := range db.Range(start, end) {
+			want = append(want, string(key))
+		}
+		for key := range db.Keys(start, end) {
+			got = append(got, string(key))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Keys(%q, %q): %d keys, Range %d", start, end, len(got), len(want))
+		}
+	}
+	for key := range db.Keys(nil, nil) {
+		if string(key) != "key0000" {
+			t.Errorf("first key %q", key)
+		}
+		break
+	}
+
+	keys := testing.AllocsPerRun(5, func() {
+		for range db.Keys(nil, nil) {
+		}
+	})
+	kvs := testing.AllocsPerRun(5, func() {
+		for range db.Range(nil, nil) {
+		}
+	})
+	if keys >= kvs/2 {
+		t.Errorf("%.0f allocations for Keys, %.0f for Range", keys, kvs)
+	}
+}
+
+func TestKVTruncate(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "db")
+		db := &kv.KV{Path: path, WAL: wal}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := db.Truncate(); n != 0 || err != nil {
+			t.Errorf("empty file: %d, %v", n, err)
+		}
+		batch := db.Batch()
+		for i := 0; i < 5000; i++ {
+			batch.Set([]byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte("v"), 200))
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		// the values of the tail half were written last, at the end of the file
+		db.Set([]byte("big"), bytes.Repeat([]byte("b"), 10*btree.BTREE_PAGE_SIZE))
+		for i := 2500; i < 5000; i++ {
+			db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		}
+		db.Del([]byte("big"))
+		before, _ := db.FileStats()
+
+		snap := db.Snapshot()
+		if _, err := db.Truncate(); !errors.Is(err, kv.ErrSnapshotsOpen) {
+			t.Errorf("with a snapshot: %v", err)
+		}
+		snap.Close()
+		n, err := db.Truncate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _ := db.FileStats()
+		if n == 0 || after.FileSize >= before.FileSize || after.TotalPages != before.TotalPages-int64(n) {
+			t.Errorf("wal %v: %d pages cut, %+v -> %+v", wal, n, before, after)
+		}
+		if after.FileSize != after.TotalPages*btree.BTREE_PAGE_SIZE || after.TotalPages != 1+after.LivePages+after.FreePages+after.FreeListPages {
+			t.Errorf("wal %v: %+v", wal, after)
+		}
+		if after.LivePages != before.LivePages {
+			t.Errorf("wal %v: %d live pages, %d before", wal, after.LivePages, before.LivePages)
+		}
+		if n, err := db.Truncate(); n != 0 || err != nil {
+			t.Errorf("again: %d, %v", n, err)
+		}
+
+		// the file grows back and the data survives a reopen
+		for i := 2500; i < 3000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("again"))
+		}
+		db.Close()
+		db = &kv.KV{Path: path, WAL: wal}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Verify(); err != nil || db.Count() != 3000 {
+			t.Fatalf("wal %v: %v, %d keys", wal, err, db.Count())
+		}
+		if val, _, _ := db.Get([]byte("key02999")); string(val) != "again" {
+			t.Errorf("wal %v: key02999 = %q", wal, val)
+		}
+		if val, _, _ := db.Get([]byte("key00000")); len(val) != 200 {
+			t.Errorf("wal %v: key00000 = %d bytes", wal, len(val))
+		}
+		db.Close()
+	}
+}
+
+func TestKVErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, path)
+	_, _, err := db.Set(bytes.Repeat([]byte("k"), btree.BTREE_MAX_KEY_SIZE+1), nil)
+	if !errors.Is(err, kv.ErrKeyTooLarge) || !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Errorf("large key: %v", err)
+	}
+	_, _, err = kv.NewMemKV().Set([]byte("k"), bytes.Repeat([]byte("v"), btree.BTREE_MAX_VALUE_SIZE+1))
+	if !errors.Is(err, kv.ErrValueTooLarge) {
+		t.Errorf("large value in a MemKV: %v", err)
+	}
+	db.Set([]byte("small"), []byte("v"))
+	db.Set([]byte("big"), bytes.Repeat([]byte("b"), 3*btree.BTREE_PAGE_SIZE))
+	if _, _, err := db.GetCapped([]byte("big"), 100); !errors.Is(err, kv.ErrValueTooLarge) {
+		t.Errorf("GetCapped: %v", err)
+	}
+	if _, err := db.Lookup([]byte("missing")); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Lookup of a missing key: %v", err)
+	}
+	if val, err := db.Lookup([]byte("small")); err != nil || string(val) != "v" {
+		t.Errorf("Lookup = %q, %v", val, err)
+	}
+	db.Close()
+
+	ro := &kv.KV{Path: path, ReadOnly: true}
+	if err := ro.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ro.Set([]byte("k"), []byte("v")); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Set on a read-only KV: %v", err)
+	}
+	ro.Close()
+
+	// damage the overflow chain: every page but the meta page, the root
+	// leaf and the free list node
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := make([]byte, kv.META_SIZE)
+	fp.ReadAt(meta, 0)
+	root, npages := binary.LittleEndian.Uint64(meta), binary.LittleEndian.Uint64(meta[8:])
+	head, tail := binary.LittleEndian.Uint64(meta[24:]), binary.LittleEndian.Uint64(meta[40:])
+	if head != tail {
+		t.Fatalf("free list nodes %d to %d", head, tail)
+	}
+	for ptr := uint64(1); ptr < npages; ptr++ {
+		if ptr != root && ptr != head {
+			fp.WriteAt([]byte{0xff}, int64(ptr*btree.BTREE_PAGE_SIZE+100))
+		}
+	}
+	fp.Close()
+	db = openKV(t, path)
+	defer db.Close()
+	corrupt := func(op string, err error) {
+		t.Helper()
+		if !errors.Is(err, kv.ErrCorrupt) || !errors.Is(err, kv.ErrChecksumMismatch) || !errors.Is(err, btree.ErrCorrupt) {
+			t.Errorf("%s: %v", op, err)
+		}
+	}
+	_, err = db.Lookup([]byte("big"))
+	corrupt("Lookup", err)
+	_, _, err = db.Get([]byte("big"))
+	corrupt("Get", err)
+	_, _, _, err = db.GetWithFlags([]byte("big"))
+	corrupt("GetWithFlags", err)
+	_, err = db.Aggregate(nil, nil, func(acc, key, val []byte) []byte { return acc }, nil)
+	corrupt("Aggregate", err)
+	_, _, err = db.ScanBounded(nil, nil, 1<<20)
+	corrupt("ScanBounded", err)
+	_, _, err = db.GetCapped([]byte("big"), 1<<20)
+	corrupt("GetCapped", err)
+	// the length is in the leaf, the damaged chain isn't read
+	if _, ok, err := db.GetCapped([]byte("big"), 100); !ok || !errors.Is(err, kv.ErrValueTooLarge) || errors.Is(err, kv.ErrCorrupt) {
+		t.Errorf("GetCapped over the cap = %v, %v", ok, err)
+	}
+	_, _, err = db.Del([]byte("big"))
+	corrupt("Del", err)
+	_, _, err = db.Set([]byte("big"), []byte("new"))
+	corrupt("Set", err)
+	if val, err := db.Lookup([]byte("small")); err != nil || string(val) != "v" {
+		t.Errorf("Lookup after the failed updates = %q, %v", val, err)
+	}
+
+	// nothing of a failed merge is committed
+	fresh := openKV(t, filepath.Join(filepath.Dir(path), "fresh"))
+	defer fresh.Close()
+	fresh.Set([]byte("kept"), []byte("v"))
+	corrupt("Merge", kv.Merge(fresh, db, nil))
+	if _, ok, _ := fresh.Get([]byte("small")); ok || fresh.Count() != 1 {
+		t.Errorf("the failed merge left %d keys", fresh.Count())
+	}
+}
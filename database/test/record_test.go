@@ -0,0 +1,60 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"project/record"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	vals := []record.Value{
+		record.Int64(-42),
+		record.String("hello"),
+		record.Bytes([]byte{0x00, 0x01, 0x02, 0xff}),
+		record.Int64(math.MinInt64),
+		record.String(""),
+		record.Int64(math.MaxInt64),
+	}
+	got := record.DecodeRecord(record.EncodeRecord(vals))
+	if !reflect.DeepEqual(got, vals) {
+		t.Errorf("DecodeRecord = %+v, want %+v", got, vals)
+	}
+}
+
+func TestRecordOrder(t *testing.T) {
+	ints := []int64{math.MinInt64, -1 << 40, -300, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+	strs := []string{"", "\x00", "\x00\x00", "\x01", "a", "a\x00", "a\x01", "ab", "b"}
+	var recs [][]byte
+	for _, i := range ints {
+		for _, s := range strs {
+			recs = append(recs, record.EncodeRecord([]record.Value{record.Int64(i), record.String(s)}))
+		}
+	}
+	// generated in order
+	if !sort.SliceIsSorted(recs, func(a, b int) bool { return bytes.Compare(recs[a], recs[b]) < 0 }) {
+		t.Error("encoded records are not in column order")
+	}
+	for i := 1; i < len(recs); i++ {
+		if bytes.Equal(recs[i-1], recs[i]) {
+			t.Errorf("records %d and %d encode the same", i-1, i)
+		}
+	}
+}
+
+func TestRecordMalformed(t *testing.T) {
+	good := record.EncodeRecord([]record.Value{record.Int64(7), record.String("x")})
+	for _, data := range [][]byte{good[:5], good[:len(good)-1], {9}, {record.TYPE_BYTES, 0x01, 0x05, 0x00}} {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, record.ErrBadRecord) {
+					t.Errorf("DecodeRecord(%x) panicked with %v", data, err)
+				}
+			}()
+			record.DecodeRecord(data)
+		}()
+	}
+}
@@ -0,0 +1,61 @@
+package testutil
+
+import (
+	"math/rand"
+	"project/utils"
+)
+
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
+// the shape of the generated keys
+type Dist int
+
+const (
+	Uniform      Dist = iota // independent random keys
+	SharedPrefix             // most of the key is one of a few common prefixes
+)
+
+const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// GenKeys returns n distinct KVs in random order, the same ones for the same
+// seed, so a failing test can be replayed exactly.
+func GenKeys(seed int64, n, keyLen, valLen int) []KV {
+	return GenKeysDist(seed, n, keyLen, valLen, Uniform)
+}
+
+func GenKeysDist(seed int64, n, keyLen, valLen int, dist Dist) []KV {
+	rng := rand.New(rand.NewSource(seed))
+	randBytes := func(size int) []byte {
+		out := make([]byte, size)
+		for i := range out {
+			out[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return out
+	}
+
+	var prefixes [][]byte
+	if dist == SharedPrefix {
+		for i := 0; i < 4; i++ {
+			prefixes = append(prefixes, randBytes(keyLen*3/4))
+		}
+	}
+
+	seen := map[string]bool{}
+	out := make([]KV, 0, n)
+	for attempts := 0; len(out) < n; attempts++ {
+		utils.Assert(attempts < 100*n, "key space too small for n distinct keys")
+		key := randBytes(keyLen)
+		if dist == SharedPrefix {
+			copy(key, prefixes[rng.Intn(len(prefixes))])
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		out = append(out, KV{Key: key, Val: randBytes(valLen)})
+	}
+	return out
+}